@@ -5,8 +5,78 @@
 
 package main
 
-import "github.com/vmware-samples/go-redis-pmem/redis"
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/vmware-samples/go-redis-pmem/redis"
+)
 
 func main() {
-	redis.RunServer()
+	def := redis.DefaultConfig()
+	configFile := flag.String("config", "", "redis.conf style configuration file")
+	// Every other flag is named after its configuration directive and, when
+	// given, overrides the value read from the configuration file.
+	flag.String("pool-path", def.PoolPath, "persistent memory pool file")
+	flag.String("pool-size", "0", "bytes to preallocate for a new pool, e.g. 4gb")
+	flag.String("bind", "", "interface to accept clients on")
+	flag.String("port", "6379", "TCP port to accept clients on")
+	flag.String("rehash-interval", millis(def.RehashInterval), "milliseconds between rehash steps")
+	flag.String("expire-interval", millis(def.ExpireInterval), "milliseconds between active expire cycles")
+	flag.String("dict-init-size", strconv.Itoa(def.DictInitSize), "initial buckets of the keyspace dict")
+	flag.String("dict-bucket-per-shard", strconv.Itoa(def.DictBucketPerShard), "buckets per lock in the keyspace dict")
+	flag.String("expire-dict-init-size", strconv.Itoa(def.ExpireInitSize), "initial buckets of the expire dict")
+	flag.String("expire-dict-bucket-per-shard", strconv.Itoa(def.ExpireBucketPerShard), "buckets per lock in the expire dict")
+	flag.String("databases", strconv.Itoa(def.Databases), "number of databases")
+	flag.String("list-max-ziplist-size", strconv.Itoa(def.ListFill), "quicklist fill factor")
+	flag.String("hash-max-ziplist-entries", strconv.Itoa(def.HashMaxZiplistEntries), "max fields of a ziplist hash")
+	flag.String("hash-max-ziplist-value", strconv.Itoa(def.HashMaxZiplistValue), "max field or value length of a ziplist hash")
+	flag.String("set-max-intset-entries", strconv.Itoa(def.SetMaxIntsetEntries), "max members of an intset")
+	flag.String("proto-max-bulk-len", "512mb", "max length of a bulk string in a query")
+	flag.String("notify-keyspace-events", "", "classes of keyspace events to publish, e.g. KEA")
+	flag.String("maxmemory", "0", "bytes the keys may use before eviction, e.g. 2gb")
+	flag.String("maxmemory-policy", "noeviction", "eviction policy over maxmemory, e.g. allkeys-lru")
+	flag.String("maxmemory-samples", strconv.Itoa(def.MaxMemorySamples), "keys sampled per db to pick one to evict")
+	flag.Parse()
+
+	cfg := def
+	if *configFile != "" {
+		var err error
+		if cfg, err = redis.LoadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if err := cfg.Set(f.Name, f.Value.String()); err != nil {
+			log.Fatal(err)
+		}
+	})
+
+	srv := redis.NewServer(cfg)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Shutdown:", err)
+		}
+	}()
+	if err := srv.Start(); err != redis.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
 }
@@ -1,344 +0,0 @@
-///////////////////////////////////////////////////////////////////////
-// Copyright 2018-2019 VMware, Inc.
-// SPDX-License-Identifier: BSD-2-Clause
-///////////////////////////////////////////////////////////////////////
-
-#include "textflag.h"
-
-TEXT ·aeshashstr(SB),NOSPLIT,$0-24
-	MOVQ	p+0(FP), AX	// ptr to string struct
-	MOVQ	8(AX), CX	// length of string
-	MOVQ	(AX), AX	// string data
-	LEAQ	ret+16(FP), DX
-	JMP	runtime·aeshashbody(SB)
-
-// AX: data
-// CX: length
-// DX: address to put return value
-TEXT ·aeshashbody(SB),NOSPLIT,$0-0
-	// Fill an SSE register with our seeds.
-	MOVQ	h+8(FP), X0			// 64 bits of per-table hash seed
-	PINSRW	$4, CX, X0			// 16 bits of length
-	PSHUFHW $0, X0, X0			// repeat length 4 times total
-	MOVO	X0, X1				// save unscrambled seed
-	PXOR	runtime·aeskeysched(SB), X0	// xor in per-process seed
-	AESENC	X0, X0				// scramble seed
-
-	CMPQ	CX, $16
-	JB	aes0to15
-	JE	aes16
-	CMPQ	CX, $32
-	JBE	aes17to32
-	CMPQ	CX, $64
-	JBE	aes33to64
-	CMPQ	CX, $128
-	JBE	aes65to128
-	JMP	aes129plus
-
-aes0to15:
-	TESTQ	CX, CX
-	JE	aes0
-
-	ADDQ	$16, AX
-	TESTW	$0xff0, AX
-	JE	endofpage
-
-	// 16 bytes loaded at this address won't cross
-	// a page boundary, so we can load it directly.
-	MOVOU	-16(AX), X1
-	ADDQ	CX, CX
-	MOVQ	$masks<>(SB), AX
-	PAND	(AX)(CX*8), X1
-final1:
-	PXOR	X0, X1	// xor data with seed
-	AESENC	X1, X1	// scramble combo 3 times
-	AESENC	X1, X1
-	AESENC	X1, X1
-	MOVQ	X1, (DX)
-	RET
-
-endofpage:
-	// address ends in 1111xxxx. Might be up against
-	// a page boundary, so load ending at last byte.
-	// Then shift bytes down using pshufb.
-	MOVOU	-32(AX)(CX*1), X1
-	ADDQ	CX, CX
-	MOVQ	$shifts<>(SB), AX
-	PSHUFB	(AX)(CX*8), X1
-	JMP	final1
-
-aes0:
-	// Return scrambled input seed
-	AESENC	X0, X0
-	MOVQ	X0, (DX)
-	RET
-
-aes16:
-	MOVOU	(AX), X1
-	JMP	final1
-
-aes17to32:
-	// make second starting seed
-	PXOR	runtime·aeskeysched+16(SB), X1
-	AESENC	X1, X1
-	
-	// load data to be hashed
-	MOVOU	(AX), X2
-	MOVOU	-16(AX)(CX*1), X3
-
-	// xor with seed
-	PXOR	X0, X2
-	PXOR	X1, X3
-
-	// scramble 3 times
-	AESENC	X2, X2
-	AESENC	X3, X3
-	AESENC	X2, X2
-	AESENC	X3, X3
-	AESENC	X2, X2
-	AESENC	X3, X3
-
-	// combine results
-	PXOR	X3, X2
-	MOVQ	X2, (DX)
-	RET
-
-aes33to64:
-	// make 3 more starting seeds
-	MOVO	X1, X2
-	MOVO	X1, X3
-	PXOR	runtime·aeskeysched+16(SB), X1
-	PXOR	runtime·aeskeysched+32(SB), X2
-	PXOR	runtime·aeskeysched+48(SB), X3
-	AESENC	X1, X1
-	AESENC	X2, X2
-	AESENC	X3, X3
-	
-	MOVOU	(AX), X4
-	MOVOU	16(AX), X5
-	MOVOU	-32(AX)(CX*1), X6
-	MOVOU	-16(AX)(CX*1), X7
-
-	PXOR	X0, X4
-	PXOR	X1, X5
-	PXOR	X2, X6
-	PXOR	X3, X7
-	
-	AESENC	X4, X4
-	AESENC	X5, X5
-	AESENC	X6, X6
-	AESENC	X7, X7
-	
-	AESENC	X4, X4
-	AESENC	X5, X5
-	AESENC	X6, X6
-	AESENC	X7, X7
-	
-	AESENC	X4, X4
-	AESENC	X5, X5
-	AESENC	X6, X6
-	AESENC	X7, X7
-
-	PXOR	X6, X4
-	PXOR	X7, X5
-	PXOR	X5, X4
-	MOVQ	X4, (DX)
-	RET
-
-aes65to128:
-	// make 7 more starting seeds
-	MOVO	X1, X2
-	MOVO	X1, X3
-	MOVO	X1, X4
-	MOVO	X1, X5
-	MOVO	X1, X6
-	MOVO	X1, X7
-	PXOR	runtime·aeskeysched+16(SB), X1
-	PXOR	runtime·aeskeysched+32(SB), X2
-	PXOR	runtime·aeskeysched+48(SB), X3
-	PXOR	runtime·aeskeysched+64(SB), X4
-	PXOR	runtime·aeskeysched+80(SB), X5
-	PXOR	runtime·aeskeysched+96(SB), X6
-	PXOR	runtime·aeskeysched+112(SB), X7
-	AESENC	X1, X1
-	AESENC	X2, X2
-	AESENC	X3, X3
-	AESENC	X4, X4
-	AESENC	X5, X5
-	AESENC	X6, X6
-	AESENC	X7, X7
-
-	// load data
-	MOVOU	(AX), X8
-	MOVOU	16(AX), X9
-	MOVOU	32(AX), X10
-	MOVOU	48(AX), X11
-	MOVOU	-64(AX)(CX*1), X12
-	MOVOU	-48(AX)(CX*1), X13
-	MOVOU	-32(AX)(CX*1), X14
-	MOVOU	-16(AX)(CX*1), X15
-
-	// xor with seed
-	PXOR	X0, X8
-	PXOR	X1, X9
-	PXOR	X2, X10
-	PXOR	X3, X11
-	PXOR	X4, X12
-	PXOR	X5, X13
-	PXOR	X6, X14
-	PXOR	X7, X15
-
-	// scramble 3 times
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-
-	// combine results
-	PXOR	X12, X8
-	PXOR	X13, X9
-	PXOR	X14, X10
-	PXOR	X15, X11
-	PXOR	X10, X8
-	PXOR	X11, X9
-	PXOR	X9, X8
-	MOVQ	X8, (DX)
-	RET
-
-aes129plus:
-	// make 7 more starting seeds
-	MOVO	X1, X2
-	MOVO	X1, X3
-	MOVO	X1, X4
-	MOVO	X1, X5
-	MOVO	X1, X6
-	MOVO	X1, X7
-	PXOR	runtime·aeskeysched+16(SB), X1
-	PXOR	runtime·aeskeysched+32(SB), X2
-	PXOR	runtime·aeskeysched+48(SB), X3
-	PXOR	runtime·aeskeysched+64(SB), X4
-	PXOR	runtime·aeskeysched+80(SB), X5
-	PXOR	runtime·aeskeysched+96(SB), X6
-	PXOR	runtime·aeskeysched+112(SB), X7
-	AESENC	X1, X1
-	AESENC	X2, X2
-	AESENC	X3, X3
-	AESENC	X4, X4
-	AESENC	X5, X5
-	AESENC	X6, X6
-	AESENC	X7, X7
-	
-	// start with last (possibly overlapping) block
-	MOVOU	-128(AX)(CX*1), X8
-	MOVOU	-112(AX)(CX*1), X9
-	MOVOU	-96(AX)(CX*1), X10
-	MOVOU	-80(AX)(CX*1), X11
-	MOVOU	-64(AX)(CX*1), X12
-	MOVOU	-48(AX)(CX*1), X13
-	MOVOU	-32(AX)(CX*1), X14
-	MOVOU	-16(AX)(CX*1), X15
-
-	// xor in seed
-	PXOR	X0, X8
-	PXOR	X1, X9
-	PXOR	X2, X10
-	PXOR	X3, X11
-	PXOR	X4, X12
-	PXOR	X5, X13
-	PXOR	X6, X14
-	PXOR	X7, X15
-	
-	// compute number of remaining 128-byte blocks
-	DECQ	CX
-	SHRQ	$7, CX
-	
-aesloop:
-	// scramble state
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-
-	// scramble state, xor in a block
-	MOVOU	(AX), X0
-	MOVOU	16(AX), X1
-	MOVOU	32(AX), X2
-	MOVOU	48(AX), X3
-	AESENC	X0, X8
-	AESENC	X1, X9
-	AESENC	X2, X10
-	AESENC	X3, X11
-	MOVOU	64(AX), X4
-	MOVOU	80(AX), X5
-	MOVOU	96(AX), X6
-	MOVOU	112(AX), X7
-	AESENC	X4, X12
-	AESENC	X5, X13
-	AESENC	X6, X14
-	AESENC	X7, X15
-
-	ADDQ	$128, AX
-	DECQ	CX
-	JNE	aesloop
-
-	// 3 more scrambles to finish
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-	AESENC	X8, X8
-	AESENC	X9, X9
-	AESENC	X10, X10
-	AESENC	X11, X11
-	AESENC	X12, X12
-	AESENC	X13, X13
-	AESENC	X14, X14
-	AESENC	X15, X15
-
-	PXOR	X12, X8
-	PXOR	X13, X9
-	PXOR	X14, X10
-	PXOR	X15, X11
-	PXOR	X10, X8
-	PXOR	X11, X9
-	PXOR	X9, X8
-	MOVQ	X8, (DX)
-	RET
@@ -0,0 +1,213 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Clients blocked by BLPOP and friends wait in volatile memory, they are
+// dropped by a restart like any other connection state. A blocked command
+// registers its client on the keys while it still holds their locks, so a
+// push can't slip in between the empty check and the registration. Pushers
+// only mark the keys as ready, and the first waiter of a ready key is woken
+// once the transaction of the pusher has committed. The waiter then runs its
+// command again in its own transaction and replies only after that one
+// committed, so a popped element is durable before it is delivered. If the
+// list still has elements the waiter marks the key ready again, which wakes
+// the next waiter in FIFO order.
+
+type blockKey struct {
+	dbid int
+	key  string
+}
+
+type blocking struct {
+	mu   sync.Mutex
+	keys map[blockKey][]*client // waiters of each key, oldest first
+}
+
+type blockState struct {
+	dbid      int
+	keys      [][]byte
+	timeout   time.Time // zero blocks forever
+	ready     chan struct{}
+	onTimeout func(*client) // replies the timeout
+}
+
+func newBlocking() *blocking {
+	return &blocking{keys: make(map[blockKey][]*client)}
+}
+
+// getTimeoutOrReply parses a timeout in seconds, 0 means forever.
+func (c *client) getTimeoutOrReply(arg []byte) (time.Time, bool) {
+	t, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(t) || math.IsInf(t, 0) {
+		c.addReplyError([]byte("timeout is not a float or out of range"))
+		return time.Time{}, false
+	}
+	if t < 0 {
+		c.addReplyError([]byte("timeout is negative"))
+		return time.Time{}, false
+	}
+	if t == 0 {
+		return time.Time{}, true
+	}
+	return time.Now().Add(time.Duration(t * float64(time.Second))), true
+}
+
+// blockForKeys registers c as a waiter of keys, whose locks must be held. It
+// does nothing if c is already blocked, a woken client keeps its place in the
+// queues until it is served.
+func (c *client) blockForKeys(keys [][]byte, timeout time.Time, onTimeout func(*client)) {
+	if c.bstate != nil {
+		return
+	}
+	bs := &blockState{dbid: c.dbid, timeout: timeout, ready: make(chan struct{}, 1),
+		onTimeout: onTimeout}
+	for _, key := range keys {
+		bs.keys = append(bs.keys, append([]byte(nil), key...))
+	}
+	b := c.s.blocking
+	b.mu.Lock()
+	c.bstate = bs
+	for _, bk := range bs.blockKeys() {
+		b.keys[bk] = append(b.keys[bk], c)
+	}
+	b.mu.Unlock()
+}
+
+// unblock removes c from the queues of its keys.
+func (c *client) unblock() {
+	if c.bstate == nil {
+		return
+	}
+	b := c.s.blocking
+	b.mu.Lock()
+	for _, bk := range c.bstate.blockKeys() {
+		q := b.keys[bk]
+		for i, w := range q {
+			if w == c {
+				q = append(q[:i], q[i+1:]...)
+				break
+			}
+		}
+		if len(q) == 0 {
+			delete(b.keys, bk)
+		} else {
+			b.keys[bk] = q
+		}
+	}
+	c.bstate = nil
+	b.mu.Unlock()
+}
+
+func (bs *blockState) blockKeys() []blockKey {
+	bks := make([]blockKey, len(bs.keys))
+	for i, key := range bs.keys {
+		bks[i] = blockKey{bs.dbid, string(key)}
+	}
+	return bks
+}
+
+// signalKeyAsReady records that key in the selected db got elements a waiter
+// may pop. The waiter is woken by call once the transaction of c has
+// committed.
+func (c *client) signalKeyAsReady(key []byte) {
+	c.signalDbKeyAsReady(c.dbid, key)
+}
+
+func (c *client) signalDbKeyAsReady(dbid int, key []byte) {
+	bk := blockKey{dbid, string(key)}
+	b := c.s.blocking
+	b.mu.Lock()
+	_, ok := b.keys[bk]
+	b.mu.Unlock()
+	if ok {
+		c.readyKeys = append(c.readyKeys, bk)
+	}
+}
+
+// signalDbAsReady records every key of db dbid that has waiters, e.g., after
+// SWAPDB gave the db new contents.
+func (c *client) signalDbAsReady(dbid int) {
+	b := c.s.blocking
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for bk := range b.keys {
+		if bk.dbid == dbid {
+			c.readyKeys = append(c.readyKeys, bk)
+		}
+	}
+}
+
+// wakeReady wakes the oldest waiter of each key.
+func (b *blocking) wakeReady(keys []blockKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, bk := range keys {
+		if q := b.keys[bk]; len(q) > 0 {
+			select {
+			case q[0].bstate.ready <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// waitForKeys waits until c is woken, times out or the server shuts down,
+// and returns false in the last case. A client that timed out or went away
+// meanwhile is unblocked, and the keys are passed on to the next waiters in
+// case c took their wakeup.
+func (c *client) waitForKeys() bool {
+	bs := c.bstate
+	c.flush()
+	var expired <-chan time.Time
+	if !bs.timeout.IsZero() {
+		timer := time.NewTimer(time.Until(bs.timeout))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-bs.ready:
+		if c.connAlive() {
+			return true
+		}
+	case <-expired:
+		bs.onTimeout(c)
+	case <-c.s.quit:
+		c.unblock()
+		return false
+	}
+	c.unblock()
+	c.s.blocking.wakeReady(bs.blockKeys())
+	return true
+}
+
+// connAlive reports whether the peer of c is still connected, without
+// consuming pending queries. A woken client checks it before popping, an
+// element handed to a closed connection would be lost.
+func (c *client) connAlive() bool {
+	if c.conn == nil {
+		return true
+	}
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	alive := false
+	rc.Read(func(fd uintptr) bool {
+		var b [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		alive = n > 0 || err == syscall.EAGAIN || err == syscall.EWOULDBLOCK
+		return true
+	})
+	return alive
+}
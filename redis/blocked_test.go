@@ -0,0 +1,64 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBlockedClients(t *testing.T) {
+	createSharedObjects()
+	s := NewServer(DefaultConfig())
+	c1, c2, pusher := s.newClient(nil), s.newClient(nil), s.newClient(nil)
+	woken := func(c *client) bool {
+		select {
+		case <-c.bstate.ready:
+			return true
+		default:
+			return false
+		}
+	}
+
+	fmt.Println("Parse blocking timeouts.")
+	_, ok := c1.getTimeoutOrReply([]byte("-1"))
+	assertEqual(t, ok, false)
+	_, ok = c1.getTimeoutOrReply([]byte("abc"))
+	assertEqual(t, ok, false)
+	assertEqual(t, c1.wBuffer.String(),
+		"-ERR timeout is negative\r\n-ERR timeout is not a float or out of range\r\n")
+	c1.wBuffer.Reset()
+	timeout, ok := c1.getTimeoutOrReply([]byte("0"))
+	assertEqual(t, ok, true)
+	assertEqual(t, timeout.IsZero(), true)
+
+	fmt.Println("Wake waiters of a ready key in FIFO order.")
+	c1.blockForKeys(argv("k1", "k2"), time.Time{}, (*client).addReplyNullArray)
+	c2.blockForKeys(argv("k1"), time.Time{}, (*client).addReplyNullArray)
+	pusher.signalKeyAsReady([]byte("nokey"))
+	assertEqual(t, len(pusher.readyKeys), 0)
+	pusher.signalKeyAsReady([]byte("k1"))
+	assertEqual(t, pusher.readyKeys, []blockKey{{0, "k1"}})
+	s.blocking.wakeReady(pusher.readyKeys)
+	assertEqual(t, woken(c1), true)
+	assertEqual(t, woken(c2), false)
+
+	fmt.Println("Pass the key on once the first waiter is served.")
+	c1.unblock()
+	assertEqual(t, c1.bstate, (*blockState)(nil))
+	_, ok = s.blocking.keys[blockKey{0, "k2"}]
+	assertEqual(t, ok, false)
+	s.blocking.wakeReady(pusher.readyKeys)
+	assertEqual(t, woken(c2), true)
+
+	fmt.Println("Reply the timeout and unblock.")
+	c2.bstate.timeout = time.Now()
+	assertEqual(t, c2.waitForKeys(), true)
+	assertEqual(t, c2.wBuffer.String(), "*-1\r\n")
+	assertEqual(t, c2.bstate, (*blockState)(nil))
+	assertEqual(t, len(s.blocking.keys), 0)
+}
@@ -0,0 +1,158 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Commands whose keys can not be described by firstkey, lastkey and keystep
+// find them with a getkeys function instead.
+var commandGetKeys = map[string]func(argv [][]byte) []int{
+	"ZUNIONSTORE": zunionInterGetKeys,
+	"ZINTERSTORE": zunionInterGetKeys,
+	"MEMORY":      memoryGetKeys,
+}
+
+// checkArity reports whether argc arguments are accepted by cmd.
+func (cmd *redisCommand) checkArity(argc int) bool {
+	if cmd.arity > 0 {
+		return argc == cmd.arity
+	}
+	return argc >= -cmd.arity
+}
+
+// getKeysFromCommand returns the positions of the key arguments in argv, which
+// must already have passed the arity check of cmd.
+func getKeysFromCommand(cmd *redisCommand, argv [][]byte) []int {
+	if getkeys, ok := commandGetKeys[cmd.name]; ok {
+		return getkeys(argv)
+	}
+	if cmd.firstkey == 0 {
+		return nil
+	}
+	last := cmd.lastkey
+	if last < 0 {
+		last += len(argv)
+	}
+	keys := make([]int, 0, (last-cmd.firstkey)/cmd.keystep+1)
+	for j := cmd.firstkey; j <= last && j < len(argv); j += cmd.keystep {
+		keys = append(keys, j)
+	}
+	return keys
+}
+
+// ZUNIONSTORE/ZINTERSTORE destination numkeys key [key ...] [options]
+func zunionInterGetKeys(argv [][]byte) []int {
+	num, err := slice2i(argv[2])
+	if err != nil || num < 1 || num > len(argv)-3 {
+		return nil
+	}
+	// input keys first, followed by the destination key
+	keys := make([]int, 0, num+1)
+	for i := 0; i < num; i++ {
+		keys = append(keys, 3+i)
+	}
+	return append(keys, 1)
+}
+
+func (c *client) addReplyCommandFlags(cmd *redisCommand) {
+	var flags []string
+	if cmd.flag&CMD_WRITE != 0 {
+		flags = append(flags, "write")
+	}
+	if cmd.flag&CMD_READONLY != 0 {
+		flags = append(flags, "readonly")
+	}
+	if cmd.flag&CMD_DENYOOM != 0 {
+		flags = append(flags, "denyoom")
+	}
+	if cmd.flag&CMD_PUBSUB != 0 {
+		flags = append(flags, "pubsub")
+	}
+	if _, ok := commandGetKeys[cmd.name]; ok {
+		flags = append(flags, "movablekeys")
+	}
+	c.addReplySetLen(len(flags))
+	for _, f := range flags {
+		c.addReplyStatus(f)
+	}
+}
+
+func (c *client) addReplyCommand(cmd *redisCommand) {
+	if cmd == nil {
+		c.addReplyNull()
+		return
+	}
+	c.addReplyMultiBulkLen(6)
+	c.addReplyBulk([]byte(strings.ToLower(cmd.name)))
+	c.addReplyLongLong(int64(cmd.arity))
+	c.addReplyCommandFlags(cmd)
+	c.addReplyLongLong(int64(cmd.firstkey))
+	c.addReplyLongLong(int64(cmd.lastkey))
+	c.addReplyLongLong(int64(cmd.keystep))
+}
+
+// COMMAND [INFO command-name ... | COUNT | GETKEYS command arg ... | HELP]
+func commandCommand(c *client) {
+	if c.argc == 1 {
+		names := make([]string, 0, len(c.s.commands))
+		for name := range c.s.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.addReplyMultiBulkLen(len(names))
+		for _, name := range names {
+			c.addReplyCommand(c.s.commands[name])
+		}
+		return
+	}
+
+	sub := c.argv[1]
+	if bytes.EqualFold(sub, []byte("help")) && c.argc == 2 {
+		help := []string{
+			"(no subcommand) -- Return details about all Redis commands.",
+			"COUNT -- Return the total number of commands in this Redis server.",
+			"GETKEYS <full-command> -- Return the keys from a full Redis command.",
+			"INFO [command-name ...] -- Return details about multiple Redis commands."}
+		c.addReplyMultiBulkLen(len(help))
+		for _, h := range help {
+			c.addReplyStatus(h)
+		}
+	} else if bytes.EqualFold(sub, []byte("info")) {
+		c.addReplyMultiBulkLen(c.argc - 2)
+		for _, name := range c.argv[2:] {
+			c.addReplyCommand(c.s.commands[strings.ToUpper(string(name))])
+		}
+	} else if bytes.EqualFold(sub, []byte("count")) && c.argc == 2 {
+		c.addReplyLongLong(int64(len(c.s.commands)))
+	} else if bytes.EqualFold(sub, []byte("getkeys")) && c.argc >= 3 {
+		cmd := c.s.commands[strings.ToUpper(string(c.argv[2]))]
+		argv := c.argv[2:]
+		if cmd == nil {
+			c.addReplyError([]byte("Invalid command specified"))
+			return
+		} else if !cmd.checkArity(len(argv)) {
+			c.addReplyError([]byte("Invalid number of arguments specified for command"))
+			return
+		}
+		keys := getKeysFromCommand(cmd, argv)
+		if len(keys) == 0 {
+			c.addReplyError([]byte("Invalid arguments specified for command"))
+			return
+		}
+		c.addReplyMultiBulkLen(len(keys))
+		for _, k := range keys {
+			c.addReplyBulk(argv[k])
+		}
+	} else {
+		c.addReplyError([]byte(fmt.Sprintf(
+			"Unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.", sub)))
+	}
+}
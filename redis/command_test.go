@@ -0,0 +1,52 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func argv(args ...string) [][]byte {
+	v := make([][]byte, len(args))
+	for i, a := range args {
+		v[i] = []byte(a)
+	}
+	return v
+}
+
+func TestCommandTable(t *testing.T) {
+	fmt.Println("Check key specs of the command table.")
+	for _, cmd := range redisCommandTable {
+		if cmd.arity == 0 {
+			t.Fatal("missing arity for", cmd.name)
+		}
+		if cmd.firstkey > 0 && cmd.keystep <= 0 {
+			t.Fatal("bad key step for", cmd.name)
+		}
+	}
+
+	fmt.Println("Check arity.")
+	s := NewServer(DefaultConfig())
+	s.populateCommandTable()
+	assertEqual(t, s.commands["GET"].checkArity(1), false)
+	assertEqual(t, s.commands["GET"].checkArity(2), true)
+	assertEqual(t, s.commands["GET"].checkArity(3), false)
+	assertEqual(t, s.commands["SET"].checkArity(2), false)
+	assertEqual(t, s.commands["SET"].checkArity(5), true)
+
+	fmt.Println("Extract keys.")
+	assertEqual(t, getKeysFromCommand(s.commands["MSET"], argv("MSET", "a", "1", "b", "2")), []int{1, 3})
+	assertEqual(t, getKeysFromCommand(s.commands["DEL"], argv("DEL", "a", "b", "c")), []int{1, 2, 3})
+	assertEqual(t, getKeysFromCommand(s.commands["SMOVE"], argv("SMOVE", "a", "b", "m")), []int{1, 2})
+	assertEqual(t, getKeysFromCommand(s.commands["COPY"], argv("COPY", "a", "b", "DB", "1")), []int{1, 2})
+	assertEqual(t, len(getKeysFromCommand(s.commands["PING"], argv("PING"))), 0)
+	assertEqual(t, getKeysFromCommand(s.commands["OBJECT"], argv("OBJECT", "FREQ", "k")), []int{2})
+	assertEqual(t, len(getKeysFromCommand(s.commands["OBJECT"], argv("OBJECT", "HELP"))), 0)
+	assertEqual(t, getKeysFromCommand(s.commands["ZUNIONSTORE"],
+		argv("ZUNIONSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2")), []int{3, 4, 1})
+	assertEqual(t, len(getKeysFromCommand(s.commands["ZINTERSTORE"], argv("ZINTERSTORE", "d", "3", "a", "b"))), 0)
+}
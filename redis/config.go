@@ -0,0 +1,316 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the tunables of a Server. Start from DefaultConfig() and
+// override the fields that need to change, either directly, through Set, or
+// by loading a redis.conf style file with LoadConfig.
+type Config struct {
+	PoolPath string // persistent memory pool file
+	Addr     string // TCP address to accept clients on, "host:port"
+	PoolSize int64  // bytes to preallocate for a new pool file, 0 to grow on demand
+
+	RehashInterval time.Duration // sleep between incremental rehash steps
+	ExpireInterval time.Duration // period of the active expire cycle
+
+	DictInitSize         int // initial buckets of the keyspace dict
+	DictBucketPerShard   int // buckets sharing one lock in the keyspace dict
+	ExpireInitSize       int // initial buckets of the expire dict
+	ExpireBucketPerShard int // buckets sharing one lock in the expire dict
+
+	Databases int // number of databases, SELECT takes 0 to Databases-1
+
+	ListFill int // quicklist fill factor, same meaning as list-max-ziplist-size
+
+	HashMaxZiplistEntries int // max fields of a hash encoded as a ziplist
+	HashMaxZiplistValue   int // max length of a field or value in a ziplist hash
+	SetMaxIntsetEntries   int // max members of a set encoded as an intset
+
+	ProtoMaxBulkLen int64 // max length of a single bulk string in a query
+
+	NotifyKeyspaceEvents int // NOTIFY_* classes of keyspace events to publish
+
+	// MaxMemory limits the estimated bytes of the keys and of the dicts
+	// holding them before eviction, see Server.usedMemory, 0 for no limit.
+	// It does not bound the pool: go-pmem does not report the live bytes of
+	// its heap, and the pool file keeps its peak size after keys are deleted,
+	// so garbage not yet reused, fragmentation and undo logs are not counted.
+	MaxMemory        int64
+	MaxMemoryPolicy  int // MAXMEMORY_* policy applied over MaxMemory
+	MaxMemorySamples int // keys sampled per db to pick one to evict
+}
+
+// DefaultConfig returns the configuration the server used to hardcode.
+func DefaultConfig() Config {
+	return Config{
+		PoolPath:              "./database",
+		Addr:                  ":6379",
+		PoolSize:              0,
+		RehashInterval:        100 * time.Millisecond,
+		ExpireInterval:        10 * time.Millisecond,
+		DictInitSize:          1024,
+		DictBucketPerShard:    32,
+		ExpireInitSize:        128,
+		ExpireBucketPerShard:  1,
+		Databases:             16,
+		ListFill:              -2,
+		HashMaxZiplistEntries: 512,
+		HashMaxZiplistValue:   64,
+		SetMaxIntsetEntries:   512,
+		ProtoMaxBulkLen:       512 * 1024 * 1024,
+		NotifyKeyspaceEvents:  0,
+		MaxMemory:             0,
+		MaxMemoryPolicy:       MAXMEMORY_NO_EVICTION,
+		MaxMemorySamples:      5,
+	}
+}
+
+// LoadConfig reads a redis.conf style file on top of DefaultConfig(). Every
+// non empty line that does not start with '#' is a directive followed by its
+// argument, e.g. "port 6380". Arguments may be quoted like in redis-cli.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		args, ok := splitArgs([]byte(line))
+		if !ok {
+			return cfg, fmt.Errorf("%s:%d: unbalanced quotes in configuration line", path, lineno)
+		}
+		if len(args) != 2 {
+			return cfg, fmt.Errorf("%s:%d: wrong number of arguments for '%s'", path, lineno, args[0])
+		}
+		if err := cfg.Set(string(args[0]), string(args[1])); err != nil {
+			return cfg, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+// Set changes a single option given its redis.conf directive name.
+func (cfg *Config) Set(directive, value string) error {
+	var err error
+	switch strings.ToLower(directive) {
+	case "pool-path":
+		cfg.PoolPath = value
+	case "pool-size":
+		cfg.PoolSize, err = memtoll(value)
+	case "bind":
+		_, port, _ := net.SplitHostPort(cfg.Addr)
+		cfg.Addr = net.JoinHostPort(value, port)
+	case "port":
+		var port int
+		if port, err = strconv.Atoi(value); err == nil && (port < 0 || port > 65535) {
+			err = errors.New("invalid port")
+		}
+		if err == nil {
+			host, _, _ := net.SplitHostPort(cfg.Addr)
+			cfg.Addr = net.JoinHostPort(host, value)
+		}
+	case "rehash-interval":
+		cfg.RehashInterval, err = parseMillis(value)
+	case "expire-interval":
+		cfg.ExpireInterval, err = parseMillis(value)
+	case "dict-init-size":
+		cfg.DictInitSize, err = parsePositive(value)
+	case "dict-bucket-per-shard":
+		cfg.DictBucketPerShard, err = parsePositive(value)
+	case "expire-dict-init-size":
+		cfg.ExpireInitSize, err = parsePositive(value)
+	case "expire-dict-bucket-per-shard":
+		cfg.ExpireBucketPerShard, err = parsePositive(value)
+	case "databases":
+		cfg.Databases, err = parsePositive(value)
+	case "list-max-ziplist-size":
+		cfg.ListFill, err = strconv.Atoi(value)
+	case "hash-max-ziplist-entries":
+		cfg.HashMaxZiplistEntries, err = parseNonNegative(value)
+	case "hash-max-ziplist-value":
+		cfg.HashMaxZiplistValue, err = parseNonNegative(value)
+	case "set-max-intset-entries":
+		cfg.SetMaxIntsetEntries, err = parseNonNegative(value)
+	case "proto-max-bulk-len":
+		if cfg.ProtoMaxBulkLen, err = memtoll(value); err == nil && cfg.ProtoMaxBulkLen < 1024*1024 {
+			err = errors.New("must be at least 1mb")
+		}
+	case "notify-keyspace-events":
+		cfg.NotifyKeyspaceEvents, err = keyspaceEventsStringToFlags(value)
+	case "maxmemory":
+		cfg.MaxMemory, err = memtoll(value)
+	case "maxmemory-policy":
+		cfg.MaxMemoryPolicy, err = maxmemoryPolicyFromString(value)
+	case "maxmemory-samples":
+		cfg.MaxMemorySamples, err = parsePositive(value)
+	default:
+		return fmt.Errorf("bad directive '%s'", directive)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid argument '%s' for '%s': %v", value, directive, err)
+	}
+	return nil
+}
+
+// configDirectives are the directives known to Set and Get, in the order
+// CONFIG GET replies them.
+var configDirectives = []string{"pool-path", "pool-size", "bind", "port", "rehash-interval",
+	"expire-interval", "dict-init-size", "dict-bucket-per-shard", "expire-dict-init-size",
+	"expire-dict-bucket-per-shard", "databases", "list-max-ziplist-size", "hash-max-ziplist-entries",
+	"hash-max-ziplist-value", "set-max-intset-entries", "proto-max-bulk-len", "notify-keyspace-events",
+	"maxmemory", "maxmemory-policy", "maxmemory-samples"}
+
+// Get returns the value of an option given its redis.conf directive name, in
+// a format Set accepts.
+func (cfg *Config) Get(directive string) (string, bool) {
+	host, port, _ := net.SplitHostPort(cfg.Addr)
+	switch strings.ToLower(directive) {
+	case "pool-path":
+		return cfg.PoolPath, true
+	case "pool-size":
+		return strconv.FormatInt(cfg.PoolSize, 10), true
+	case "bind":
+		return host, true
+	case "port":
+		return port, true
+	case "rehash-interval":
+		return strconv.FormatInt(int64(cfg.RehashInterval/time.Millisecond), 10), true
+	case "expire-interval":
+		return strconv.FormatInt(int64(cfg.ExpireInterval/time.Millisecond), 10), true
+	case "dict-init-size":
+		return strconv.Itoa(cfg.DictInitSize), true
+	case "dict-bucket-per-shard":
+		return strconv.Itoa(cfg.DictBucketPerShard), true
+	case "expire-dict-init-size":
+		return strconv.Itoa(cfg.ExpireInitSize), true
+	case "expire-dict-bucket-per-shard":
+		return strconv.Itoa(cfg.ExpireBucketPerShard), true
+	case "databases":
+		return strconv.Itoa(cfg.Databases), true
+	case "list-max-ziplist-size":
+		return strconv.Itoa(cfg.ListFill), true
+	case "hash-max-ziplist-entries":
+		return strconv.Itoa(cfg.HashMaxZiplistEntries), true
+	case "hash-max-ziplist-value":
+		return strconv.Itoa(cfg.HashMaxZiplistValue), true
+	case "set-max-intset-entries":
+		return strconv.Itoa(cfg.SetMaxIntsetEntries), true
+	case "proto-max-bulk-len":
+		return strconv.FormatInt(cfg.ProtoMaxBulkLen, 10), true
+	case "notify-keyspace-events":
+		return keyspaceEventsFlagsToString(cfg.NotifyKeyspaceEvents), true
+	case "maxmemory":
+		return strconv.FormatInt(cfg.MaxMemory, 10), true
+	case "maxmemory-policy":
+		return maxmemoryPolicies[cfg.MaxMemoryPolicy], true
+	case "maxmemory-samples":
+		return strconv.Itoa(cfg.MaxMemorySamples), true
+	default:
+		return "", false
+	}
+}
+
+// CONFIG GET parameter
+// The configuration can only be changed by restarting the server, so CONFIG
+// SET and REWRITE are not supported.
+func configCommand(c *client) {
+	sub := c.argv[1]
+	if bytes.EqualFold(sub, []byte("help")) && c.argc == 2 {
+		help := []string{
+			"GET <pattern> -- Return parameters matching the glob-like <pattern> and their values."}
+		c.addReplyMultiBulkLen(len(help))
+		for _, h := range help {
+			c.addReplyStatus(h)
+		}
+	} else if bytes.EqualFold(sub, []byte("get")) && c.argc == 3 {
+		c.addDeferredMultiBulkLength()
+		n := 0
+		for _, directive := range configDirectives {
+			if stringmatch(c.argv[2], []byte(directive), true) {
+				value, _ := c.s.cfg.Get(directive)
+				c.addReplyBulk([]byte(directive))
+				c.addReplyBulk([]byte(value))
+				n += 2
+			}
+		}
+		c.setDeferredMultiBulkLength(n)
+	} else {
+		c.addReplyError([]byte(fmt.Sprintf(
+			"Unknown subcommand or wrong number of arguments for '%s'. Try CONFIG HELP.", sub)))
+	}
+}
+
+func parseMillis(s string) (time.Duration, error) {
+	ms, err := parsePositive(s)
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+func parsePositive(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n <= 0 {
+		err = errors.New("must be positive")
+	}
+	return n, err
+}
+
+func parseNonNegative(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = errors.New("must not be negative")
+	}
+	return n, err
+}
+
+// memtoll converts a memory amount like "1gb" or "100m" into bytes, following
+// the unit rules of redis.conf: k/m/g are powers of 1000, kb/mb/gb powers of
+// 1024, and the unit is case insensitive.
+func memtoll(s string) (int64, error) {
+	s = strings.ToLower(s)
+	mul := int64(1)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = s[:len(s)-len(u.suffix)]
+			mul = u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n * mul, nil
+}
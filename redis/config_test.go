@@ -0,0 +1,94 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	fmt.Println("Parse a redis.conf style file.")
+	f, err := ioutil.TempFile("", "redis.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\npool-path \"/mnt/pmem0/db\"\nbind 127.0.0.1\nport 6380\n" +
+		"pool-size 1gb\nrehash-interval 50\nlist-max-ziplist-size 128\n")
+	f.Close()
+
+	cfg, err := LoadConfig(f.Name())
+	assertEqual(t, err, nil)
+	assertEqual(t, cfg.PoolPath, "/mnt/pmem0/db")
+	assertEqual(t, cfg.Addr, "127.0.0.1:6380")
+	assertEqual(t, cfg.PoolSize, int64(1024*1024*1024))
+	assertEqual(t, cfg.RehashInterval, 50*time.Millisecond)
+	assertEqual(t, cfg.ExpireInterval, DefaultConfig().ExpireInterval)
+	assertEqual(t, cfg.ListFill, 128)
+
+	fmt.Println("Reject unknown directives and bad values.")
+	cfg = DefaultConfig()
+	assertEqual(t, cfg.Set("no-such-option", "1") != nil, true)
+	assertEqual(t, cfg.Set("port", "70000") != nil, true)
+	assertEqual(t, cfg.Set("dict-init-size", "0") != nil, true)
+	assertEqual(t, cfg.Set("pool-size", "-1") != nil, true)
+	assertEqual(t, cfg.Set("notify-keyspace-events", "KEq") != nil, true)
+	assertEqual(t, cfg.Set("databases", "0") != nil, true)
+	assertEqual(t, cfg.Set("hash-max-ziplist-entries", "-1") != nil, true)
+	assertEqual(t, cfg.Set("hash-max-ziplist-value", "0"), nil)
+	assertEqual(t, cfg.Set("set-max-intset-entries", "-1") != nil, true)
+	assertEqual(t, cfg.Addr, DefaultConfig().Addr)
+
+	fmt.Println("Parse keyspace event classes.")
+	assertEqual(t, cfg.Set("notify-keyspace-events", "Kl$"), nil)
+	assertEqual(t, cfg.NotifyKeyspaceEvents, NOTIFY_KEYSPACE|NOTIFY_LIST|NOTIFY_STRING)
+	assertEqual(t, cfg.Set("notify-keyspace-events", "AE"), nil)
+	assertEqual(t, cfg.NotifyKeyspaceEvents&NOTIFY_KEY_MISS, 0)
+	assertEqual(t, cfg.NotifyKeyspaceEvents&NOTIFY_EXPIRED != 0, true)
+	assertEqual(t, cfg.Set("notify-keyspace-events", ""), nil)
+	assertEqual(t, cfg.NotifyKeyspaceEvents, 0)
+}
+
+func TestConfigGet(t *testing.T) {
+	fmt.Println("Get values that Set accepts.")
+	cfg := DefaultConfig()
+	cfg.Set("notify-keyspace-events", "KEA")
+	for _, directive := range configDirectives {
+		value, ok := cfg.Get(directive)
+		assertEqual(t, ok, true)
+		cfg2 := cfg
+		assertEqual(t, cfg2.Set(directive, value), nil)
+		assertEqual(t, cfg2, cfg)
+	}
+	_, ok := cfg.Get("no-such-option")
+	assertEqual(t, ok, false)
+	assertEqual(t, keyspaceEventsFlagsToString(NOTIFY_KEYEVENT|NOTIFY_LIST|NOTIFY_KEY_MISS), "lEm")
+
+	fmt.Println("CONFIG GET replies the directives matching a pattern.")
+	createSharedObjects()
+	c := newParserClient()
+	c.argv = argv("CONFIG", "GET", "*DICT-INIT*")
+	c.argc = 3
+	configCommand(c)
+	assertEqual(t, c.wBuffer.String(), "*4\r\n$14\r\ndict-init-size\r\n$4\r\n1024\r\n"+
+		"$21\r\nexpire-dict-init-size\r\n$3\r\n128\r\n")
+}
+
+func TestMemtoll(t *testing.T) {
+	fmt.Println("Convert memory units.")
+	for s, n := range map[string]int64{"100": 100, "1k": 1000, "1kb": 1024,
+		"2M": 2000000, "2mb": 2 * 1024 * 1024, "1G": 1000000000, "10b": 10} {
+		v, err := memtoll(s)
+		assertEqual(t, err, nil)
+		assertEqual(t, v, n)
+	}
+	_, err := memtoll("1tb")
+	assertEqual(t, err != nil, true)
+}
@@ -6,6 +6,13 @@
 package redis
 
 import (
+	"bytes"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vmware/go-pmem-transaction/transaction"
@@ -16,67 +23,151 @@ import (
 // rehash Lock -> table Lock -> bucket Lock
 // table0 -> table1
 // bucket id ascending
+// Commands touching several dbs lock them in ascending index order.
 
-var expired chan []byte = make(chan []byte, 100)
-
-func (db *redisDb) Cron() {
-	go db.dict.Cron(100 * time.Millisecond)
-	go db.expire.Cron(100 * time.Millisecond)
-	go db.expireCron(10 * time.Millisecond)
+// Cron starts the background rehash and expire goroutines of db. They return
+// once quit is closed, and wg tracks them until then.
+func (db *redisDb) Cron(rehash, expire time.Duration, quit <-chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		db.dict.Cron(rehash, quit)
+	}()
+	go func() {
+		defer wg.Done()
+		db.expire.Cron(rehash, quit)
+	}()
+	go func() {
+		defer wg.Done()
+		db.expireCron(expire, quit)
+	}()
 }
 
-// active expire (only check table 0 for simplicity)
-func (db *redisDb) expireCron(sleep time.Duration) {
-	i := 0
+const (
+	// keys of the expire dict sampled in each transaction of a cycle
+	activeExpireKeysPerLoop = 20
+	// a cycle stops once at most this percentage of a sample had expired
+	activeExpireAcceptableStale = 10
+	// percentage of the expire interval a cycle may run for
+	activeExpireCyclePercent = 25
+)
+
+// expireCron deletes the keys readers found expired, and runs an active
+// expire cycle every sleep period.
+func (db *redisDb) expireCron(sleep time.Duration, quit <-chan struct{}) {
 	ticker := time.NewTicker(sleep)
+	defer ticker.Stop()
 	for {
 		select {
-		case key := <-expired:
-			txn("undo") {
-			db.lockKeyWrite(key) // lockKeyWrite calls expireIfNeeded.
-			}
+		case <-quit:
+			return
+		case <-db.expired.pending:
+			db.deleteExpired(db.expired.drain())
 		case <-ticker.C:
-			txn("undo") {
-			db.expire.lock.RLock()
-			mask := db.expire.tab[0].mask
-			i = i & mask
-			s := db.expire.shard(i)
-			db.expire.lockShard(0, s)
-			e := db.expire.tab[0].bucket[i]
-			for e != nil {
-				when := e.value.(int64)
-				now := time.Now().UnixNano()
-				if when <= now {
-					db.dict.lockKey(e.key)
-					db.delete(e.key)
-					e = e.next
-					// only delete one expire key in each transaction to prevent
-					// deadlock.
-					break
-				}
-				e = e.next
-			}
-			if e == nil { // finished checking current bucket
-				i++
-			}
+			db.activeExpireCycle(sleep*activeExpireCyclePercent/100, quit)
+			if db.cfg.MaxMemory > 0 {
+				db.updateOverhead()
 			}
 		}
 	}
 }
 
+// activeExpireCycle deletes expired keys sampled at random from both tables
+// of the expire dict, like the active expire cycle of redis. It keeps going
+// while more than activeExpireAcceptableStale percent of a sample had
+// expired, until budget is spent. The expired keys of a sample are deleted in
+// a second transaction, so the expire dict locks of the sample are released
+// before the keys are locked in the usual order, and no transaction holds
+// more than a sample.
+func (db *redisDb) activeExpireCycle(budget time.Duration, quit <-chan struct{}) {
+	start := time.Now()
+	for {
+		var keys [][]byte
+		sampled := 0
+		txn("undo") {
+		keys, sampled = db.sampleExpired(activeExpireKeysPerLoop)
+		}
+		expired := len(keys)
+		// keys reported by readers meanwhile go with the sample, they would
+		// wait for the whole cycle otherwise.
+		db.deleteExpired(append(keys, db.expired.drain()...))
+		if sampled == 0 || expired*100 <= sampled*activeExpireAcceptableStale ||
+			time.Since(start) >= budget {
+			return
+		}
+		select {
+		case <-quit:
+			return
+		default:
+		}
+	}
+}
+
+// deleteExpired deletes the keys that are still expired once locked, a client
+// may have changed them since they were found. Each transaction locks at most
+// activeExpireKeysPerLoop keys.
+func (db *redisDb) deleteExpired(keys [][]byte) {
+	for len(keys) > 0 {
+		n := activeExpireKeysPerLoop
+		if n > len(keys) {
+			n = len(keys)
+		}
+		var expired [][]byte
+		txn("undo") {
+		expired = db.lockKeysWrite(keys[:n], 1) // lockKeysWrite calls expireIfNeeded.
+		}
+		for _, key := range expired {
+			db.notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key)
+		}
+		keys = keys[n:]
+	}
+}
+
+// sampleExpired returns the expired keys among about n keys of the expire
+// dict, and how many keys it looked at.
+func (db *redisDb) sampleExpired(n int) (keys [][]byte, sampled int) {
+	now := time.Now().UnixNano()
+	sampled = db.expire.sample(n, false, func(e *entry) {
+		if e.value.(int64) <= now {
+			keys = append(keys, e.key)
+		}
+	})
+	return
+}
+
 func (db *redisDb) swizzle() {
 	db.dict.swizzle()
 	db.expire.swizzle()
 }
 
+// swizzleLocks rebuilds the volatile locks of the dicts of db, including the
+// ones nested in its values. Unlike swizzle it neither checks the pmem
+// pointers nor walks the elements of the values.
+func (db *redisDb) swizzleLocks() {
+	db.dict.swizzleLocks()
+	db.expire.swizzleLocks()
+	for i := range db.dict.tab {
+		for _, e := range db.dict.tab[i].bucket {
+			for ; e != nil; e = e.next {
+				switch v := e.value.(type) {
+				case *dict:
+					v.swizzleLocks()
+				case *zset:
+					v.dict.swizzleLocks()
+				}
+			}
+		}
+	}
+}
+
 func existsCommand(c *client) {
 	var count int64
 
-	alive := c.db.lockKeysRead(c.argv[1:], 1)
+	alive := c.lockKeysRead(c.argv[1:], 1)
 
 	for i, key := range c.argv[1:] {
 		if alive[i] {
-			if c.db.lookupKeyRead(key) != nil {
+			if c.lookupKeyRead(key) != nil {
 				count++
 			}
 		}
@@ -87,47 +178,488 @@ func existsCommand(c *client) {
 func delCommand(c *client) {
 	var count int64
 
-	c.db.lockKeysWrite(c.argv[1:], 1)
+	c.lockKeysWrite(c.argv[1:], 1)
 
 	for _, key := range c.argv[1:] {
-		c.db.expireIfNeeded(key)
+		c.expireIfNeeded(c.db, key)
 		if c.db.delete(key) {
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
 			count++
 		}
 	}
 	c.addReplyLongLong(count)
 }
 
+// UNLINK key [key ...]
+// Deleting a key only unlinks its value from the dict, the value is reclaimed
+// by the garbage collector of the pmem heap in the background. So unlike in
+// redis, DEL never blocks on freeing a large value and UNLINK is the same.
+func unlinkCommand(c *client) {
+	delCommand(c)
+}
+
+// TOUCH key [key ...]
+func touchCommand(c *client) {
+	existsCommand(c)
+}
+
+// TYPE key
+func typeCommand(c *client) {
+	var o interface{}
+	if c.lockKeyRead(c.argv[1]) {
+		o = c.lookupKeyRead(c.argv[1])
+	}
+	c.addReplyStatus(typeName(o))
+}
+
+func renameCommand(c *client) {
+	renameGenericCommand(c, false)
+}
+
+func renamenxCommand(c *client) {
+	renameGenericCommand(c, true)
+}
+
+// RENAME key newkey / RENAMENX key newkey
+// The value and the expire time move to the new key in the transaction of
+// the command, the value itself is not copied.
+func renameGenericCommand(c *client, nx bool) {
+	src, dst := c.argv[1], c.argv[2]
+	c.lockKeysWrite(c.argv[1:3], 1)
+
+	o := c.db.lookupKeyWrite(src)
+	if o == nil {
+		c.addReplyError([]byte("no such key"))
+		return
+	}
+	if bytes.Equal(src, dst) {
+		if nx {
+			c.addReply(shared.czero)
+		} else {
+			c.addReply(shared.ok)
+		}
+		return
+	}
+	when := c.db.getExpire(src)
+	if c.db.lookupKeyWrite(dst) != nil {
+		if nx {
+			c.addReply(shared.czero)
+			return
+		}
+		c.db.delete(dst)
+	}
+	c.db.delete(src)
+	c.db.setKey(shadowCopyToPmem(dst), o)
+	if when >= 0 {
+		c.db.setExpire(dst, when)
+	}
+	if _, ok := o.(*quicklist); ok {
+		c.signalKeyAsReady(dst)
+	}
+	c.notifyKeyspaceEvent(NOTIFY_GENERIC, "rename_from", src)
+	c.notifyKeyspaceEvent(NOTIFY_GENERIC, "rename_to", dst)
+	if nx {
+		c.addReply(shared.cone)
+	} else {
+		c.addReply(shared.ok)
+	}
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func copyCommand(c *client) {
+	dstid := c.dbid
+	replace := false
+	for i := 3; i < c.argc; i++ {
+		if bytes.EqualFold(c.argv[i], []byte("replace")) {
+			replace = true
+		} else if bytes.EqualFold(c.argv[i], []byte("db")) && i+1 < c.argc {
+			id, ok := c.getLongLongOrReply(c.argv[i+1], nil)
+			if !ok {
+				return
+			}
+			if id < 0 || id >= int64(len(c.s.dbs)) {
+				c.addReplyError([]byte("DB index is out of range"))
+				return
+			}
+			dstid = int(id)
+			i++
+		} else {
+			c.addReply(shared.syntaxerr)
+			return
+		}
+	}
+	srckey, dstkey := c.argv[1], c.argv[2]
+	src, dst := c.db, c.s.dbs[dstid]
+	if src == dst && bytes.Equal(srckey, dstkey) {
+		c.addReplyError([]byte("source and destination objects are the same"))
+		return
+	}
+	if c.batch {
+		c.expireIfNeeded(src, srckey)
+		c.expireIfNeeded(dst, dstkey)
+	} else if src == dst {
+		c.notifyExpired(src, src.lockKeysWrite(c.argv[1:3], 1)...)
+	} else if c.dbid < dstid {
+		c.lockDbKeyWrite(src, srckey)
+		c.lockDbKeyWrite(dst, dstkey)
+	} else {
+		c.lockDbKeyWrite(dst, dstkey)
+		c.lockDbKeyWrite(src, srckey)
+	}
+
+	o := src.lookupKeyWrite(srckey)
+	if o == nil {
+		c.addReply(shared.czero)
+		return
+	}
+	if dst.lookupKeyWrite(dstkey) != nil {
+		if !replace {
+			c.addReply(shared.czero)
+			return
+		}
+		dst.delete(dstkey)
+	}
+	when := src.getExpire(srckey)
+	o = dupObject(o)
+	dst.setKey(shadowCopyToPmem(dstkey), o)
+	if when >= 0 {
+		dst.setExpire(dstkey, when)
+	}
+	if _, ok := o.(*quicklist); ok {
+		c.signalDbKeyAsReady(dstid, dstkey)
+	}
+	c.notifyDbKeyspaceEvent(dstid, NOTIFY_GENERIC, "copy_to", dstkey)
+	c.addReply(shared.cone)
+}
+
 func dbsizeCommand(c *client) {
-	c.db.dict.lockAllKeys()
+	c.lockAllKeys()
 	c.addReplyLongLong(int64(c.db.dict.size()))
 }
 
 func flushdbCommand(c *client) {
-	c.db.lockTablesWrite()
-	c.db.expire.empty()
-	c.db.dict.empty()
+	c.lockTablesWrite()
+	c.db.empty()
+	c.addReply(shared.ok)
+}
+
+func flushallCommand(c *client) {
+	for _, db := range c.s.dbs {
+		if !c.batch {
+			db.lockTablesWrite()
+		}
+		db.empty()
+	}
 	c.addReply(shared.ok)
 }
 
 func selectCommand(c *client) {
-	// TODO: not implemented
+	id, ok := c.getLongLongOrReply(c.argv[1], []byte("-ERR invalid DB index\r\n"))
+	if !ok {
+		return
+	}
+	if id < 0 || id >= int64(len(c.s.dbs)) {
+		c.addReplyError([]byte("DB index is out of range"))
+		return
+	}
+	c.dbid = int(id)
+	c.db = c.s.dbs[c.dbid]
+	c.addReply(shared.ok)
+}
+
+// MOVE key db
+func moveCommand(c *client) {
+	id, ok := c.getLongLongOrReply(c.argv[2], nil)
+	if !ok {
+		return
+	}
+	if id < 0 || id >= int64(len(c.s.dbs)) {
+		c.addReplyError([]byte("DB index is out of range"))
+		return
+	}
+	if int(id) == c.dbid {
+		c.addReplyError([]byte("source and destination objects are the same"))
+		return
+	}
+	src, dst := c.db, c.s.dbs[id]
+	key := c.argv[1]
+	if c.batch {
+		c.expireIfNeeded(src, key)
+		c.expireIfNeeded(dst, key)
+	} else if c.dbid < int(id) {
+		c.lockDbKeyWrite(src, key)
+		c.lockDbKeyWrite(dst, key)
+	} else {
+		c.lockDbKeyWrite(dst, key)
+		c.lockDbKeyWrite(src, key)
+	}
+
+	o := src.lookupKeyWrite(key)
+	if o == nil || dst.lookupKeyWrite(key) != nil {
+		c.addReply(shared.czero)
+		return
+	}
+	when := src.getExpire(key)
+	src.delete(key)
+	dst.setKey(shadowCopyToPmem(key), o)
+	if when >= 0 {
+		dst.setExpire(key, when)
+	}
+	if _, ok := o.(*quicklist); ok {
+		c.signalDbKeyAsReady(int(id), key)
+	}
+	c.notifyKeyspaceEvent(NOTIFY_GENERIC, "move_from", key)
+	c.notifyDbKeyspaceEvent(int(id), NOTIFY_GENERIC, "move_to", key)
+	c.addReply(shared.cone)
+}
+
+// SWAPDB index index
+func swapdbCommand(c *client) {
+	id1, ok := c.getLongLongOrReply(c.argv[1], []byte("-ERR invalid first DB index\r\n"))
+	if !ok {
+		return
+	}
+	id2, ok := c.getLongLongOrReply(c.argv[2], []byte("-ERR invalid second DB index\r\n"))
+	if !ok {
+		return
+	}
+	n := int64(len(c.s.dbs))
+	if id1 < 0 || id1 >= n || id2 < 0 || id2 >= n {
+		c.addReplyError([]byte("DB index is out of range"))
+		return
+	}
+	// SWAPDB runs exclusively, so no command holds a db resolved by index.
+	// The crons keep working on their db wherever it moves.
+	dbs := c.s.dbs
+	txn("undo") {
+		dbs[id1], dbs[id2] = dbs[id2], dbs[id1]
+	}
+	atomic.StoreInt32(&dbs[id1].id, int32(id1))
+	atomic.StoreInt32(&dbs[id2].id, int32(id2))
+	c.db = dbs[c.dbid]
+	c.signalDbAsReady(int(id1))
+	c.signalDbAsReady(int(id2))
 	c.addReply(shared.ok)
 }
 
 func randomkeyCommand(c *client) {
-	c.db.dict.lockAllKeys()
+	c.lockAllKeys()
 	if de := c.db.randomKey(); de != nil {
 		c.addReplyBulk(de.key)
 	} else {
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
+	}
+}
+
+// KEYS pattern
+func keysCommand(c *client) {
+	pattern := c.argv[1]
+	allkeys := len(pattern) == 1 && pattern[0] == '*'
+	c.lockAllKeysExpire()
+	c.addDeferredMultiBulkLength()
+	n := 0
+	iter := c.db.dict.getIterator()
+	for e := iter.next(); e != nil; e = iter.next() {
+		if (allkeys || stringmatch(pattern, e.key, false)) && c.db.checkLiveKey(e.key) {
+			c.addReplyBulk(e.key)
+			n++
+		}
+	}
+	c.setDeferredMultiBulkLength(n)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanCommand(c *client) {
+	cursor, ok := c.parseScanCursorOrReply(c.argv[1])
+	if !ok {
+		return
+	}
+	scanGenericCommand(c, nil, cursor)
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+func hscanCommand(c *client) {
+	cursor, ok := c.parseScanCursorOrReply(c.argv[2])
+	if !ok {
+		return
+	}
+	if !c.lockKeyRead(c.argv[1]) {
+		c.addReply(shared.emptyscan)
+		return
+	}
+	if o, ok := c.getHashOrReply(c.lookupKeyRead(c.argv[1]), shared.emptyscan); ok && o != nil {
+		scanGenericCommand(c, o, cursor)
+	}
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscanCommand(c *client) {
+	cursor, ok := c.parseScanCursorOrReply(c.argv[2])
+	if !ok {
+		return
+	}
+	if !c.lockKeyRead(c.argv[1]) {
+		c.addReply(shared.emptyscan)
+		return
+	}
+	if o, ok := c.getSetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptyscan); ok && o != nil {
+		scanGenericCommand(c, o, cursor)
+	}
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+func zscanCommand(c *client) {
+	cursor, ok := c.parseScanCursorOrReply(c.argv[2])
+	if !ok {
+		return
+	}
+	if !c.lockKeyRead(c.argv[1]) {
+		c.addReply(shared.emptyscan)
+		return
+	}
+	if o, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptyscan); ok && o != nil {
+		scanGenericCommand(c, o, cursor)
 	}
 }
 
-func (db *redisDb) lockKeyWrite(key []byte) {
+func (c *client) parseScanCursorOrReply(arg []byte) (uint64, bool) {
+	cursor, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		c.addReplyError([]byte("invalid cursor"))
+		return 0, false
+	}
+	return cursor, true
+}
+
+// scanGenericCommand scans the keyspace if o is nil, otherwise the hash, set
+// or sorted set o, whose key is locked. The keyspace is scanned with
+// dict.scanShared, and only the expire times of the returned keys are locked,
+// unless EXEC holds the tables. Hashes reply field and value pairs,
+// sorted sets member and score pairs. Options start after the cursor.
+func scanGenericCommand(c *client, o interface{}, cursor uint64) {
+	var pattern []byte
+	var typ string
+	count := int64(10)
+	i := 2
+	if o != nil {
+		i = 3
+	}
+	for ; i < c.argc; i += 2 {
+		if i+1 >= c.argc {
+			c.addReply(shared.syntaxerr)
+			return
+		}
+		opt := c.argv[i]
+		if bytes.EqualFold(opt, []byte("count")) {
+			var ok bool
+			if count, ok = c.getLongLongOrReply(c.argv[i+1], nil); !ok {
+				return
+			}
+			if count < 1 {
+				c.addReply(shared.syntaxerr)
+				return
+			}
+		} else if bytes.EqualFold(opt, []byte("match")) {
+			pattern = c.argv[i+1]
+			if len(pattern) == 1 && pattern[0] == '*' {
+				pattern = nil // matches anything, skip the matching
+			}
+		} else if bytes.EqualFold(opt, []byte("type")) && o == nil {
+			typ = strings.ToLower(string(c.argv[i+1]))
+		} else {
+			c.addReply(shared.syntaxerr)
+			return
+		}
+	}
+
+	var d *dict
+	var entries []*entry
+	switch v := o.(type) {
+	case nil:
+		d = c.db.dict
+	case *dict:
+		d = v
+	case *zset:
+		d = v.dict
+	case *ziplist:
+		// Like redis, reply all the elements of a small hash or set at once.
+		hi := hashTypeInitIterator(v)
+		for hi.hashTypeNext() {
+			field, value := hi.hashTypeCurrentFromZiplist()
+			key, _ := getString(field)
+			entries = append(entries, &entry{key: key, value: value})
+		}
+		cursor = 0
+	case *intset:
+		si := setTypeInitIterator(v)
+		for ele := setTypeNext(si); ele != nil; ele = setTypeNext(si) {
+			key, _ := getString(ele)
+			entries = append(entries, &entry{key: key})
+		}
+		cursor = 0
+	}
+	scan := d.scan
+	if o == nil && !c.batch {
+		scan = d.scanShared
+	}
+	// Like redis, visit at most 10 times count buckets so that a sparse
+	// table does not block for long.
+	for maxiterations := count * 10; d != nil; maxiterations-- {
+		cursor = scan(cursor, func(e *entry) {
+			entries = append(entries, &entry{key: e.key, value: e.value})
+		})
+		if cursor == 0 || maxiterations == 1 || int64(len(entries)) >= count {
+			break
+		}
+	}
+
+	if o == nil && !c.batch && len(entries) > 0 {
+		keys := make([][]byte, len(entries))
+		for i, e := range entries {
+			keys[i] = e.key
+		}
+		c.db.expire.lockKeys(keys, 1)
+	}
+
+	c.addReplyMultiBulkLen(2)
+	c.addReplyBulk([]byte(strconv.FormatUint(cursor, 10)))
+	c.addDeferredMultiBulkLength()
+	n := 0
+	for _, e := range entries {
+		if pattern != nil && !stringmatch(pattern, e.key, false) {
+			continue
+		}
+		switch o.(type) {
+		case nil:
+			if !c.db.checkLiveKey(e.key) || (typ != "" && typeName(e.value) != typ) {
+				continue
+			}
+			c.addReplyBulk(e.key)
+			n++
+		case *dict, *ziplist, *intset:
+			// set members have no value
+			c.addReplyBulk(e.key)
+			n++
+			if e.value != nil {
+				s, _ := getString(e.value)
+				c.addReplyBulk(s)
+				n++
+			}
+		case *zset:
+			c.addReplyBulk(e.key)
+			c.addReplyBulk([]byte(strconv.FormatFloat(e.value.(float64), 'g', -1, 64)))
+			n += 2
+		}
+	}
+	c.setDeferredMultiBulkLength(n)
+}
+
+// lockKeyWrite locks key for writing and expires it if needed, see
+// expireIfNeeded.
+func (db *redisDb) lockKeyWrite(key []byte) bool {
 	db.expire.lockKey(key)
 	db.dict.lockKey(key)
-	db.expireIfNeeded(key)
+	return db.expireIfNeeded(key)
 }
 
 func (db *redisDb) lockKeyRead(key []byte) bool {
@@ -136,12 +668,16 @@ func (db *redisDb) lockKeyRead(key []byte) bool {
 	return db.checkLiveKey(key)
 }
 
-func (db *redisDb) lockKeysWrite(keys [][]byte, stride int) {
+// lockKeysWrite locks keys for writing and returns those it expired.
+func (db *redisDb) lockKeysWrite(keys [][]byte, stride int) (expired [][]byte) {
 	db.expire.lockKeys(keys, stride)
 	db.dict.lockKeys(keys, stride)
 	for i := 0; i < len(keys)/stride; i++ {
-		db.expireIfNeeded(keys[i*stride])
+		if db.expireIfNeeded(keys[i*stride]) {
+			expired = append(expired, keys[i*stride])
+		}
 	}
+	return
 }
 
 func (db *redisDb) lockKeysRead(keys [][]byte, stride int) []bool {
@@ -159,6 +695,93 @@ func (db *redisDb) lockTablesWrite() {
 	}
 }
 
+// Command handlers lock keys through the client, so that EXEC can take the
+// locks of a whole batch up front. While the batch holds them, the
+// wrappers only expire the keys as the db lock methods would.
+
+func (c *client) lockKey(key []byte) {
+	if !c.batch {
+		c.db.expire.lockKey(key)
+		c.db.dict.lockKey(key)
+	}
+}
+
+func (c *client) lockKeyWrite(key []byte) {
+	if c.batch {
+		c.expireIfNeeded(c.db, key)
+	} else {
+		c.lockDbKeyWrite(c.db, key)
+	}
+}
+
+// lockDbKeyWrite locks key of db, which may not be the selected one.
+func (c *client) lockDbKeyWrite(db *redisDb, key []byte) {
+	if db.lockKeyWrite(key) {
+		c.notifyExpired(db, key)
+	}
+}
+
+// expireIfNeeded expires key of db, which may not be the selected one, and
+// records the event.
+func (c *client) expireIfNeeded(db *redisDb, key []byte) {
+	if db.expireIfNeeded(key) {
+		c.notifyExpired(db, key)
+	}
+}
+
+func (c *client) lockKeyRead(key []byte) bool {
+	if c.batch {
+		// the batch holds write locks, so expire the key right away instead
+		// of reporting it to the expire cron.
+		c.expireIfNeeded(c.db, key)
+		return true
+	}
+	return c.db.lockKeyRead(key)
+}
+
+func (c *client) lockKeysWrite(keys [][]byte, stride int) {
+	if c.batch {
+		for i := 0; i < len(keys)/stride; i++ {
+			c.expireIfNeeded(c.db, keys[i*stride])
+		}
+	} else {
+		c.notifyExpired(c.db, c.db.lockKeysWrite(keys, stride)...)
+	}
+}
+
+func (c *client) lockKeysRead(keys [][]byte, stride int) []bool {
+	if c.batch {
+		alive := make([]bool, len(keys))
+		for i := 0; i < len(keys)/stride; i++ {
+			c.expireIfNeeded(c.db, keys[i*stride])
+			alive[i*stride] = true
+		}
+		return alive
+	}
+	return c.db.lockKeysRead(keys, stride)
+}
+
+func (c *client) lockTablesWrite() {
+	if !c.batch {
+		c.db.lockTablesWrite()
+	}
+}
+
+func (c *client) lockAllKeys() {
+	if !c.batch {
+		c.db.dict.lockAllKeys()
+	}
+}
+
+// lockAllKeysExpire also locks the expire dict, for commands that check the
+// expire time of the keys they visit.
+func (c *client) lockAllKeysExpire() {
+	if !c.batch {
+		c.db.expire.lockAllKeys()
+		c.db.dict.lockAllKeys()
+	}
+}
+
 func (db *redisDb) checkLiveKeys(keys [][]byte, stride int) []bool {
 	alive := make([]bool, len(keys))
 	for i := 0; i < len(keys)/stride; i++ {
@@ -167,30 +790,90 @@ func (db *redisDb) checkLiveKeys(keys [][]byte, stride int) []bool {
 	return alive
 }
 
+// checkLiveKey reports whether key is not past its expire time. A reader
+// can't delete an expired key under its read locks, so the key is queued for
+// expireCron instead.
 func (db *redisDb) checkLiveKey(key []byte) bool {
-	when := db.getExpire(key)
-	if when < 0 {
+	if !db.keyExpired(key) {
 		return true
 	}
-	now := time.Now().UnixNano()
-	if now < when {
-		return true
-	}
-	expired <- key
+	db.expired.push(key)
 	return false
 }
 
+// expireQueue collects the keys readers found expired for expireCron. push
+// never blocks, so a reader holding key locks can't wait for the cron that
+// needs the same locks, and a key read many times is queued once.
+type expireQueue struct {
+	mu      sync.Mutex
+	keys    map[string]struct{}
+	pending chan struct{} // holds a value while keys may not be empty
+}
+
+func newExpireQueue() *expireQueue {
+	return &expireQueue{
+		keys:    make(map[string]struct{}),
+		pending: make(chan struct{}, 1)}
+}
+
+// push queues a copy of key, the caller may reuse its buffer.
+func (q *expireQueue) push(key []byte) {
+	q.mu.Lock()
+	q.keys[string(key)] = struct{}{}
+	q.mu.Unlock()
+	select {
+	case q.pending <- struct{}{}:
+	default:
+	}
+}
+
+// drain removes and returns the queued keys.
+func (q *expireQueue) drain() [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	keys := make([][]byte, 0, len(q.keys))
+	for k := range q.keys {
+		keys = append(keys, []byte(k))
+		delete(q.keys, k)
+	}
+	return keys
+}
+
+// keyExpired reports whether key is past its expire time, without reporting
+// it to the expire cron.
+func (db *redisDb) keyExpired(key []byte) bool {
+	when := db.getExpire(key)
+	return when >= 0 && time.Now().UnixNano() >= when
+}
+
 func (db *redisDb) lookupKeyWrite(key []byte) interface{} {
 	return db.lookupKey(key)
 }
 
 func (db *redisDb) lookupKeyRead(key []byte) interface{} {
-	return db.lookupKey(key)
+	o := db.lookupKey(key)
+	if o == nil {
+		atomic.AddInt64(&db.stats.keyspaceMisses, 1)
+	} else {
+		atomic.AddInt64(&db.stats.keyspaceHits, 1)
+	}
+	return o
+}
+
+// lookupKeyRead looks key up for a read of c and reports a miss as a
+// keymiss event, like lookupKeyRead in redis.
+func (c *client) lookupKeyRead(key []byte) interface{} {
+	o := c.db.lookupKeyRead(key)
+	if o == nil {
+		c.notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key)
+	}
+	return o
 }
 
 func (db *redisDb) lookupKey(key []byte) interface{} {
 	_, _, _, e := db.dict.find(key)
 	if e != nil {
+		db.updateLRU(e)
 		return e.value
 	}
 	return nil
@@ -211,12 +894,121 @@ func (db *redisDb) randomKey() *entry {
 // key and value data should be in pmem
 func (db *redisDb) setKey(key []byte, value interface{}) (insert bool) {
 	db.removeExpire(key)
-	return db.dict.set(key, value)
+	if atomic.LoadInt32(&legacyHash) != 0 {
+		// the value may come from a key the hash migration did not reach.
+		migrateValue(value)
+	}
+	insert = db.dict.set(key, value)
+	_, _, _, e := db.dict.find(key)
+	atomic.StoreUint32(&db.meta(e).lru, db.initialLRU())
+	db.estimateUsage(e)
+	return
+}
+
+// migrateValue moves the entries of the dicts nested in a value to the
+// buckets of their seeded hash and returns how many moved, see legacyHash.
+func migrateValue(v interface{}) int {
+	switch o := v.(type) {
+	case *dict:
+		return o.migrateAll()
+	case *zset:
+		return o.dict.migrateAll()
+	default:
+		return 0
+	}
 }
 
 func (db *redisDb) delete(key []byte) bool {
 	db.expire.delete(key)
-	return (db.dict.delete(key) != nil)
+	e := db.dict.delete(key)
+	if e == nil {
+		return false
+	}
+	m := db.dropMeta(e)
+	if db.cfg.MaxMemory > 0 {
+		db.addUsage(-int64(m.usage))
+	}
+	return true
+}
+
+// empty deletes all keys of db, the caller holds the locks of lockTablesWrite.
+func (db *redisDb) empty() {
+	db.expire.empty()
+	db.dict.empty()
+	db.metas = new(sync.Map)
+	db.addUsage(-atomic.LoadInt64(&db.used))
+}
+
+// signalModifiedKey gives key a new version for WATCH. setKey and delete
+// change the version already, commands that update a value in place call
+// this instead.
+func (db *redisDb) signalModifiedKey(key []byte) {
+	db.dict.touch(key)
+	if db.cfg.MaxMemory > 0 {
+		if _, _, _, e := db.dict.find(key); e != nil {
+			db.updateUsage(e)
+		}
+	}
+}
+
+// updateUsage updates the memory used by the key of e after its value was
+// changed in place. Aggregate values are only sampled again once their
+// length crossed a power of two since the last estimate, in between the
+// estimate is scaled by their length. This keeps in place updates O(1).
+func (db *redisDb) updateUsage(e *entry) {
+	if db.cfg.MaxMemory == 0 {
+		return
+	}
+	m := db.meta(e)
+	n, ok := valueLen(e.value)
+	if !ok || m.usageLen == 0 || n == 0 || bits.Len32(n) != bits.Len32(m.usageLen) {
+		db.estimateUsage(e)
+		return
+	}
+	db.setUsage(e, int64(m.usage)*int64(n)/int64(m.usageLen), n)
+}
+
+// estimateUsage estimates the memory used by the key of e, sampling its
+// value, and adds the change to the usage of db. Keys are only accounted
+// with maxmemory set.
+func (db *redisDb) estimateUsage(e *entry) {
+	if db.cfg.MaxMemory == 0 {
+		return
+	}
+	n, _ := valueLen(e.value)
+	db.setUsage(e, objectUsage(e.key, e.value, db.cfg.MaxMemorySamples), n)
+}
+
+func (db *redisDb) setUsage(e *entry, usage int64, n uint32) {
+	if usage > math.MaxUint32 {
+		usage = math.MaxUint32
+	}
+	m := db.meta(e)
+	db.addUsage(usage - int64(m.usage))
+	m.usage = uint32(usage)
+	m.usageLen = n
+}
+
+// addUsage adds n bytes to the memory used by db and by the server.
+func (db *redisDb) addUsage(n int64) {
+	atomic.AddInt64(&db.used, n)
+	atomic.AddInt64(&db.stats.usedMemory, n)
+}
+
+// computeUsage estimates the memory used by every key and by the dicts of db
+// at startup, the estimates are volatile.
+func (db *redisDb) computeUsage() {
+	iter := db.dict.getIterator()
+	for e := iter.next(); e != nil; e = iter.next() {
+		db.estimateUsage(e)
+	}
+	db.updateOverhead()
+}
+
+// keyVersion returns the modification version of key, 0 if it does not
+// exist.
+func (db *redisDb) keyVersion(key []byte) uint64 {
+	return db.dict.keyVersion(key)
 }
 
 func expireCommand(c *client) {
@@ -243,7 +1035,7 @@ func expireGeneric(c *client, base time.Time, d time.Duration) {
 
 	expire := base.Add(time.Duration(when) * d)
 
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 
 	if c.db.lookupKeyWrite(c.argv[1]) == nil {
 		c.addReply(shared.czero)
@@ -254,12 +1046,15 @@ func expireGeneric(c *client, base time.Time, d time.Duration) {
 	// never executed as a DEL when load AOF or in the context of a slave.
 	if expire.Before(time.Now()) {
 		c.db.delete(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
 		c.addReply(shared.cone)
 		return
 	} else {
 		// int64 value should be inlined in interface, therefore should also be
 		// persisted after set.
 		c.db.setExpire(c.argv[1], expire.UnixNano())
+		c.db.signalModifiedKey(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", c.argv[1])
 		c.addReply(shared.cone)
 		return
 	}
@@ -277,17 +1072,21 @@ func (db *redisDb) removeExpire(key []byte) bool {
 	return db.expire.delete(key) != nil
 }
 
-// tx must be writable
-func (db *redisDb) expireIfNeeded(key []byte) {
+// expireIfNeeded deletes key if it is past its expire time, and reports
+// whether it did. The caller reports the expired event once the transaction
+// has committed. tx must be writable
+func (db *redisDb) expireIfNeeded(key []byte) bool {
 	when := db.getExpire(key)
 	if when < 0 {
-		return
+		return false
 	}
 	now := time.Now().UnixNano()
 	if now < when {
-		return
+		return false
 	}
 	db.delete(key)
+	atomic.AddInt64(&db.stats.expiredKeys, 1)
+	return true
 }
 
 func (db *redisDb) getExpire(key []byte) int64 {
@@ -315,10 +1114,9 @@ func pttlCommand(c *client) {
 func ttlGeneric(c *client, ms bool) {
 	var ttl int64 = -1
 
-	c.db.expire.lockKey(c.argv[1])
-	c.db.dict.lockKey(c.argv[1])
+	c.lockKey(c.argv[1])
 
-	if c.db.lookupKeyRead(c.argv[1]) == nil {
+	if c.lookupKeyRead(c.argv[1]) == nil {
 		c.addReplyLongLong(-2)
 		return
 	}
@@ -343,12 +1141,14 @@ func ttlGeneric(c *client, ms bool) {
 }
 
 func persistCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	_, _, _, e := c.db.dict.find(c.argv[1])
 	if e == nil {
 		c.addReply(shared.czero)
 	} else {
 		if c.db.removeExpire(c.argv[1]) {
+			c.db.signalModifiedKey(c.argv[1])
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "persist", c.argv[1])
 			c.addReply(shared.cone)
 		} else {
 			c.addReply(shared.czero)
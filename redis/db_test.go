@@ -0,0 +1,152 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLazyExpireFlood(t *testing.T) {
+	c := newTestClient(1)
+	s := c.s
+	s.cfg.ExpireInterval = time.Millisecond
+	s.cfg.RehashInterval = time.Millisecond
+
+	fmt.Println("Queue each expired key once.")
+	for i := 0; i < 10; i++ {
+		runCommand(c, "SET", "expired"+strconv.Itoa(i), "v", "PX", "1")
+	}
+	time.Sleep(5 * time.Millisecond)
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 10; i++ {
+			assertEqual(t, runCommand(c, "GET", "expired"+strconv.Itoa(i)), "$-1\r\n")
+		}
+	}
+	assertEqual(t, len(c.db.expired.drain()), 10)
+	assertEqual(t, len(c.db.expired.drain()), 0)
+	runCommand(c, "FLUSHDB")
+
+	fmt.Println("Readers never block on expired keys while the expire cron runs.")
+	const keys = 2000
+	for i := 0; i < keys; i++ {
+		runCommand(c, "SET", "expired"+strconv.Itoa(i), "v", "PX", "1")
+	}
+	runCommand(c, "SET", "live", "v")
+	time.Sleep(5 * time.Millisecond)
+	s.Cron()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			cl := s.newClient(nil)
+			cl.db = c.db
+			for i := 0; i < 200; i++ {
+				key := "expired" + strconv.Itoa((g*200+i)%keys)
+				if r := runCommand(cl, "GET", key); r != "$-1\r\n" {
+					t.Errorf("GET of expired key replied %q", r)
+					return
+				}
+				if r := runCommand(cl, "EXISTS", key, "live"); r != ":1\r\n" {
+					t.Errorf("EXISTS of expired and live key replied %q", r)
+					return
+				}
+			}
+		}(g)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("readers blocked on expired keys")
+	}
+
+	fmt.Println("The expire cron deletes the expired keys.")
+	for deadline := time.Now().Add(10 * time.Second); runCommand(c, "DBSIZE") != ":1\r\n"; {
+		if time.Now().After(deadline) {
+			t.Fatal("expired keys not deleted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(s.quit)
+	s.crons.Wait()
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	fmt.Println("Start samples at any bucket, small tables too.")
+	for _, size := range []int{64, 8} {
+		d := &dict{tab: [2]table{scanTable(size, size), {mask: -1}}, rehashIdx: -1}
+		seen := make(map[string]bool)
+		for i := 0; i < 100*size; i++ {
+			d.sample(1, true, func(e *entry) {
+				seen[string(e.key)] = true
+			})
+		}
+		assertEqual(t, len(seen), size)
+	}
+
+	c := newTestClient(1)
+	db := c.db
+	expiredKeys := func() int {
+		n := 0
+		now := time.Now().UnixNano()
+		iter := db.expire.getIterator()
+		for e := iter.next(); e != nil; e = iter.next() {
+			if e.value.(int64) <= now {
+				n++
+			}
+		}
+		return n
+	}
+	setKeys := func(prefix string, n int, px string) {
+		for i := 0; i < n; i++ {
+			runCommand(c, "SET", prefix+strconv.Itoa(i), "v", "PX", px)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	fmt.Println("Run a single sample once the budget is spent.")
+	setKeys("expired", 1000, "1")
+	db.activeExpireCycle(0, nil)
+	assertEqual(t, expiredKeys() < 1000 && expiredKeys() > 900, true)
+
+	fmt.Println("Go on until no expired key is left.")
+	db.activeExpireCycle(time.Hour, nil)
+	assertEqual(t, db.expire.size(), 0)
+	assertEqual(t, db.dict.size(), 0)
+
+	fmt.Println("Stop once few keys of a sample had expired.")
+	setKeys("live", 1000, "3600000")
+	setKeys("expired", 1000, "1")
+	db.activeExpireCycle(time.Hour, nil)
+	assertEqual(t, expiredKeys() > 0 && expiredKeys() < 1000, true)
+	assertEqual(t, db.expire.size()-expiredKeys(), 1000)
+
+	fmt.Println("Expire the keys of the second table during a rehash.")
+	runCommand(c, "FLUSHDB")
+	setKeys("live", 10, "3600000")
+	db.expire.resize(256)
+	setKeys("expired", 200, "1")
+	used := 0
+	for _, u := range db.expire.tab[1].used {
+		used += u
+	}
+	assertEqual(t, used, 200)
+	for i := 0; i < 100 && expiredKeys() > 0; i++ {
+		db.activeExpireCycle(time.Hour, nil)
+	}
+	assertEqual(t, expiredKeys(), 0)
+	assertEqual(t, db.expire.size(), 10)
+	assertEqual(t, db.dict.size(), 10)
+}
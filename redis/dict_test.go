@@ -8,39 +8,52 @@ package redis
 import (
 	"bytes"
 	"fmt"
-	"pmem/heap"
+	"os"
 	"reflect"
 	"runtime/debug"
 	"strconv"
 	"testing"
 	"time"
 
-	"github.com/vmware/go-pmem-transaction/transaction"
+	"github.com/vmware/go-pmem-transaction/pmem"
 )
 
 var d *dict
 
+// testPool is the pool file the tests allocate pmem from.
+const testPool = "testdatabase"
+
+// testServerEnv enables TestServer, which opens the pool of a real server and
+// so has to run alone.
+const testServerEnv = "REDIS_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testServerEnv) != "" {
+		os.Exit(m.Run())
+	}
+	os.Remove(testPool)
+	pmem.Init(testPool)
+	code := m.Run()
+	os.Remove(testPool)
+	os.Exit(code)
+}
+
 func TestServer(t *testing.T) {
-	s := new(server)
+	if os.Getenv(testServerEnv) == "" {
+		t.Skip("set " + testServerEnv + "=1 and run it alone with -run TestServer")
+	}
+	s := NewServer(DefaultConfig())
 	go s.Start()
 	time.Sleep(180 * time.Second)
 
 	conn := getClient()
 	conn.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"))
 	time.Sleep(1 * time.Second)
-	undoTx := transaction.NewUndo()
-	fmt.Println(s.db.lookupKeyRead(undoTx, []byte("foo")))
-	transaction.Release(undoTx)
+	fmt.Println(s.dbs[0].lookupKeyRead([]byte("foo")))
 }
 
-func setup() transaction.TX {
-	logSlice := make([]byte, transaction.LOGSIZE)
-	heapSlice := make([]byte, 100000000)
-	transaction.Init(logSlice)
-	undoTx := transaction.NewUndo()
-	heap.Init(undoTx, heapSlice, 100000000)
-	d = NewDict(undoTx, 4, 1)
-	return undoTx
+func setup() {
+	d = NewDict(4, 1)
 }
 
 func assertEqual(t *testing.T, actual, expected interface{}) {
@@ -66,11 +79,11 @@ func assertEqual(t *testing.T, actual, expected interface{}) {
 }
 
 func BenchmarkDictSet(b *testing.B) {
-	undoTx := setup()
+	setup()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		d.set(undoTx, []byte(strconv.Itoa(i%10000)), i)
+		d.set([]byte(strconv.Itoa(i%10000)), int64(i))
 	}
 }
 
@@ -82,3 +95,22 @@ func BenchmarkMapInsert(b *testing.B) {
 		mbench[strconv.Itoa(i%10000)] = i
 	}
 }
+
+func TestSwizzleLocks(t *testing.T) {
+	db := &redisDb{dict: NewDict(4, 1), expire: NewDict(4, 1)}
+	h, zs := NewDict(4, 1), zsetCreate()
+	db.dict.set([]byte("hash"), h)
+	db.dict.set([]byte("zset"), zs)
+	dicts := []*dict{db.dict, db.expire, h, zs.dict}
+	// drop the locks like a restart does
+	for _, d := range dicts {
+		d.lock, d.rehashLock, d.tab[0].bucketlock = nil, nil, nil
+	}
+
+	fmt.Println("Rebuild the locks of the dicts nested in values too.")
+	db.swizzleLocks()
+	for _, d := range dicts {
+		assertEqual(t, d.lock != nil && d.rehashLock != nil, true)
+		assertEqual(t, len(d.tab[0].bucketlock), d.shard(len(d.tab[0].bucket)))
+	}
+}
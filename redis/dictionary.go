@@ -8,14 +8,13 @@ package redis
 import (
 	"bytes"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"math"
+	"math/bits"
 	"math/rand"
 	"runtime"
 	"sort"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -27,7 +26,18 @@ const (
 )
 
 var (
-	fnvHash hash.Hash32 = fnv.New32a()
+	// hashSeed keys the hash of all dicts. It is kept in the pool, so that
+	// keys stay in their buckets across restarts, see Server.init.
+	hashSeed [2]uint64
+
+	// legacyHash is set while the pool still holds entries placed by
+	// dumbhash, the hash of earlier versions. Until migrateHash moved them
+	// all, lookups also try the dumbhash bucket of a key.
+	legacyHash int32
+
+	// lastVersion is the last modification version handed out to an entry,
+	// accessed atomically, see nextVersion.
+	lastVersion uint64
 )
 
 type (
@@ -40,6 +50,8 @@ type (
 
 		initSize       int
 		bucketPerShard int
+
+		emptyVersion uint64 // version when empty was last called
 	}
 
 	table struct {
@@ -50,9 +62,10 @@ type (
 	}
 
 	entry struct {
-		key   []byte
-		value interface{}
-		next  *entry
+		key     []byte
+		value   interface{}
+		next    *entry
+		version uint64 // bumped on every modification of the key, see touch
 	}
 
 	dictIterator struct {
@@ -110,17 +123,27 @@ func inPMem(a unsafe.Pointer) {
 
 func (d *dict) swizzle() {
 	inPMem(unsafe.Pointer(d))
-	d.lock = new(sync.RWMutex)
-	d.rehashLock = new(sync.RWMutex)
+	d.swizzleLocks()
 	d.tab[0].swizzle(d)
 	d.tab[1].swizzle(d)
 }
 
+// swizzleLocks rebuilds the volatile locks of d without walking its entries.
+func (d *dict) swizzleLocks() {
+	txn("undo") {
+	d.lock = new(sync.RWMutex)
+	d.rehashLock = new(sync.RWMutex)
+	for i := range d.tab {
+		if s := d.tab[i].mask + 1; s > 0 {
+			d.tab[i].bucketlock = make([]sync.RWMutex, d.shard(s))
+		}
+	}
+	}
+}
+
 func (t *table) swizzle(d *dict) {
 	s := t.mask + 1
 	if s > 0 {
-		shards := d.shard(s)
-		t.bucketlock = make([]sync.RWMutex, shards)
 		inPMem(unsafe.Pointer(&t.bucket[0]))
 		inPMem(unsafe.Pointer(&t.used[0]))
 		total := 0
@@ -159,6 +182,18 @@ func (e *entry) swizzle() {
 		v.swizzle()
 	case *zset:
 		v.swizzle()
+	case *quicklist:
+		v.swizzle()
+	case *ziplist:
+		inPMem(unsafe.Pointer(v))
+		if len(v.data) > 0 {
+			inPMem(unsafe.Pointer(&v.data[0]))
+		}
+	case *intset:
+		inPMem(unsafe.Pointer(v))
+		if len(v.contents) > 0 {
+			inPMem(unsafe.Pointer(&v.contents[0]))
+		}
 	case int64:
 	case float64:
 	case nil:
@@ -174,16 +209,11 @@ func (d *dict) shard(b int) int {
 }
 
 func (d *dict) hashKey(key []byte) int {
-	return dumbhash(key)
-}
-
-func fnvhash(key []byte) int {
-	fnvHash.Write(key)
-	h := int(fnvHash.Sum32())
-	fnvHash.Reset()
-	return h
+	return int(siphash(hashSeed[0], hashSeed[1], key))
 }
 
+// dumbhash reads the key as a decimal number. Pools written before hashSeed
+// placed their entries with it, see legacyHash.
 func dumbhash(key []byte) int {
 	h := 0
 	for i, n := range key {
@@ -192,17 +222,23 @@ func dumbhash(key []byte) int {
 	return h
 }
 
-func memtierhash(key []byte) int {
-	h, _ := strconv.Atoi(string(key[8:]))
-	return h
-}
-
-// rehash and resize
-func (d *dict) Cron(sleep time.Duration) {
+// rehash and resize until quit is closed
+func (d *dict) Cron(sleep time.Duration, quit <-chan struct{}) {
 	var used, size0, size1 int
 	for {
 		if size1 == 0 {
-			time.Sleep(sleep) // reduce cpu consumption and lock contention
+			// reduce cpu consumption and lock contention
+			select {
+			case <-quit:
+				return
+			case <-time.After(sleep):
+			}
+		} else {
+			select {
+			case <-quit:
+				return
+			default:
+			}
 		}
 		txn("undo") {
 		d.rehashLock.Lock()
@@ -264,6 +300,112 @@ func (d *dict) rehashSwap() {
 	//fmt.Println("Rehash finished!")
 }
 
+// migrateHash moves the entries dumbhash placed in d to the buckets of their
+// seeded hash, one shard at a time under the exclusive dict lock like a
+// resize. fn is called on the values of a shard before it is migrated, so a
+// top level dict can migrate the dicts nested in its values under the same
+// locks, it returns how many nested entries it moved. Passes repeat until one
+// moves nothing while the tables stayed the same, a rehash may swap in a
+// table, or move an entry into a shard, that the pass has already left. As
+// with a rehash, a SCAN running meanwhile may miss the keys that move. It
+// returns false if quit is closed first.
+func (d *dict) migrateHash(fn func(interface{}) int, quit <-chan struct{}) bool {
+	for {
+		var start **entry
+		moved, same := 0, false
+		for t := 0; t < 2; t++ {
+			for s := 0; ; s++ {
+				select {
+				case <-quit:
+					return false
+				default:
+				}
+				done := false
+				txn("undo") {
+				d.rehashLock.Lock()
+				d.lock.Lock()
+				if t == 0 && s == 0 {
+					start = &d.tab[0].bucket[0]
+				}
+				tab := &d.tab[t]
+				lo := s * d.bucketPerShard
+				if lo >= len(tab.bucket) {
+					done = true
+					same = t == 1 && start == &d.tab[0].bucket[0]
+				} else {
+					hi := lo + d.bucketPerShard
+					if hi > len(tab.bucket) {
+						hi = len(tab.bucket)
+					}
+					if fn != nil {
+						for i := lo; i < hi; i++ {
+							for e := tab.bucket[i]; e != nil; e = e.next {
+								moved += fn(e.value)
+							}
+						}
+					}
+					moved += d.migrateBuckets(t, lo, hi)
+				}
+				}
+				if done {
+					break
+				}
+			}
+		}
+		if moved == 0 && same {
+			return true
+		}
+	}
+}
+
+// migrateAll moves all entries of a nested dict to the buckets of their seeded
+// hash and returns how many moved. The caller holds the lock of the key of d.
+func (d *dict) migrateAll() int {
+	moved := 0
+	for t := range d.tab {
+		moved += d.migrateBuckets(t, 0, len(d.tab[t].bucket))
+	}
+	return moved
+}
+
+// migrateBuckets moves the entries in buckets lo to hi-1 of table t that are
+// not in the bucket of their seeded hash and returns how many moved. While
+// rehashing, entries of table 0 move to table 1, the rehash may already have
+// passed their bucket in table 0.
+func (d *dict) migrateBuckets(t, lo, hi int) int {
+	moved := 0
+	tab := &d.tab[t]
+	dt := tab
+	if t == 0 && d.rehashIdx != -1 {
+		dt = &d.tab[1]
+	}
+	txn("undo") {
+	for i := lo; i < hi; i++ {
+		var pre *entry
+		for e := tab.bucket[i]; e != nil; {
+			next := e.next
+			b := d.hashKey(e.key) & dt.mask
+			if dt == tab && b == i {
+				pre = e
+			} else {
+				if pre == nil {
+					tab.bucket[i] = next
+				} else {
+					pre.next = next
+				}
+				e.next = dt.bucket[b]
+				dt.bucket[b] = e
+				tab.used[d.shard(i)]--
+				dt.used[d.shard(b)]++
+				moved++
+			}
+			e = next
+		}
+	}
+	}
+	return moved
+}
+
 func (d *dict) resizeIfNeeded() (used, size0, size1 int) {
 	size0 = len(d.tab[0].bucket)
 	used = d.size()
@@ -305,8 +447,7 @@ func (d *dict) lockKey(key []byte) {
 	}
 
 	for t := 0; t <= maxt; t++ {
-		s := d.findShard(t, key)
-		d.lockShard(t, s)
+		d.lockShards(t, d.keyShards(t, key, nil))
 	}
 	}
 }
@@ -319,27 +460,42 @@ func (d *dict) lockKeys(keys [][]byte, stride int) {
 	if d.tab[1].mask > 0 {
 		maxt = 1
 	}
-	shards := make([]int, len(keys)/stride)
+	shards := make([]int, 0, len(keys)/stride)
 
 	for t := 0; t <= maxt; t++ {
-		for i, _ := range shards {
-			shards[i] = d.findShard(t, keys[i*stride])
-		}
-		// make sure locks are acquired in the same order (ascending table and
-		// bucket id) to prevent deadlock!
-		sort.Ints(shards)
-		prev := -1
-		for _, s := range shards {
-			// only lock distinct shards
-			if s != prev {
-				d.lockShard(t, s)
-				prev = s
-			}
+		shards = shards[:0]
+		for i := 0; i < len(keys)/stride; i++ {
+			shards = d.keyShards(t, keys[i*stride], shards)
 		}
+		d.lockShards(t, shards)
 	}
 	}
 }
 
+// lockShards locks the distinct shards of table t. Sorting them makes sure
+// locks are acquired in the same order (ascending table and bucket id) to
+// prevent deadlock!
+func (d *dict) lockShards(t int, shards []int) {
+	sort.Ints(shards)
+	prev := -1
+	for _, s := range shards {
+		if s != prev {
+			d.lockShard(t, s)
+			prev = s
+		}
+	}
+}
+
+// keyShards appends the shards of table t that key may be in to shards. The
+// dumbhash bucket of the key is included until the migration is done.
+func (d *dict) keyShards(t int, key []byte, shards []int) []int {
+	shards = append(shards, d.findShard(t, key))
+	if atomic.LoadInt32(&legacyHash) != 0 {
+		shards = append(shards, d.shard(dumbhash(key)&d.tab[t].mask))
+	}
+	return shards
+}
+
 func (d *dict) lockAllKeys() {
 	txn("undo") {
 	d.lock.RLock()
@@ -394,6 +550,19 @@ func (d *dict) find(key []byte) (int, int, *entry, *entry) {
 			curr = curr.next
 		}
 	}
+	if atomic.LoadInt32(&legacyHash) != 0 {
+		lh := dumbhash(key)
+		for i := 0; i <= maxt; i++ {
+			lb := lh & d.tab[i].mask
+			var lpre *entry
+			for e := d.tab[i].bucket[lb]; e != nil; e = e.next {
+				if bytes.Equal(e.key, key) {
+					return i, lb, lpre, e
+				}
+				lpre = e
+			}
+		}
+	}
 	return maxt, b, pre, curr
 }
 
@@ -405,6 +574,7 @@ func (d *dict) set(key []byte, value interface{}) (insert bool) {
 	if e != nil {
 		txn("undo") {
 		e.value = value
+		e.version = nextVersion()
 		}
 		return false
 	} else {
@@ -412,6 +582,7 @@ func (d *dict) set(key []byte, value interface{}) (insert bool) {
 		e2.key = key
 		e2.value = value
 		e2.next = d.tab[t].bucket[b]
+		e2.version = nextVersion()
 		runtime.FlushRange(unsafe.Pointer(e2), unsafe.Sizeof(*e2)) // shadow update
 		txn("undo") {
 		d.tab[t].bucket[b] = e2
@@ -440,6 +611,39 @@ func (d *dict) delete(key []byte) *entry {
 	return e
 }
 
+// touch gives key a new modification version for updates that change its
+// value in place instead of going through set. It returns false if key does
+// not exist.
+func (d *dict) touch(key []byte) bool {
+	_, _, _, e := d.find(key)
+	if e == nil {
+		return false
+	}
+	txn("undo") {
+	e.version = nextVersion()
+	}
+	return true
+}
+
+// nextVersion returns a new modification version. Versions only grow, so a
+// key that is removed and set again never gets back a version a WATCH has
+// seen. The counter is shared by all dicts, writers of different shards get
+// their versions without a common lock. Each run starts above the versions
+// of earlier runs, see Server.init.
+func nextVersion() uint64 {
+	return atomic.AddUint64(&lastVersion, 1)
+}
+
+// keyVersion returns the modification version of key, 0 if it does not
+// exist. Any change to the key, including removing it, changes the version.
+func (d *dict) keyVersion(key []byte) uint64 {
+	_, _, _, e := d.find(key)
+	if e == nil {
+		return 0
+	}
+	return e.version
+}
+
 func (d *dict) size() int {
 	s := 0
 	for _, t := range d.tab {
@@ -463,6 +667,7 @@ func (d *dict) empty() {
 	d.resetTable(0, d.initSize)
 	d.resetTable(1, 0)
 	d.rehashIdx = -1
+	d.emptyVersion = nextVersion()
 	}
 }
 
@@ -507,6 +712,58 @@ func (d *dict) randomKey() *entry {
 	return e
 }
 
+// sample calls fn on about n entries of d and returns how many it visited. It
+// walks at most 20 buckets per entry from a random one of either table,
+// weighted by the buckets still in use, and wraps around to the first bucket
+// in use. The shards of the wrapped buckets are locked first, so shards are
+// still locked in ascending order. The locks are held until the end of the
+// caller's transaction, unless locked reports that the caller already holds
+// the tables of d, as EXEC does.
+func (d *dict) sample(n int, locked bool, fn func(e *entry)) (sampled int) {
+	txn("undo") {
+	if !locked {
+		d.rehashLock.RLock()
+		d.lock.RLock()
+	}
+	lo, size0, size1 := 0, d.tab[0].mask+1, d.tab[1].mask+1
+	if d.rehashIdx >= 0 {
+		lo = d.rehashIdx
+	} else if d.rehashIdx == -2 {
+		lo = size0
+	}
+	if size0-lo+size1 > 0 {
+		t := 0
+		if rand.Intn(size0-lo+size1) >= size0-lo {
+			t, lo = 1, 0
+		}
+		size := d.tab[t].mask + 1
+		start, walk := lo+rand.Intn(size-lo), 20*n
+		if walk > size-lo {
+			walk = size - lo
+		}
+		s := -1
+		for b := lo; !locked && b < lo+walk-(size-start); b++ {
+			if d.shard(b) != s {
+				s = d.shard(b)
+				d.lockShard(t, s)
+			}
+		}
+		for i := 0; i < walk && sampled < n; i++ {
+			b := lo + (start-lo+i)%(size-lo)
+			if !locked && d.shard(b) > s {
+				s = d.shard(b)
+				d.lockShard(t, s)
+			}
+			for e := d.tab[t].bucket[b]; e != nil; e = e.next {
+				fn(e)
+				sampled++
+			}
+		}
+	}
+	}
+	return
+}
+
 func (d *dict) getIterator() *dictIterator {
 	iter := &dictIterator{
 		d:         d,
@@ -544,3 +801,77 @@ func (i *dictIterator) next() *entry {
 	}
 	return nil
 }
+
+// scan calls fn for the entries in the buckets at cursor v and returns the
+// cursor of the next call, 0 once the whole dict was visited. Like dictScan
+// in redis, the cursor is incremented in reverse binary order over the bucket
+// index, so an entry present during the whole iteration is returned at least
+// once even if the tables grow, shrink or are rehashed between calls. While
+// rehashing, the buckets of the larger table that the bucket of the smaller
+// one expands to are visited in the same call. The caller must hold the locks
+// of the visited buckets.
+func (d *dict) scan(v uint64, fn func(e *entry)) uint64 {
+	return d.scanBuckets(v, func(t int, i uint64) {
+		for e := d.tab[t].bucket[i]; e != nil; e = e.next {
+			fn(e)
+		}
+	})
+}
+
+// scanShared is scan for a caller that holds no lock of d. The tables are
+// held shared during the call, and the shards of the visited buckets only
+// while fn runs, taken in ascending order. fn must copy what it keeps of e.
+func (d *dict) scanShared(v uint64, fn func(e *entry)) uint64 {
+	d.rehashLock.RLock()
+	defer d.rehashLock.RUnlock()
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	var shards [2][]int
+	d.scanBuckets(v, func(t int, i uint64) {
+		shards[t] = append(shards[t], d.shard(int(i)))
+	})
+	for t := range shards {
+		sort.Ints(shards[t])
+		for j, s := range shards[t] {
+			if j == 0 || s != shards[t][j-1] {
+				d.tab[t].bucketlock[s].RLock()
+				defer d.tab[t].bucketlock[s].RUnlock()
+			}
+		}
+	}
+	return d.scan(v, fn)
+}
+
+// scanBuckets calls visit for the buckets of table t that scan visits at
+// cursor v, and returns the next cursor.
+func (d *dict) scanBuckets(v uint64, visit func(t int, i uint64)) uint64 {
+	if d.rehashIdx == -1 {
+		m0 := uint64(d.tab[0].mask)
+		visit(0, v&m0)
+		return incrReverse(v, m0)
+	}
+	small, large := 0, 1
+	if d.tab[0].mask > d.tab[1].mask {
+		small, large = 1, 0
+	}
+	m0, m1 := uint64(d.tab[small].mask), uint64(d.tab[large].mask)
+	visit(small, v&m0)
+	for {
+		visit(large, v&m1)
+		v = incrReverse(v, m1)
+		// continue while the bits only covered by the larger mask are set
+		if v&(m0^m1) == 0 {
+			break
+		}
+	}
+	return v
+}
+
+// incrReverse increments the bits of v covered by mask, starting from the
+// highest one.
+func incrReverse(v, mask uint64) uint64 {
+	v |= ^mask
+	v = bits.Reverse64(v)
+	v++
+	return bits.Reverse64(v)
+}
@@ -0,0 +1,284 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+// Policies of maxmemory-policy, in the order of maxmemoryPolicies.
+const (
+	MAXMEMORY_NO_EVICTION int = iota
+	MAXMEMORY_ALLKEYS_LRU
+	MAXMEMORY_VOLATILE_LRU
+	MAXMEMORY_ALLKEYS_LFU
+	MAXMEMORY_VOLATILE_LFU
+	MAXMEMORY_ALLKEYS_RANDOM
+	MAXMEMORY_VOLATILE_RANDOM
+	MAXMEMORY_VOLATILE_TTL
+)
+
+var maxmemoryPolicies = []string{"noeviction", "allkeys-lru", "volatile-lru", "allkeys-lfu",
+	"volatile-lfu", "allkeys-random", "volatile-random", "volatile-ttl"}
+
+func maxmemoryPolicyFromString(s string) (int, error) {
+	for policy, name := range maxmemoryPolicies {
+		if strings.EqualFold(s, name) {
+			return policy, nil
+		}
+	}
+	return 0, errors.New("unknown policy")
+}
+
+func isLFUPolicy(policy int) bool {
+	return policy == MAXMEMORY_ALLKEYS_LFU || policy == MAXMEMORY_VOLATILE_LFU
+}
+
+// The LFU counter of a key is logarithmic like in redis: the lru field of its
+// keyMeta holds the last decrement time in minutes in its upper 16 bits and the
+// counter in its lowest 8 bits. The counter starts at lfuInitVal so new keys
+// are not evicted right away, and loses one every lfuDecayTime minutes.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = 1
+)
+
+// lruClock returns the access clock in seconds, the lru field of a keyMeta
+// holds it unless the policy is LFU.
+func lruClock() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+func lfuTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 0xffff
+}
+
+// lfuTimeElapsed returns the minutes since ldt, taking into account that the
+// 16 bit minute clock wraps.
+func lfuTimeElapsed(ldt uint32) uint32 {
+	now := lfuTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 0xffff - ldt + now
+}
+
+// lfuLogIncr increments counter with a probability that decreases as the
+// counter grows.
+func lfuLogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return counter
+	}
+	baseval := float64(counter) - lfuInitVal
+	if baseval < 0 {
+		baseval = 0
+	}
+	if rand.Float64() < 1/(baseval*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecrAndReturn returns the counter of lru decremented by the decay
+// periods elapsed since it was last updated.
+func lfuDecrAndReturn(lru uint32) uint32 {
+	counter := lru & 255
+	periods := lfuTimeElapsed(lru>>8) / lfuDecayTime
+	if periods > counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// keyMeta is the volatile state of a key kept for maxmemory. It is not part
+// of the entry, so reads never store into pmem and the entries of nested
+// dicts don't carry it. It starts over on every start of the server.
+type keyMeta struct {
+	lru      uint32 // access clock or LFU counter, see updateLRU
+	usage    uint32 // estimated bytes of the key, see updateUsage
+	usageLen uint32 // length of the value when usage was updated
+}
+
+// meta returns the keyMeta of the entry e of the main dict, e.g. the one of a
+// key not accessed since the start is created as for a new key.
+func (db *redisDb) meta(e *entry) *keyMeta {
+	if m, ok := db.metas.Load(e); ok {
+		return m.(*keyMeta)
+	}
+	m, _ := db.metas.LoadOrStore(e, &keyMeta{lru: db.initialLRU()})
+	return m.(*keyMeta)
+}
+
+// dropMeta forgets the keyMeta of the entry e, which was deleted from the
+// main dict, and returns it.
+func (db *redisDb) dropMeta(e *entry) *keyMeta {
+	m, ok := db.metas.Load(e)
+	if !ok {
+		return &keyMeta{}
+	}
+	db.metas.Delete(e)
+	return m.(*keyMeta)
+}
+
+// initialLRU returns the lru field of a new key.
+func (db *redisDb) initialLRU() uint32 {
+	if isLFUPolicy(db.cfg.MaxMemoryPolicy) {
+		return lfuTimeInMinutes()<<8 | lfuInitVal
+	}
+	return lruClock()
+}
+
+// updateLRU records an access to the key of e. Readers call it under shared
+// locks, so the lru field is only accessed atomically. A concurrent access
+// may win and drop an LFU increment.
+func (db *redisDb) updateLRU(e *entry) {
+	m := db.meta(e)
+	if isLFUPolicy(db.cfg.MaxMemoryPolicy) {
+		lru := atomic.LoadUint32(&m.lru)
+		atomic.StoreUint32(&m.lru, lfuTimeInMinutes()<<8|lfuLogIncr(lfuDecrAndReturn(lru)))
+	} else {
+		atomic.StoreUint32(&m.lru, lruClock())
+	}
+}
+
+// evictionScore ranks the key of e for eviction, the higher the better.
+func (db *redisDb) evictionScore(policy int, e *entry) int64 {
+	switch policy {
+	case MAXMEMORY_ALLKEYS_LRU, MAXMEMORY_VOLATILE_LRU:
+		return int64(lruClock() - atomic.LoadUint32(&db.meta(e).lru))
+	case MAXMEMORY_ALLKEYS_LFU, MAXMEMORY_VOLATILE_LFU:
+		return int64(255 - lfuDecrAndReturn(atomic.LoadUint32(&db.meta(e).lru)))
+	default:
+		return rand.Int63()
+	}
+}
+
+// usedMemory returns the bytes maxmemory limits: the estimates of the keys
+// and the dict overhead of every db. Memory the pmem heap has not reused yet,
+// its fragmentation and the undo logs are not included, see Config.MaxMemory.
+func (s *Server) usedMemory() int64 {
+	return atomic.LoadInt64(&s.stats.usedMemory) + atomic.LoadInt64(&s.stats.overheadMemory)
+}
+
+// updateOverhead measures the tables of the dicts of db and the entries of its
+// expire dict, like MEMORY STATS. The expire cron calls it every cycle, so
+// the overhead lags a resize by at most an expire interval.
+func (db *redisDb) updateOverhead() {
+	main, expires := db.dict.stats(false), db.expire.stats(false)
+	n := main.tableBytes() + expires.tableBytes() + int64(expires.entries())*expireEntryUsage
+	atomic.AddInt64(&db.stats.overheadMemory, n-atomic.SwapInt64(&db.overhead, n))
+}
+
+// freeMemoryIfNeeded evicts keys according to maxmemory-policy until the
+// memory used by the keys and the dicts is within maxmemory. It returns false
+// if that is not possible, the command must then be rejected.
+func (c *client) freeMemoryIfNeeded() bool {
+	s := c.s
+	if s.cfg.MaxMemory == 0 {
+		return true
+	}
+	for s.usedMemory() > s.cfg.MaxMemory {
+		if s.cfg.MaxMemoryPolicy == MAXMEMORY_NO_EVICTION || !s.evictKey() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictKey deletes the best key to evict among maxmemory-samples keys of
+// every db, each sampled in its own transaction. It returns false if no db
+// has a key the policy can evict.
+func (s *Server) evictKey() bool {
+	s.inflight.RLock()
+	defer s.inflight.RUnlock()
+	if s.closing() {
+		return false
+	}
+	var (
+		best      *redisDb
+		bestKey   []byte
+		bestScore int64
+	)
+	for _, db := range s.dbs {
+		var (
+			key   []byte
+			score int64
+		)
+		txn("undo") {
+		key, score = db.evictionCandidate(s.cfg.MaxMemoryPolicy, s.cfg.MaxMemorySamples)
+		}
+		if key != nil && (bestKey == nil || score > bestScore) {
+			best, bestKey, bestScore = db, key, score
+		}
+	}
+	if bestKey == nil {
+		return false
+	}
+	evicted, expired := false, false
+	txn("undo") {
+	// the key may have been deleted or expired since it was sampled.
+	expired = best.lockKeyWrite(bestKey)
+	if best.delete(bestKey) {
+		evicted = true
+	}
+	}
+	if evicted {
+		atomic.AddInt64(&s.stats.evictedKeys, 1)
+		best.notifyKeyspaceEvent(NOTIFY_EVICTED, "evicted", bestKey)
+	} else if expired {
+		best.notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", bestKey)
+	}
+	return true
+}
+
+// evictionCandidate returns the best key to evict among about n keys of db
+// and its score, nil if db has no key the policy can evict. The volatile
+// policies sample the expire dict, the LRU and LFU ones then lock the keys in
+// the main dict to read their access clock.
+func (db *redisDb) evictionCandidate(policy, n int) (best []byte, bestScore int64) {
+	consider := func(key []byte, score int64) {
+		if best == nil || score > bestScore {
+			best, bestScore = key, score
+		}
+	}
+	switch policy {
+	case MAXMEMORY_ALLKEYS_LRU, MAXMEMORY_ALLKEYS_LFU, MAXMEMORY_ALLKEYS_RANDOM:
+		db.dict.sample(n, false, func(e *entry) {
+			consider(e.key, db.evictionScore(policy, e))
+		})
+	case MAXMEMORY_VOLATILE_TTL:
+		db.expire.sample(n, false, func(e *entry) {
+			consider(e.key, math.MaxInt64-e.value.(int64))
+		})
+	case MAXMEMORY_VOLATILE_RANDOM:
+		db.expire.sample(n, false, func(e *entry) {
+			consider(e.key, rand.Int63())
+		})
+	case MAXMEMORY_VOLATILE_LRU, MAXMEMORY_VOLATILE_LFU:
+		var keys [][]byte
+		db.expire.sample(n, false, func(e *entry) {
+			keys = append(keys, e.key)
+		})
+		if len(keys) == 0 {
+			break
+		}
+		db.dict.lockKeys(keys, 1)
+		for _, key := range keys {
+			if _, _, _, e := db.dict.find(key); e != nil {
+				consider(key, db.evictionScore(policy, e))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,115 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMaxmemory(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	c.s.populateCommandTable()
+	query := func(args ...string) string {
+		c.wBuffer.Reset()
+		c.argv = argv(args...)
+		c.argc = len(c.argv)
+		c.processCommand()
+		return c.wBuffer.String()
+	}
+
+	fmt.Println("Reject commands that may grow memory over maxmemory with noeviction.")
+	c.s.cfg.MaxMemory = 100
+	c.s.stats.usedMemory = 101
+	assertEqual(t, query("SET", "a", "b"), string(shared.oomerr))
+	multiCommand(c)
+	assertEqual(t, query("LPUSH", "l", "x"), string(shared.oomerr))
+	c.wBuffer.Reset()
+	execCommand(c)
+	assertEqual(t, c.wBuffer.String(), string(shared.execaborterr))
+	c.s.stats.usedMemory = 100
+	assertEqual(t, c.freeMemoryIfNeeded(), true)
+
+	fmt.Println("Parse the eviction policies.")
+	cfg := DefaultConfig()
+	assertEqual(t, cfg.Set("maxmemory-policy", "Volatile-TTL"), nil)
+	assertEqual(t, cfg.MaxMemoryPolicy, MAXMEMORY_VOLATILE_TTL)
+	assertEqual(t, cfg.Set("maxmemory-policy", "lru") != nil, true)
+	assertEqual(t, cfg.Set("maxmemory", "1gb"), nil)
+	assertEqual(t, cfg.MaxMemory, int64(1024*1024*1024))
+
+	fmt.Println("Decay and increment the LFU counter.")
+	now := lfuTimeInMinutes()
+	assertEqual(t, lfuDecrAndReturn(now<<8|10), uint32(10))
+	assertEqual(t, lfuDecrAndReturn((now-3)&0xffff<<8|10), uint32(7))
+	assertEqual(t, lfuDecrAndReturn((now-30)&0xffff<<8|10), uint32(0))
+	assertEqual(t, lfuLogIncr(0), uint32(1))
+	assertEqual(t, lfuLogIncr(255), uint32(255))
+	counter := uint32(lfuInitVal)
+	for i := 0; i < 1000; i++ {
+		counter = lfuLogIncr(counter)
+	}
+	assertEqual(t, counter > lfuInitVal && counter < 100, true)
+
+	fmt.Println("Estimate the memory of a value from samples of its elements.")
+	d := &dict{tab: [2]table{scanTable(8, 8), {mask: -1}}, rehashIdx: -1}
+	d.tab[0].used = []int{8}
+	assertEqual(t, dictUsage(d, 0), dictUsage(d, 3))
+	assertEqual(t, objectUsage([]byte("key"), int64(1), 5), objectUsage([]byte("abc"), 1.5, 5))
+
+	fmt.Println("Scale the usage of aggregates on in place updates, sample it again past powers of two.")
+	c = newTestClient(1)
+	c.s.cfg.MaxMemory = 1 << 40
+	runCommand(c, "RPUSH", "l", "a", "b")
+	_, _, _, e := c.db.dict.find([]byte("l"))
+	m := c.db.meta(e)
+	assertEqual(t, int64(m.usage), objectUsage(e.key, e.value, c.s.cfg.MaxMemorySamples))
+	usage := int64(m.usage)
+	runCommand(c, "RPUSH", "l", "c")
+	assertEqual(t, m.usageLen, uint32(3))
+	assertEqual(t, int64(m.usage), usage*3/2)
+	runCommand(c, "RPUSH", "l", "d")
+	assertEqual(t, int64(m.usage), objectUsage(e.key, e.value, c.s.cfg.MaxMemorySamples))
+	assertEqual(t, c.db.used, int64(m.usage))
+
+	fmt.Println("Count the dict tables and the expire entries against maxmemory.")
+	runCommand(c, "SET", "k", "v", "EX", "100")
+	c.db.updateOverhead()
+	overhead := c.db.dict.tableBytes() + c.db.expire.tableBytes() + expireEntryUsage
+	assertEqual(t, c.db.overhead, overhead)
+	assertEqual(t, c.s.usedMemory(), c.s.stats.usedMemory+overhead)
+
+	fmt.Println("Forget the state of deleted keys.")
+	_, _, _, ek := c.db.dict.find([]byte("k"))
+	runCommand(c, "DEL", "k")
+	_, ok := c.db.metas.Load(ek)
+	assertEqual(t, ok, false)
+	assertEqual(t, c.db.used, int64(m.usage))
+
+	fmt.Println("Record accesses from concurrent readers.")
+	c.s.cfg.MaxMemoryPolicy = MAXMEMORY_ALLKEYS_LFU
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.db.updateLRU(e)
+				c.db.evictionScore(MAXMEMORY_ALLKEYS_LFU, e)
+			}
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, c.db.evictionScore(MAXMEMORY_ALLKEYS_LFU, e) < 255-lfuInitVal, true)
+
+	fmt.Println("Drop the state of all keys on FLUSHDB.")
+	runCommand(c, "FLUSHDB")
+	_, ok = c.db.metas.Load(e)
+	assertEqual(t, ok, false)
+	assertEqual(t, c.db.used, int64(0))
+}
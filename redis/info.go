@@ -0,0 +1,303 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// serverStats are the volatile counters reported by INFO. The counters are
+// updated atomically from any goroutine.
+type serverStats struct {
+	startTime    time.Time     // set by Start
+	recoveryTime time.Duration // swizzle of the databases at the last start
+
+	numConnections int64 // connections accepted
+	numCommands    int64 // commands processed
+	expiredKeys    int64 // keys deleted by lazy and active expiry
+	evictedKeys    int64 // keys deleted by maxmemory-policy
+	usedMemory     int64 // estimated bytes of the keys with maxmemory set
+	overheadMemory int64 // bytes of the dicts with maxmemory set, see updateOverhead
+	keyspaceHits   int64
+	keyspaceMisses int64
+}
+
+// infoSections are the sections INFO reports without argument. INFO all adds
+// dicts, the rehash state and shard counters of every db.
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace"}
+
+// INFO [section]
+func infoCommand(c *client) {
+	if c.argc > 2 {
+		c.addReply(shared.syntaxerr)
+		return
+	}
+	section := "default"
+	if c.argc == 2 {
+		section = strings.ToLower(string(c.argv[1]))
+	}
+	c.addReplyBulk([]byte(c.genInfoString(section)))
+}
+
+func (c *client) genInfoString(section string) string {
+	var sections []string
+	switch section {
+	case "default":
+		sections = infoSections
+	case "all", "everything":
+		sections = append(infoSections, "dicts")
+	default:
+		sections = []string{section}
+	}
+	var b bytes.Buffer
+	for _, name := range sections {
+		n := b.Len()
+		if n > 0 {
+			b.WriteString("\r\n")
+		}
+		if !c.genInfoSection(&b, name) {
+			b.Truncate(n)
+		}
+	}
+	return b.String()
+}
+
+// genInfoSection writes one section, returning false for an unknown one. The
+// keyspace and dicts sections read the dicts with dict.stats, no key locks
+// are held.
+func (c *client) genInfoSection(b *bytes.Buffer, name string) bool {
+	s := c.s
+	line := func(field string, value interface{}) {
+		fmt.Fprintf(b, "%s:%v\r\n", field, value)
+	}
+	switch name {
+	case "server":
+		b.WriteString("# Server\r\n")
+		uptime := time.Since(s.stats.startTime)
+		_, port, _ := net.SplitHostPort(s.cfg.Addr)
+		line("redis_version", REDIS_VERSION)
+		line("redis_mode", "standalone")
+		line("os", runtime.GOOS+" "+runtime.GOARCH)
+		line("arch_bits", strconv.IntSize)
+		line("go_version", runtime.Version())
+		line("process_id", os.Getpid())
+		line("tcp_port", port)
+		line("uptime_in_seconds", int64(uptime/time.Second))
+		line("uptime_in_days", int64(uptime/(24*time.Hour)))
+	case "clients":
+		b.WriteString("# Clients\r\n")
+		s.mu.Lock()
+		connected := len(s.clients)
+		s.mu.Unlock()
+		line("connected_clients", connected)
+		line("blocked_clients", s.blocking.numClients())
+	case "memory":
+		b.WriteString("# Memory\r\n")
+		// used_memory is the volatile Go heap, the pool is reported by
+		// the blocks of its file, see poolUsage.
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		used, total := poolUsage(s.cfg.PoolPath)
+		line("used_memory", ms.HeapAlloc)
+		line("used_memory_human", bytesToHuman(int64(ms.HeapAlloc)))
+		line("used_memory_pmem", used)
+		line("used_memory_pmem_human", bytesToHuman(used))
+		line("total_pmem", total)
+		line("total_pmem_human", bytesToHuman(total))
+		line("used_memory_dataset", atomic.LoadInt64(&s.stats.usedMemory))
+		line("maxmemory", s.cfg.MaxMemory)
+		line("maxmemory_human", bytesToHuman(s.cfg.MaxMemory))
+		line("maxmemory_policy", maxmemoryPolicies[s.cfg.MaxMemoryPolicy])
+	case "persistence":
+		b.WriteString("# Persistence\r\n")
+		line("loading", 0)
+		line("pool_path", s.cfg.PoolPath)
+		line("last_run_clean", boolToInt(s.lastRunClean))
+		line("recovery_time_ms", int64(s.stats.recoveryTime/time.Millisecond))
+	case "stats":
+		b.WriteString("# Stats\r\n")
+		s.pubsub.mu.RLock()
+		channels, patterns := len(s.pubsub.channels), 0
+		for _, clients := range s.pubsub.patterns {
+			patterns += len(clients)
+		}
+		s.pubsub.mu.RUnlock()
+		line("total_connections_received", atomic.LoadInt64(&s.stats.numConnections))
+		line("total_commands_processed", atomic.LoadInt64(&s.stats.numCommands))
+		line("expired_keys", atomic.LoadInt64(&s.stats.expiredKeys))
+		line("evicted_keys", atomic.LoadInt64(&s.stats.evictedKeys))
+		line("keyspace_hits", atomic.LoadInt64(&s.stats.keyspaceHits))
+		line("keyspace_misses", atomic.LoadInt64(&s.stats.keyspaceMisses))
+		line("pubsub_channels", channels)
+		line("pubsub_patterns", patterns)
+	case "keyspace":
+		b.WriteString("# Keyspace\r\n")
+		for id, db := range s.dbs {
+			keys, expires := db.dict.stats(c.batch).entries(), db.expire.stats(c.batch).entries()
+			if keys > 0 {
+				// avg_ttl is not tracked, it is kept for parsers of the format.
+				line(fmt.Sprintf("db%d", id), fmt.Sprintf("keys=%d,expires=%d,avg_ttl=0", keys, expires))
+			}
+		}
+	case "dicts":
+		b.WriteString("# Dicts\r\n")
+		for id, db := range s.dbs {
+			db.dict.stats(c.batch).genInfo(b, fmt.Sprintf("db%d_dict", id))
+			db.expire.stats(c.batch).genInfo(b, fmt.Sprintf("db%d_expires", id))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// dictStats are the rehash state of a dict and the entries used in each shard
+// of its tables.
+type dictStats struct {
+	rehashIdx int
+	tab       [2]struct {
+		size int
+		used []int
+	}
+}
+
+// stats reads the rehash state and the shard counters of d. Unless the caller
+// holds the table locks of d, as EXEC does, it takes them shared, and each
+// shard lock only while reading its counter. Writers of other shards do not
+// wait for it, so the counters of different shards may be from different
+// moments.
+func (d *dict) stats(locked bool) *dictStats {
+	if !locked {
+		d.rehashLock.RLock()
+		defer d.rehashLock.RUnlock()
+		d.lock.RLock()
+		defer d.lock.RUnlock()
+	}
+	ds := &dictStats{rehashIdx: d.rehashIdx}
+	for i := range d.tab {
+		t := &d.tab[i]
+		ds.tab[i].size = t.mask + 1
+		if t.used == nil {
+			continue
+		}
+		ds.tab[i].used = make([]int, len(t.used))
+		for s := range t.used {
+			if !locked {
+				t.bucketlock[s].RLock()
+			}
+			ds.tab[i].used[s] = t.used[s]
+			if !locked {
+				t.bucketlock[s].RUnlock()
+			}
+		}
+	}
+	return ds
+}
+
+// entries returns the number of entries in both tables.
+func (ds *dictStats) entries() int {
+	n := 0
+	for _, t := range ds.tab {
+		for _, u := range t.used {
+			n += u
+		}
+	}
+	return n
+}
+
+// tableBytes returns the bytes of the bucket arrays and shard counters of
+// both tables.
+func (ds *dictStats) tableBytes() int64 {
+	var n int64
+	for _, t := range ds.tab {
+		n += int64(t.size)*int64(unsafe.Sizeof((*entry)(nil))) +
+			int64(len(t.used))*int64(unsafe.Sizeof(int(0)))
+	}
+	return n
+}
+
+// genInfo writes the rehash state of a dict, and the entries used in each
+// shard of its tables.
+func (ds *dictStats) genInfo(b *bytes.Buffer, name string) {
+	fmt.Fprintf(b, "%s:rehashidx=%d", name, ds.rehashIdx)
+	for i, t := range ds.tab {
+		used := 0
+		for _, u := range t.used {
+			used += u
+		}
+		fmt.Fprintf(b, ",table%d_size=%d,table%d_used=%d", i, t.size, i, used)
+	}
+	b.WriteString("\r\n")
+	for i, t := range ds.tab {
+		if t.used == nil {
+			continue
+		}
+		fmt.Fprintf(b, "%s_table%d_shards:", name, i)
+		for j, u := range t.used {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Itoa(u))
+		}
+		b.WriteString("\r\n")
+	}
+}
+
+// poolUsage returns the bytes allocated to the pool file, from st_blocks, and
+// its size. The pool is a sparse file whose blocks are allocated as the pmem
+// heap first touches them. The heap never returns them, so the allocated bytes
+// are the peak usage of the heap, not the bytes it currently uses.
+func poolUsage(path string) (used, total int64) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, 0
+	}
+	return st.Blocks * 512, st.Size
+}
+
+func (b *blocking) numClients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clients := make(map[*client]struct{})
+	for _, q := range b.keys {
+		for _, c := range q {
+			clients[c] = struct{}{}
+		}
+	}
+	return len(clients)
+}
+
+// bytesToHuman formats n like redis, e.g., 1.50K or 2.00G.
+func bytesToHuman(n int64) string {
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", f, units[i])
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
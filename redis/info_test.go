@@ -0,0 +1,56 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	c.s.stats.numCommands = 7
+
+	fmt.Println("INFO reports the default sections in order.")
+	info := c.genInfoString("default")
+	var sections []string
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, "# ") {
+			sections = append(sections, line[2:])
+		}
+	}
+	assertEqual(t, sections, []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Keyspace"})
+	assertEqual(t, strings.Contains(info, "\r\nredis_version:"+REDIS_VERSION+"\r\n"), true)
+	assertEqual(t, strings.Contains(info, "\r\ntotal_commands_processed:7\r\n"), true)
+	assertEqual(t, strings.Contains(info, "\r\n\r\n# Clients\r\nconnected_clients:0\r\n"), true)
+
+	fmt.Println("INFO section reports only that section.")
+	assertEqual(t, c.genInfoString("persistence"),
+		"# Persistence\r\nloading:0\r\npool_path:./database\r\nlast_run_clean:0\r\nrecovery_time_ms:0\r\n")
+	assertEqual(t, c.genInfoString("nosuchsection"), "")
+	c.argv = argv("INFO", "a", "b")
+	c.argc = 3
+	infoCommand(c)
+	assertEqual(t, c.wBuffer.String(), "-ERR syntax error\r\n")
+
+	fmt.Println("Report the keys and dicts of the databases.")
+	c = newTestClient(2)
+	runCommand(c, "SET", "a", "1")
+	runCommand(c, "SET", "b", "2", "EX", "100")
+	info = c.genInfoString("keyspace")
+	assertEqual(t, info, "# Keyspace\r\ndb0:keys=2,expires=1,avg_ttl=0\r\n")
+	info = c.genInfoString("dicts")
+	assertEqual(t, strings.Contains(info, fmt.Sprintf("\r\ndb0_dict:rehashidx=-1,table0_size=%d,table0_used=2,"+
+		"table1_size=0,table1_used=0\r\n", c.db.dict.tab[0].mask+1)), true)
+	assertEqual(t, strings.Contains(info, "\r\ndb1_expires:rehashidx=-1,"), true)
+
+	fmt.Println("Format memory sizes like redis.")
+	assertEqual(t, bytesToHuman(1000), "1000B")
+	assertEqual(t, bytesToHuman(1536), "1.50K")
+	assertEqual(t, bytesToHuman(3*1024*1024*1024), "3.00G")
+}
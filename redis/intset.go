@@ -0,0 +1,211 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+// intset is a sorted set of integers, all stored with the width of the
+// largest one like in redis. Updates move the integers of contents in place,
+// in a transaction that logs the range they overwrite once, so a crash leaves
+// the old or the new set. contents is only reallocated, with room to double, once
+// it is full or its encoding is upgraded.
+type intset struct {
+	encoding uint32 // bytes per integer, one of INTSET_ENC_*
+	length   uint32
+	contents []byte // little endian integers in ascending order
+}
+
+const (
+	INTSET_ENC_INT16 uint32 = 2
+	INTSET_ENC_INT32 uint32 = 4
+	INTSET_ENC_INT64 uint32 = 8
+)
+
+func intsetNew() *intset {
+	is := pnew(intset)
+	txn("undo") {
+	is.encoding = INTSET_ENC_INT16
+	}
+	return is
+}
+
+// return the encoding needed to store value.
+func intsetValueEncoding(value int64) uint32 {
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return INTSET_ENC_INT64
+	} else if value < math.MinInt16 || value > math.MaxInt16 {
+		return INTSET_ENC_INT32
+	} else {
+		return INTSET_ENC_INT16
+	}
+}
+
+// get the integer at pos of contents encoded with enc.
+func intsetGetEncoded(contents []byte, pos int, enc uint32) int64 {
+	switch enc {
+	case INTSET_ENC_INT64:
+		return int64(binary.LittleEndian.Uint64(contents[pos*8:]))
+	case INTSET_ENC_INT32:
+		return int64(int32(binary.LittleEndian.Uint32(contents[pos*4:])))
+	default:
+		return int64(int16(binary.LittleEndian.Uint16(contents[pos*2:])))
+	}
+}
+
+// set the integer at pos of contents encoded with enc.
+func intsetSetEncoded(contents []byte, pos int, enc uint32, value int64) {
+	switch enc {
+	case INTSET_ENC_INT64:
+		binary.LittleEndian.PutUint64(contents[pos*8:], uint64(value))
+	case INTSET_ENC_INT32:
+		binary.LittleEndian.PutUint32(contents[pos*4:], uint32(value))
+	default:
+		binary.LittleEndian.PutUint16(contents[pos*2:], uint16(value))
+	}
+}
+
+func (is *intset) Len() int {
+	return int(is.length)
+}
+
+// get the integer at pos.
+func (is *intset) Get(pos int) int64 {
+	return intsetGetEncoded(is.contents, pos, is.encoding)
+}
+
+// return a random integer of a non empty set.
+func (is *intset) Random() int64 {
+	return is.Get(rand.Intn(is.Len()))
+}
+
+// binary search value, return its position or the position it should be
+// inserted at.
+func (is *intset) search(value int64) (int, bool) {
+	n := is.Len()
+	// the ends are checked first, new integers are often appended.
+	if n == 0 || value > is.Get(n-1) {
+		return n, false
+	} else if value < is.Get(0) {
+		return 0, false
+	}
+	pos := sort.Search(n, func(i int) bool {
+		return is.Get(i) >= value
+	})
+	return pos, is.Get(pos) == value
+}
+
+func (is *intset) Find(value int64) bool {
+	if intsetValueEncoding(value) > is.encoding {
+		return false
+	}
+	_, found := is.search(value)
+	return found
+}
+
+// add value to the set, return false if it is already there.
+func (is *intset) Add(value int64) bool {
+	enc := is.encoding
+	pos, found := 0, false
+	if valenc := intsetValueEncoding(value); valenc > enc {
+		// value does not fit the current encoding, so it is either smaller
+		// or larger than all the integers of the set.
+		enc = valenc
+		if value > 0 {
+			pos = is.Len()
+		}
+	} else if pos, found = is.search(value); found {
+		return false
+	}
+	var encoded [8]byte
+	intsetSetEncoded(encoded[:], 0, enc, value)
+	w, size := int(enc), (is.Len()+1)*int(enc)
+	if enc != is.encoding || size > cap(is.contents) {
+		// upgrade or grow into a new slice, with a hole for value at pos.
+		newcontents := pmake([]byte, 2*size)[:size]
+		for i := 0; i < is.Len(); i++ {
+			j := i
+			if i >= pos {
+				j++
+			}
+			intsetSetEncoded(newcontents, j, enc, is.Get(i))
+		}
+		copy(newcontents[pos*w:], encoded[:w])
+		runtime.FlushRange(unsafe.Pointer(&newcontents[0]), uintptr(size))
+		txn("undo") {
+		is.encoding = enc
+		is.contents = newcontents
+		is.length++
+		}
+		return true
+	}
+	// move the integers from pos one up, then store value at pos. A txn
+	// block would log each byte stored by the loop of a move, and not log
+	// copy at all, so the range is logged by hand first.
+	contents := is.contents[:size]
+	tx := transaction.NewUndo()
+	tx.Begin()
+	tx.Log(contents[pos*w:])
+	copy(contents[(pos+1)*w:], contents[pos*w:size-w])
+	copy(contents[pos*w:], encoded[:w])
+	txn("undo") {
+	is.contents = contents
+	is.length++
+	}
+	tx.End()
+	transaction.Release(tx)
+	return true
+}
+
+// remove value from the set, return false if it is not there. The encoding is
+// never downgraded, and contents keeps its capacity.
+func (is *intset) Remove(value int64) bool {
+	if intsetValueEncoding(value) > is.encoding {
+		return false
+	}
+	pos, found := is.search(value)
+	if !found {
+		return false
+	}
+	w := int(is.encoding)
+	// move the integers after pos one down, logging their range once like
+	// Add.
+	contents := is.contents
+	tx := transaction.NewUndo()
+	tx.Begin()
+	tx.Log(contents[pos*w:])
+	copy(contents[pos*w:], contents[(pos+1)*w:])
+	txn("undo") {
+	is.contents = contents[:len(contents)-w]
+	is.length--
+	}
+	tx.End()
+	transaction.Release(tx)
+	return true
+}
+
+func (is *intset) deepCopy() *intset {
+	newis := pnew(intset)
+	newcontents := pmake([]byte, len(is.contents))
+	copy(newcontents, is.contents)
+	if len(newcontents) > 0 {
+		runtime.FlushRange(unsafe.Pointer(&newcontents[0]), uintptr(len(newcontents)))
+	}
+	txn("undo") {
+	newis.encoding = is.encoding
+	newis.length = is.length
+	newis.contents = newcontents
+	}
+	return newis
+}
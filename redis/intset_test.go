@@ -0,0 +1,117 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestIntset(t *testing.T) {
+	fmt.Println("Pick the smallest encoding of a value.")
+	assertEqual(t, intsetValueEncoding(math.MaxInt16), INTSET_ENC_INT16)
+	assertEqual(t, intsetValueEncoding(math.MinInt16-1), INTSET_ENC_INT32)
+	assertEqual(t, intsetValueEncoding(math.MaxInt32), INTSET_ENC_INT32)
+	assertEqual(t, intsetValueEncoding(math.MinInt32-1), INTSET_ENC_INT64)
+
+	fmt.Println("Binary search the sorted integers.")
+	values := []int64{-5, 3, 40000}
+	contents := make([]byte, len(values)*int(INTSET_ENC_INT32))
+	for i, v := range values {
+		intsetSetEncoded(contents, i, INTSET_ENC_INT32, v)
+	}
+	is := &intset{encoding: INTSET_ENC_INT32, length: uint32(len(values)), contents: contents}
+	assertEqual(t, is.Get(2), int64(40000))
+	assertEqual(t, is.Find(3), true)
+	assertEqual(t, is.Find(4), false)
+	assertEqual(t, is.Find(1<<40), false)
+	pos, found := is.search(4)
+	assertEqual(t, pos, 2)
+	assertEqual(t, found, false)
+	pos, _ = is.search(-10)
+	assertEqual(t, pos, 0)
+	pos, _ = is.search(50000)
+	assertEqual(t, pos, 3)
+
+	fmt.Println("Only match members that are canonical integers.")
+	assertEqual(t, setTypeIsMember(is, []byte("-5")), true)
+	assertEqual(t, setTypeIsMember(is, []byte("03")), false)
+	assertEqual(t, setTypeIsMember(is, int64(40000)), true)
+	assertEqual(t, setTypeSize(is), 3)
+	si := setTypeInitIterator(is)
+	for _, v := range values {
+		assertEqual(t, setTypeNext(si), v)
+	}
+	assertEqual(t, setTypeNext(si), nil)
+	assertEqual(t, typeName(is), "set")
+	assertEqual(t, encodingName(is), "intset")
+
+	fmt.Println("Add integers in order, upgrades go first if negative and last if positive.")
+	is = intsetNew()
+	members := func() []int64 {
+		m := make([]int64, is.Len())
+		for i := range m {
+			m[i] = is.Get(i)
+		}
+		return m
+	}
+	for _, v := range []int64{5, 1, 3} {
+		assertEqual(t, is.Add(v), true)
+	}
+	assertEqual(t, is.Add(3), false)
+	assertEqual(t, members(), []int64{1, 3, 5})
+	assertEqual(t, is.encoding, INTSET_ENC_INT16)
+	assertEqual(t, is.Add(-70000), true)
+	assertEqual(t, is.encoding, INTSET_ENC_INT32)
+	assertEqual(t, is.Add(1<<40), true)
+	assertEqual(t, is.encoding, INTSET_ENC_INT64)
+	assertEqual(t, members(), []int64{-70000, 1, 3, 5, 1 << 40})
+	assertEqual(t, is.Add(-1<<40), true)
+	assertEqual(t, is.Add(4), true)
+	assertEqual(t, members(), []int64{-1 << 40, -70000, 1, 3, 4, 5, 1 << 40})
+
+	fmt.Println("Move the integers in place while contents has room.")
+	base := &is.contents[0]
+	for v := int64(6); is.Len() < cap(is.contents)/int(is.encoding); v++ {
+		assertEqual(t, is.Add(-v), true)
+	}
+	assertEqual(t, &is.contents[0] == base, true)
+	assertEqual(t, is.Add(100), true)
+	assertEqual(t, &is.contents[0] == base, false)
+
+	fmt.Println("Remove integers, keeping the encoding and the capacity.")
+	is = intsetNew()
+	for _, v := range []int64{-2, 7, 40000, 9} {
+		is.Add(v)
+	}
+	capacity := cap(is.contents)
+	assertEqual(t, is.Remove(9), true)
+	assertEqual(t, is.Remove(9), false)
+	assertEqual(t, is.Remove(1<<40), false)
+	assertEqual(t, is.Remove(-2), true)
+	assertEqual(t, members(), []int64{7, 40000})
+	assertEqual(t, is.Remove(40000), true)
+	assertEqual(t, is.Remove(7), true)
+	assertEqual(t, is.Len(), 0)
+	assertEqual(t, is.encoding, INTSET_ENC_INT32)
+	assertEqual(t, cap(is.contents), capacity)
+
+	fmt.Println("Convert to a dict past set-max-intset-entries or for other members.")
+	c := newTestClient(1)
+	c.s.cfg.SetMaxIntsetEntries = 3
+	assertEqual(t, runCommand(c, "SADD", "s", "3", "-1", "2"), ":3\r\n")
+	assertEqual(t, runCommand(c, "OBJECT", "ENCODING", "s"), "$6\r\nintset\r\n")
+	assertEqual(t, runCommand(c, "SADD", "s", "4"), ":1\r\n")
+	assertEqual(t, runCommand(c, "OBJECT", "ENCODING", "s"), "$9\r\nhashtable\r\n")
+	assertEqual(t, runCommand(c, "SCARD", "s"), ":4\r\n")
+	assertEqual(t, runCommand(c, "SISMEMBER", "s", "-1"), ":1\r\n")
+	runCommand(c, "SADD", "t", "1")
+	assertEqual(t, runCommand(c, "SADD", "t", "a", "2"), ":2\r\n")
+	assertEqual(t, runCommand(c, "OBJECT", "ENCODING", "t"), "$9\r\nhashtable\r\n")
+	assertEqual(t, runCommand(c, "SREM", "t", "1", "a"), ":2\r\n")
+	assertEqual(t, runCommand(c, "SISMEMBER", "t", "2"), ":1\r\n")
+}
@@ -0,0 +1,220 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// memoryDefaultSamples is the number of elements of an aggregate value
+// MEMORY USAGE estimates the others from.
+const memoryDefaultSamples = 5
+
+// memoryStatsSamples is the number of keys of each db MEMORY STATS estimates
+// the dataset from when maxmemory is off.
+const memoryStatsSamples = 64
+
+// memoryStats is the memory of the pool as reported by MEMORY STATS. The
+// overhead is the memory of the dicts that does not hold a key: their bucket
+// arrays, and the entries of the expire dicts.
+type memoryStats struct {
+	poolSize, poolAllocated int64
+	dbs                     []dbMemoryStats
+	overhead                int64
+	keys                    int64
+	dataset                 int64 // bytes of the keys and their values
+}
+
+type dbMemoryStats struct {
+	id            int
+	main, expires int64 // overhead of the keyspace and expire dicts
+}
+
+// MEMORY USAGE key [SAMPLES count] | STATS | DOCTOR | HELP
+func memoryCommand(c *client) {
+	sub := c.argv[1]
+	if bytes.EqualFold(sub, []byte("help")) && c.argc == 2 {
+		help := []string{
+			"DOCTOR -- Return memory problems reports.",
+			"STATS -- Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>] -- Return memory in bytes used by <key> and its value. " +
+				"Nested values are sampled up to <count> times (default: 5, 0 means sample all)."}
+		c.addReplyMultiBulkLen(len(help))
+		for _, h := range help {
+			c.addReplyStatus(h)
+		}
+	} else if bytes.EqualFold(sub, []byte("usage")) && c.argc >= 3 {
+		samples := memoryDefaultSamples
+		for j := 3; j < c.argc; j++ {
+			if bytes.EqualFold(c.argv[j], []byte("samples")) && j+1 < c.argc {
+				n, ok := c.getLongLongOrReply(c.argv[j+1], nil)
+				if !ok {
+					return
+				}
+				if n < 0 {
+					c.addReply(shared.syntaxerr)
+					return
+				}
+				samples = int(n)
+				j++
+			} else {
+				c.addReply(shared.syntaxerr)
+				return
+			}
+		}
+		if !c.lockKeyRead(c.argv[2]) {
+			c.addReplyNull()
+			return
+		}
+		// find instead of lookupKey, so the access clock is not updated.
+		_, _, _, e := c.db.dict.find(c.argv[2])
+		if e == nil {
+			c.addReplyNull()
+			return
+		}
+		c.addReplyLongLong(objectUsage(e.key, e.value, samples))
+	} else if bytes.EqualFold(sub, []byte("stats")) && c.argc == 2 {
+		c.addReplyMemoryStats(c.s.memoryStats(c.batch))
+	} else if bytes.EqualFold(sub, []byte("doctor")) && c.argc == 2 {
+		c.addReplyBulk([]byte(c.s.memoryStats(c.batch).doctor(c.s.cfg.PoolSize)))
+	} else {
+		c.addReplyError([]byte(fmt.Sprintf(
+			"Unknown subcommand or wrong number of arguments for '%s'. Try MEMORY HELP.", sub)))
+	}
+}
+
+// MEMORY USAGE is the only subcommand with a key.
+func memoryGetKeys(argv [][]byte) []int {
+	if len(argv) >= 3 && bytes.EqualFold(argv[1], []byte("usage")) {
+		return []int{2}
+	}
+	return nil
+}
+
+// memoryStats measures the memory of the pool. The dict overhead is computed
+// from the sizes and shard counters read by dict.stats, no key is locked.
+// Unless maxmemory keeps the estimate of every key up to date, the dataset is
+// extrapolated from memoryStatsSamples keys of each db. locked reports that
+// the caller holds the tables of every db, as EXEC does.
+func (s *Server) memoryStats(locked bool) *memoryStats {
+	ms := &memoryStats{}
+	ms.poolAllocated, ms.poolSize = poolUsage(s.cfg.PoolPath)
+	if s.cfg.MaxMemory > 0 {
+		ms.dataset = atomic.LoadInt64(&s.stats.usedMemory)
+	}
+	for id, db := range s.dbs {
+		main, expires := db.dict.stats(locked), db.expire.stats(locked)
+		keys := int64(main.entries())
+		dm := dbMemoryStats{
+			id:      id,
+			main:    main.tableBytes(),
+			expires: expires.tableBytes() + int64(expires.entries())*expireEntryUsage}
+		ms.dbs = append(ms.dbs, dm)
+		ms.overhead += dm.main + dm.expires
+		ms.keys += keys
+		if s.cfg.MaxMemory == 0 && keys > 0 {
+			var sum int64
+			sampled := db.dict.sample(memoryStatsSamples, locked, func(e *entry) {
+				sum += objectUsage(e.key, e.value, memoryDefaultSamples)
+			})
+			if sampled > 0 {
+				ms.dataset += sum * keys / int64(sampled)
+			}
+		}
+	}
+	return ms
+}
+
+// fragmentation returns the bytes allocated to the pool file for each byte of
+// the dicts and keys. The pmem heap reuses freed memory, but never gives it
+// back to the file system.
+func (ms *memoryStats) fragmentation() float64 {
+	if ms.overhead+ms.dataset == 0 {
+		return 0
+	}
+	return float64(ms.poolAllocated) / float64(ms.overhead+ms.dataset)
+}
+
+func (c *client) addReplyMemoryStats(ms *memoryStats) {
+	c.addReplyMapLen(9 + len(ms.dbs))
+	c.addReplyBulk([]byte("pool.size"))
+	c.addReplyLongLong(ms.poolSize)
+	c.addReplyBulk([]byte("pool.allocated"))
+	c.addReplyLongLong(ms.poolAllocated)
+	for _, dm := range ms.dbs {
+		c.addReplyBulk([]byte(fmt.Sprintf("db.%d", dm.id)))
+		c.addReplyMapLen(2)
+		c.addReplyBulk([]byte("overhead.hashtable.main"))
+		c.addReplyLongLong(dm.main)
+		c.addReplyBulk([]byte("overhead.hashtable.expires"))
+		c.addReplyLongLong(dm.expires)
+	}
+	c.addReplyBulk([]byte("overhead.total"))
+	c.addReplyLongLong(ms.overhead)
+	c.addReplyBulk([]byte("keys.count"))
+	c.addReplyLongLong(ms.keys)
+	c.addReplyBulk([]byte("keys.bytes-per-key"))
+	if ms.keys > 0 {
+		c.addReplyLongLong((ms.overhead + ms.dataset) / ms.keys)
+	} else {
+		c.addReplyLongLong(0)
+	}
+	c.addReplyBulk([]byte("dataset.bytes"))
+	c.addReplyLongLong(ms.dataset)
+	c.addReplyBulk([]byte("dataset.percentage"))
+	if ms.overhead+ms.dataset > 0 {
+		c.addReplyDouble(float64(ms.dataset) * 100 / float64(ms.overhead+ms.dataset))
+	} else {
+		c.addReplyDouble(0)
+	}
+	c.addReplyBulk([]byte("fragmentation"))
+	c.addReplyDouble(ms.fragmentation())
+	c.addReplyBulk([]byte("fragmentation.bytes"))
+	c.addReplyLongLong(ms.poolAllocated - ms.overhead - ms.dataset)
+}
+
+// doctor reports the memory issues found in ms like MEMORY DOCTOR in redis.
+// poolSize is the configured pool-size, 0 if the pool grows on demand.
+func (ms *memoryStats) doctor(poolSize int64) string {
+	if ms.keys == 0 && ms.poolAllocated < 5*1024*1024 {
+		return "Hi Sam, this instance is empty or is using very little memory, " +
+			"my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I finished rebooting."
+	}
+	var b bytes.Buffer
+	issue := func(format string, a ...interface{}) {
+		if b.Len() == 0 {
+			b.WriteString("Sam, I detected a few issues in this Redis instance memory implants:\n\n")
+		}
+		fmt.Fprintf(&b, " * "+format+"\n\n", a...)
+	}
+	if frag := ms.fragmentation(); frag > 1.4 {
+		issue("High pool fragmentation: %s are allocated to the pool file, %.2f times the memory "+
+			"of the dicts and keys. The pmem heap reuses freed memory, but never gives it back "+
+			"to the file system, the pool keeps the size of its peak usage.",
+			bytesToHuman(ms.poolAllocated), frag)
+	}
+	if ms.overhead > ms.dataset {
+		issue("High dict overhead: the bucket arrays of the dicts use %s, more than the %s of "+
+			"the keys. The dicts do not shrink below dict-init-size and expire-dict-init-size, "+
+			"which may be too large for this dataset.",
+			bytesToHuman(ms.overhead), bytesToHuman(ms.dataset))
+	}
+	if poolSize > 0 && ms.poolAllocated > poolSize*9/10 {
+		issue("Pool almost full: %s of the %s pool are allocated. Set maxmemory with an eviction "+
+			"policy below the pool size, or delete keys before allocations start failing.",
+			bytesToHuman(ms.poolAllocated), bytesToHuman(poolSize))
+	}
+	if b.Len() == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base."
+	}
+	b.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	return b.String()
+}
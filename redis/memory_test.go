@@ -0,0 +1,88 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestMemory(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	memory := func(args ...string) string {
+		c.wBuffer.Reset()
+		c.argv = argv(append([]string{"MEMORY"}, args...)...)
+		c.argc = len(c.argv)
+		memoryCommand(c)
+		return c.wBuffer.String()
+	}
+
+	fmt.Println("Estimate lists from samples of their nodes.")
+	node := func(size int) *quicklistNode {
+		return &quicklistNode{zl: &ziplist{data: make([]byte, size)}}
+	}
+	ql := &quicklist{head: node(100), length: 3}
+	ql.head.next = node(100)
+	ql.head.next.next = node(400)
+	nodeSize := int64(unsafe.Sizeof(quicklistNode{}) + unsafe.Sizeof(ziplist{}))
+	base := int64(unsafe.Sizeof(quicklist{}))
+	assertEqual(t, quicklistUsage(ql, 0), base+3*nodeSize+600)
+	assertEqual(t, quicklistUsage(ql, 2), base+3*nodeSize+300)
+	assertEqual(t, quicklistUsage(&quicklist{}, 5), base)
+
+	fmt.Println("Check the arguments of MEMORY USAGE before the key.")
+	assertEqual(t, memory("USAGE", "k", "SAMPLES"), "-ERR syntax error\r\n")
+	assertEqual(t, memory("USAGE", "k", "SAMPLES", "-1"), "-ERR syntax error\r\n")
+	assertEqual(t, memory("USAGE", "k", "SAMPLES", "x"),
+		"-ERR value is not an integer or out of range\r\n")
+	assertEqual(t, strings.HasPrefix(memory("NOSUCH"), "-ERR Unknown subcommand"), true)
+	assertEqual(t, memoryGetKeys(argv("MEMORY", "USAGE", "k", "SAMPLES", "0")), []int{2})
+	assertEqual(t, len(memoryGetKeys(argv("MEMORY", "STATS"))), 0)
+
+	fmt.Println("Reply the stats as a map.")
+	ms := &memoryStats{poolSize: 1 << 30, poolAllocated: 3000, overhead: 1000, keys: 10, dataset: 1000,
+		dbs: []dbMemoryStats{{id: 0, main: 800, expires: 200}}}
+	c.wBuffer.Reset()
+	c.addReplyMemoryStats(ms)
+	reply := c.wBuffer.String()
+	assertEqual(t, strings.HasPrefix(reply, "*20\r\n$9\r\npool.size\r\n:1073741824\r\n"), true)
+	assertEqual(t, strings.Contains(reply, "$4\r\ndb.0\r\n*4\r\n$23\r\noverhead.hashtable.main\r\n:800\r\n"), true)
+	assertEqual(t, strings.Contains(reply, "$18\r\nkeys.bytes-per-key\r\n:200\r\n"), true)
+	assertEqual(t, strings.HasSuffix(reply, "$13\r\nfragmentation\r\n$3\r\n1.5\r\n$19\r\nfragmentation.bytes\r\n:1000\r\n"), true)
+
+	fmt.Println("Report fragmentation and dict overhead.")
+	doctor := ms.doctor(0)
+	assertEqual(t, strings.Contains(doctor, "High pool fragmentation"), true)
+	assertEqual(t, strings.Contains(doctor, "High dict overhead"), false)
+	ms.overhead, ms.poolAllocated = 5000, 6000
+	doctor = ms.doctor(6500)
+	assertEqual(t, strings.Contains(doctor, "High pool fragmentation"), false)
+	assertEqual(t, strings.Contains(doctor, "High dict overhead"), true)
+	assertEqual(t, strings.Contains(doctor, "Pool almost full"), true)
+	ms.overhead, ms.poolAllocated = 10, 1200
+	assertEqual(t, strings.HasPrefix(ms.doctor(0), "Hi Sam, I can't find any memory issue"), true)
+	assertEqual(t, strings.HasPrefix((&memoryStats{}).doctor(0), "Hi Sam, this instance is empty"), true)
+
+	fmt.Println("Estimate the dataset from a sample of keys without locking them.")
+	c = newTestClient(2)
+	for i := 0; i < 500; i++ {
+		runCommand(c, "SET", fmt.Sprintf("k%03d", i), "0123456789")
+	}
+	runCommand(c, "EXPIRE", "k000", "100")
+	_, _, _, e := c.db.dict.find([]byte("k000"))
+	ms = c.s.memoryStats(false)
+	assertEqual(t, ms.keys, int64(500))
+	assertEqual(t, ms.dataset, 500*objectUsage(e.key, e.value, memoryDefaultSamples))
+	assertEqual(t, ms.dbs[0].main, c.db.dict.tableBytes())
+	assertEqual(t, ms.dbs[1].expires, c.s.dbs[1].expire.tableBytes())
+	runCommand(c, "MULTI")
+	runCommand(c, "MEMORY", "STATS")
+	reply = runCommand(c, "EXEC")
+	assertEqual(t, strings.Contains(reply, "$10\r\nkeys.count\r\n:500\r\n"), true)
+}
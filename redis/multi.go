@@ -0,0 +1,209 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+)
+
+// MULTI/EXEC runs the queued commands in the undo transaction of EXEC, so
+// after a crash either the whole batch is persisted or none of it. The locks
+// of every key touched by the batch are taken before the first command runs.
+//
+// WATCH records the modification version of each key, see dict.keyVersion.
+// EXEC takes the locks of the watched keys along with the queued ones and
+// aborts if any version changed since, or if the db was flushed or swapped.
+
+type (
+	multiCmd struct {
+		cmd  *redisCommand
+		argv [][]byte
+	}
+
+	watchedKey struct {
+		dbid    int
+		db      *redisDb
+		key     []byte
+		version uint64 // 0 if the key did not exist
+		since   uint64 // last version handed out when WATCH ran
+	}
+)
+
+// Commands that control the transaction itself run immediately inside MULTI.
+func (cmd *redisCommand) queueable() bool {
+	switch cmd.name {
+	case "MULTI", "EXEC", "DISCARD", "WATCH":
+		return false
+	}
+	return true
+}
+
+func (c *client) queueMultiCommand() {
+	// argv is reused by the next query, the arguments themselves are not.
+	argv := make([][]byte, c.argc)
+	copy(argv, c.argv)
+	c.mstate = append(c.mstate, multiCmd{c.cmd, argv})
+	c.addReply(shared.queued)
+}
+
+// flagTransaction makes EXEC fail after a command could not be queued.
+func (c *client) flagTransaction() {
+	if c.multi {
+		c.dirtyExec = true
+	}
+}
+
+func (c *client) discardTransaction() {
+	c.multi = false
+	c.dirtyExec = false
+	c.mstate = nil
+	c.unwatchAllKeys()
+}
+
+func multiCommand(c *client) {
+	if c.multi {
+		c.addReplyError([]byte("MULTI calls can not be nested"))
+		return
+	}
+	c.multi = true
+	c.addReply(shared.ok)
+}
+
+func discardCommand(c *client) {
+	if !c.multi {
+		c.addReplyError([]byte("DISCARD without MULTI"))
+		return
+	}
+	c.discardTransaction()
+	c.addReply(shared.ok)
+}
+
+func execCommand(c *client) {
+	if !c.multi {
+		c.addReplyError([]byte("EXEC without MULTI"))
+		return
+	}
+	if c.dirtyExec {
+		c.addReply(shared.execaborterr)
+		c.discardTransaction()
+		return
+	}
+
+	cmd, argv, argc := c.cmd, c.argv, c.argc
+	mstate := c.mstate
+	defer func() {
+		// also runs when a queued command panics and EXEC is rolled back.
+		c.batch = false
+		c.cmd, c.argv, c.argc = cmd, argv, argc
+		c.discardTransaction()
+	}()
+
+	c.lockBatch(mstate)
+	c.batch = true
+	if c.watchedKeysModified() {
+		c.addReplyNullArray()
+		return
+	}
+	c.addReplyMultiBulkLen(len(mstate))
+	for _, mc := range mstate {
+		c.cmd, c.argv, c.argc = mc.cmd, mc.argv, len(mc.argv)
+		c.cmd.proc(c)
+	}
+}
+
+// lockBatch write locks every key the queued commands may touch and every
+// watched key, in one go so that the db locking order holds. Keys are taken
+// from the db selected at that point of the queue. Commands that may touch
+// any key lock the whole tables of their db instead, and commands that may
+// touch other dbs those of every db.
+func (c *client) lockBatch(mstate []multiCmd) {
+	keys := make([][][]byte, len(c.s.dbs))
+	tables := make([]bool, len(c.s.dbs))
+	for _, wk := range c.watched {
+		keys[wk.dbid] = append(keys[wk.dbid], wk.key)
+	}
+	dbid := c.dbid
+	for _, mc := range mstate {
+		if mc.cmd.flag&CMD_ALLDBS != 0 {
+			for i := range tables {
+				tables[i] = true
+			}
+		} else if mc.cmd.flag&CMD_ALLKEYS != 0 {
+			tables[dbid] = true
+		} else if mc.cmd.name == "SELECT" {
+			if id, err := strconv.Atoi(string(mc.argv[1])); err == nil && id >= 0 && id < len(c.s.dbs) {
+				dbid = id
+			}
+		}
+		for _, k := range getKeysFromCommand(mc.cmd, mc.argv) {
+			keys[dbid] = append(keys[dbid], mc.argv[k])
+		}
+	}
+	// dbs are locked in ascending index order.
+	for id, db := range c.s.dbs {
+		if tables[id] {
+			db.lockTablesWrite()
+		} else if len(keys[id]) > 0 {
+			c.notifyExpired(db, db.lockKeysWrite(keys[id], 1)...)
+		}
+	}
+}
+
+// WATCH key [key ...]
+func watchCommand(c *client) {
+	if c.multi {
+		c.addReplyError([]byte("WATCH inside MULTI is not allowed"))
+		return
+	}
+	alive := c.lockKeysRead(c.argv[1:], 1)
+	for i, key := range c.argv[1:] {
+		c.watchKey(key, alive[i])
+	}
+	c.addReply(shared.ok)
+}
+
+func unwatchCommand(c *client) {
+	c.unwatchAllKeys()
+	c.addReply(shared.ok)
+}
+
+// watchKey records the current version of key. A key that already expired
+// is watched as missing, so that its removal does not abort EXEC.
+func (c *client) watchKey(key []byte, alive bool) {
+	for _, wk := range c.watched {
+		if wk.db == c.db && bytes.Equal(wk.key, key) {
+			return
+		}
+	}
+	wk := watchedKey{dbid: c.dbid, db: c.db, key: key, since: atomic.LoadUint64(&lastVersion)}
+	if alive {
+		wk.version = c.db.keyVersion(key)
+	}
+	c.watched = append(c.watched, wk)
+}
+
+func (c *client) unwatchAllKeys() {
+	c.watched = nil
+}
+
+// watchedKeysModified reports whether a watched key was changed, expired,
+// flushed or swapped to another db since WATCH. The caller must hold the
+// write locks of the keys.
+func (c *client) watchedKeysModified() bool {
+	for _, wk := range c.watched {
+		if c.s.dbs[wk.dbid] != wk.db {
+			return true
+		}
+		c.expireIfNeeded(wk.db, wk.key)
+		if wk.db.keyVersion(wk.key) != wk.version ||
+			wk.db.dict.emptyVersion > wk.since {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMultiQueue(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	c.s.populateCommandTable()
+	reply := func() string {
+		s := c.wBuffer.String()
+		c.wBuffer.Reset()
+		return s
+	}
+	query := func(args ...string) {
+		c.argv = argv(args...)
+		c.argc = len(c.argv)
+		c.processCommand()
+	}
+
+	fmt.Println("Queue commands after MULTI.")
+	c.argv = argv("MULTI")
+	c.argc = 1
+	multiCommand(c)
+	assertEqual(t, reply(), "+OK\r\n")
+	multiCommand(c)
+	assertEqual(t, reply(), "-ERR MULTI calls can not be nested\r\n")
+	query("PING")
+	query("PING")
+	assertEqual(t, reply(), "+QUEUED\r\n+QUEUED\r\n")
+	assertEqual(t, len(c.mstate), 2)
+	assertEqual(t, c.mstate[1].argv, argv("PING"))
+
+	fmt.Println("Run the queue on EXEC.")
+	c.argv = argv("EXEC")
+	c.argc = 1
+	execCommand(c)
+	assertEqual(t, reply(), "*2\r\n+PONG\r\n+PONG\r\n")
+	assertEqual(t, c.multi, false)
+	assertEqual(t, c.argv, argv("EXEC"))
+	execCommand(c)
+	assertEqual(t, reply(), "-ERR EXEC without MULTI\r\n")
+
+	fmt.Println("Abort EXEC after a command failed to queue.")
+	multiCommand(c)
+	query("NOSUCHCMD")
+	query("PING")
+	reply()
+	execCommand(c)
+	assertEqual(t, reply(), "-EXECABORT Transaction discarded because of previous errors.\r\n")
+	assertEqual(t, len(c.mstate), 0)
+
+	fmt.Println("Drop the queue on DISCARD.")
+	multiCommand(c)
+	query("PING")
+	discardCommand(c)
+	assertEqual(t, reply(), "+OK\r\n+QUEUED\r\n+OK\r\n")
+	assertEqual(t, c.multi, false)
+	discardCommand(c)
+	assertEqual(t, reply(), "-ERR DISCARD without MULTI\r\n")
+}
+
+func TestWatchState(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	c.s.populateCommandTable()
+	reply := func() string {
+		s := c.wBuffer.String()
+		c.wBuffer.Reset()
+		return s
+	}
+
+	fmt.Println("Reject WATCH inside MULTI without aborting EXEC.")
+	multiCommand(c)
+	c.argv = argv("WATCH", "a")
+	c.argc = 2
+	c.lookupCommand()
+	assertEqual(t, c.cmd.queueable(), false)
+	watchCommand(c)
+	assertEqual(t, reply(), "+OK\r\n-ERR WATCH inside MULTI is not allowed\r\n")
+	assertEqual(t, c.dirtyExec, false)
+	assertEqual(t, len(c.watched), 0)
+	discardCommand(c)
+	reply()
+
+	fmt.Println("Forget watched keys on UNWATCH and DISCARD.")
+	c.watched = []watchedKey{{key: []byte("a"), version: 1}}
+	unwatchCommand(c)
+	assertEqual(t, reply(), "+OK\r\n")
+	assertEqual(t, len(c.watched), 0)
+	c.watched = []watchedKey{{key: []byte("a"), version: 1}}
+	multiCommand(c)
+	discardCommand(c)
+	assertEqual(t, len(c.watched), 0)
+
+	fmt.Println("Reply a null array to an aborted EXEC.")
+	reply()
+	c.addReplyNullArray()
+	assertEqual(t, reply(), "*-1\r\n")
+	c.resp = 3
+	c.addReplyNullArray()
+	assertEqual(t, reply(), "_\r\n")
+}
+
+func TestWatchExec(t *testing.T) {
+	c := newTestClient(2)
+	other := c.s.newClient(nil)
+	exec := func(args ...string) string {
+		runCommand(c, "MULTI")
+		runCommand(c, args...)
+		return runCommand(c, "EXEC")
+	}
+
+	fmt.Println("Abort EXEC after another client modified a watched key.")
+	runCommand(c, "SET", "k", "v1")
+	runCommand(c, "WATCH", "k")
+	runCommand(other, "SET", "k", "v2")
+	assertEqual(t, exec("SET", "k", "v3"), "*-1\r\n")
+	assertEqual(t, runCommand(other, "GET", "k"), "$2\r\nv2\r\n")
+
+	fmt.Println("Run EXEC if the watched key did not change.")
+	runCommand(c, "WATCH", "k")
+	runCommand(other, "SET", "other", "v")
+	assertEqual(t, exec("SET", "k", "v3"), "*1\r\n+OK\r\n")
+	assertEqual(t, len(c.watched), 0)
+
+	fmt.Println("Abort EXEC after the db of a watched key was flushed.")
+	runCommand(c, "WATCH", "missing")
+	runCommand(other, "FLUSHDB")
+	assertEqual(t, exec("SET", "k", "v4"), "*-1\r\n")
+
+	fmt.Println("Hand out versions that are unique across dicts.")
+	runCommand(c, "SET", "k", "v")
+	runCommand(other, "SELECT", "1")
+	runCommand(other, "SET", "k", "v")
+	v0, v1 := c.s.dbs[0].keyVersion([]byte("k")), c.s.dbs[1].keyVersion([]byte("k"))
+	assertEqual(t, v0 != 0 && v1 > v0, true)
+}
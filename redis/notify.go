@@ -0,0 +1,168 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// Classes of keyspace events, selected by the notify-keyspace-events
+// directive with the same characters as in redis.
+const (
+	NOTIFY_KEYSPACE int = 1 << 0  // K
+	NOTIFY_KEYEVENT int = 1 << 1  // E
+	NOTIFY_GENERIC  int = 1 << 2  // g
+	NOTIFY_STRING   int = 1 << 3  // $
+	NOTIFY_LIST     int = 1 << 4  // l
+	NOTIFY_SET      int = 1 << 5  // s
+	NOTIFY_HASH     int = 1 << 6  // h
+	NOTIFY_ZSET     int = 1 << 7  // z
+	NOTIFY_EXPIRED  int = 1 << 8  // x
+	NOTIFY_EVICTED  int = 1 << 9  // e
+	NOTIFY_STREAM   int = 1 << 10 // t
+	NOTIFY_KEY_MISS int = 1 << 11 // m, not included in A
+	NOTIFY_ALL      int = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET |
+		NOTIFY_HASH | NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM // A
+)
+
+// keyspaceEventsStringToFlags parses the value of notify-keyspace-events.
+func keyspaceEventsStringToFlags(classes string) (int, error) {
+	flags := 0
+	for _, c := range classes {
+		switch c {
+		case 'A':
+			flags |= NOTIFY_ALL
+		case 'g':
+			flags |= NOTIFY_GENERIC
+		case '$':
+			flags |= NOTIFY_STRING
+		case 'l':
+			flags |= NOTIFY_LIST
+		case 's':
+			flags |= NOTIFY_SET
+		case 'h':
+			flags |= NOTIFY_HASH
+		case 'z':
+			flags |= NOTIFY_ZSET
+		case 'x':
+			flags |= NOTIFY_EXPIRED
+		case 'e':
+			flags |= NOTIFY_EVICTED
+		case 'K':
+			flags |= NOTIFY_KEYSPACE
+		case 'E':
+			flags |= NOTIFY_KEYEVENT
+		case 't':
+			flags |= NOTIFY_STREAM
+		case 'm':
+			flags |= NOTIFY_KEY_MISS
+		default:
+			return 0, errors.New("invalid event class character")
+		}
+	}
+	return flags, nil
+}
+
+// keyspaceEventsFlagsToString is the inverse of keyspaceEventsStringToFlags,
+// it uses A when all the classes it covers are set.
+func keyspaceEventsFlagsToString(flags int) string {
+	var b []byte
+	if flags&NOTIFY_ALL == NOTIFY_ALL {
+		b = append(b, 'A')
+	} else {
+		for _, class := range []struct {
+			flag int
+			c    byte
+		}{
+			{NOTIFY_GENERIC, 'g'}, {NOTIFY_STRING, '$'}, {NOTIFY_LIST, 'l'}, {NOTIFY_SET, 's'},
+			{NOTIFY_HASH, 'h'}, {NOTIFY_ZSET, 'z'}, {NOTIFY_EXPIRED, 'x'}, {NOTIFY_EVICTED, 'e'},
+			{NOTIFY_STREAM, 't'},
+		} {
+			if flags&class.flag != 0 {
+				b = append(b, class.c)
+			}
+		}
+	}
+	if flags&NOTIFY_KEYSPACE != 0 {
+		b = append(b, 'K')
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		b = append(b, 'E')
+	}
+	if flags&NOTIFY_KEY_MISS != 0 {
+		b = append(b, 'm')
+	}
+	return string(b)
+}
+
+// notifyKeyspaceEvent publishes event on key to __keyspace@<dbid>__:<key>
+// and the key to __keyevent@<dbid>__:<event>, as far as the configuration
+// asks for the class of the event.
+func (s *Server) notifyKeyspaceEvent(class int, event string, key []byte, dbid int) {
+	flags := s.cfg.NotifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+	prefix := "@" + strconv.Itoa(dbid) + "__:"
+	if flags&NOTIFY_KEYSPACE != 0 {
+		channel := append([]byte("__keyspace"+prefix), key...)
+		s.publish(channel, []byte(event))
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		channel := []byte("__keyevent" + prefix + event)
+		s.publish(channel, key)
+	}
+}
+
+// notifyKeyspaceEvent reports event through the hook installed by the server
+// at startup. It publishes right away, so background jobs call it once the
+// transaction that caused the event has committed.
+func (db *redisDb) notifyKeyspaceEvent(class int, event string, key []byte) {
+	if db.notify != nil {
+		db.notify(class, event, key)
+	}
+}
+
+// keyspaceEvent is an event of a command waiting for its transaction to
+// commit.
+type keyspaceEvent struct {
+	dbid  int
+	class int
+	event string
+	key   []byte
+}
+
+// notifyKeyspaceEvent records event on key in the selected db. Like the keys
+// signaled as ready, the events of a command are published by call once its
+// transaction has committed, so subscribers never see a change that is rolled
+// back and publishing never happens under key locks.
+func (c *client) notifyKeyspaceEvent(class int, event string, key []byte) {
+	c.notifyDbKeyspaceEvent(c.dbid, class, event, key)
+}
+
+func (c *client) notifyDbKeyspaceEvent(dbid, class int, event string, key []byte) {
+	if c.s.cfg.NotifyKeyspaceEvents&class != 0 {
+		c.events = append(c.events, keyspaceEvent{dbid, class, event, key})
+	}
+}
+
+// notifyExpired records the expired event of keys that db deleted when they
+// were accessed.
+func (c *client) notifyExpired(db *redisDb, keys ...[]byte) {
+	for _, key := range keys {
+		c.notifyDbKeyspaceEvent(int(atomic.LoadInt32(&db.id)), NOTIFY_EXPIRED, "expired", key)
+	}
+}
+
+// publishEvents publishes the recorded events of c.
+func (c *client) publishEvents() {
+	for _, e := range c.events {
+		c.s.notifyKeyspaceEvent(e.class, e.event, e.key, e.dbid)
+	}
+	c.events = nil
+}
@@ -6,9 +6,12 @@
 package redis
 
 import (
+	"bytes"
+	"fmt"
 	"math"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -56,8 +59,287 @@ func (vb *vbytes) Persist() Persistent {
 	return pb
 }
 
+// typeName returns the type of the value as reported by TYPE. Hashes and sets
+// are both dicts, but only the fields of a hash have values. Lists hold their
+// ziplists in a quicklist, so a ziplist value is always a hash.
+func typeName(i interface{}) string {
+	switch v := i.(type) {
+	case []byte, *[]byte, int64, float64:
+		return "string"
+	case *quicklist:
+		return "list"
+	case *zset:
+		return "zset"
+	case *ziplist:
+		return "hash"
+	case *intset:
+		return "set"
+	case *dict:
+		if e := v.getIterator().next(); e != nil && e.value == nil {
+			return "set"
+		}
+		return "hash"
+	case nil:
+		return "none"
+	default:
+		return "unknown"
+	}
+}
+
+// OBJECT_ENCSTR_SIZE_LIMIT is the longest string reported as embstr, like in
+// redis where shorter strings are allocated along with their object header.
+const OBJECT_ENCSTR_SIZE_LIMIT = 44
+
+// encodingName returns the encoding of the value as reported by OBJECT
+// ENCODING.
+func encodingName(i interface{}) string {
+	switch v := i.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "embstr"
+	case []byte:
+		if len(v) <= OBJECT_ENCSTR_SIZE_LIMIT {
+			return "embstr"
+		}
+		return "raw"
+	case *[]byte:
+		if len(*v) <= OBJECT_ENCSTR_SIZE_LIMIT {
+			return "embstr"
+		}
+		return "raw"
+	case *quicklist:
+		return "quicklist"
+	case *zset:
+		return "skiplist"
+	case *ziplist:
+		return "ziplist"
+	case *intset:
+		return "intset"
+	case *dict:
+		return "hashtable"
+	default:
+		return "unknown"
+	}
+}
+
+// OBJECT <subcommand> key
+// Values are never shared between keys, so the refcount is always 1. The lru
+// field of an entry holds either the access clock or the LFU counter, IDLETIME
+// and FREQ are only available under the matching maxmemory-policy.
+func objectCommand(c *client) {
+	sub := c.argv[1]
+	if bytes.EqualFold(sub, []byte("help")) && c.argc == 2 {
+		help := []string{
+			"ENCODING <key> -- Return the kind of internal representation used in order to store the value associated with a key.",
+			"FREQ <key> -- Return the access frequency index of the key. The returned integer is proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key> -- Return the idle time of the key, that is the approximated number of seconds elapsed since the last access to the key.",
+			"REFCOUNT <key> -- Return the number of references of the value associated with the specified key."}
+		c.addReplyMultiBulkLen(len(help))
+		for _, h := range help {
+			c.addReplyStatus(h)
+		}
+		return
+	}
+	if c.argc != 3 {
+		c.addReplyError([]byte(fmt.Sprintf(
+			"Unknown subcommand or wrong number of arguments for '%s'. Try OBJECT HELP.", sub)))
+		return
+	}
+	var reply func(e *entry)
+	switch {
+	case bytes.EqualFold(sub, []byte("encoding")):
+		reply = func(e *entry) {
+			c.addReplyBulk([]byte(encodingName(e.value)))
+		}
+	case bytes.EqualFold(sub, []byte("refcount")):
+		reply = func(e *entry) {
+			c.addReplyLongLong(1)
+		}
+	case bytes.EqualFold(sub, []byte("idletime")):
+		reply = func(e *entry) {
+			if isLFUPolicy(c.s.cfg.MaxMemoryPolicy) {
+				c.addReplyError([]byte("An LFU maxmemory policy is selected, idle time not tracked. " +
+					"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."))
+			} else {
+				c.addReplyLongLong(int64(lruClock() - atomic.LoadUint32(&c.db.meta(e).lru)))
+			}
+		}
+	case bytes.EqualFold(sub, []byte("freq")):
+		reply = func(e *entry) {
+			if !isLFUPolicy(c.s.cfg.MaxMemoryPolicy) {
+				c.addReplyError([]byte("An LFU maxmemory policy is not selected, access frequency not tracked. " +
+					"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."))
+			} else {
+				c.addReplyLongLong(int64(lfuDecrAndReturn(atomic.LoadUint32(&c.db.meta(e).lru))))
+			}
+		}
+	default:
+		c.addReplyError([]byte(fmt.Sprintf(
+			"Unknown subcommand or wrong number of arguments for '%s'. Try OBJECT HELP.", sub)))
+		return
+	}
+	// find instead of lookupKey, so the access clock is not updated.
+	var e *entry
+	if c.lockKeyRead(c.argv[2]) {
+		_, _, _, e = c.db.dict.find(c.argv[2])
+	}
+	if e == nil {
+		c.addReplyNull()
+	} else {
+		reply(e)
+	}
+}
+
 /////////////////////////////////////////
 
+// dupObject returns a deep copy of a value in new pmem objects, for COPY.
+func dupObject(i interface{}) interface{} {
+	switch i.(type) {
+	case *quicklist:
+		return listTypeDup(i)
+	case *zset:
+		return zsetDup(i)
+	case *ziplist:
+		return hashTypeDup(i)
+	case *intset:
+		return setTypeDup(i)
+	case *dict:
+		if typeName(i) == "set" {
+			return setTypeDup(i)
+		}
+		return hashTypeDup(i)
+	default:
+		return dupStringValue(i)
+	}
+}
+
+// dupStringValue copies a string value. Numbers are stored inline in the
+// interface and are shared.
+func dupStringValue(i interface{}) interface{} {
+	switch v := i.(type) {
+	case []byte:
+		return shadowCopyToPmem(v)
+	case *[]byte:
+		return shadowCopyToPmemI(*v)
+	default:
+		return v
+	}
+}
+
+// expireEntryUsage is the pmem bytes of an entry of an expire dict, whose key
+// is shared with the main dict.
+const expireEntryUsage = int64(unsafe.Sizeof(entry{})) + 8
+
+// objectUsage estimates the pmem bytes used by a key and its value, including
+// the dict entry holding them. Like objectComputeSize in redis, the elements
+// of an aggregate value are estimated from the first samples of them, or from
+// all of them if samples is 0.
+func objectUsage(key []byte, value interface{}, samples int) int64 {
+	return int64(unsafe.Sizeof(entry{})) + int64(len(key)) + valueUsage(value, samples)
+}
+
+// valueLen returns a length of an aggregate value that is O(1) to get and grows
+// with its elements, the elements of lists and sorted sets and the buckets of
+// dicts, which follow their members on resize. ok is false for other values,
+// whose usage is O(1) to estimate.
+func valueLen(value interface{}) (n uint32, ok bool) {
+	var l int
+	switch v := value.(type) {
+	case *quicklist:
+		l = v.count
+	case *zset:
+		l = int(v.zsl.length)
+	case *dict:
+		l = len(v.tab[0].bucket) + len(v.tab[1].bucket)
+	default:
+		return 0, false
+	}
+	if l > math.MaxUint32 {
+		l = math.MaxUint32
+	}
+	return uint32(l), true
+}
+
+func valueUsage(value interface{}, samples int) int64 {
+	switch v := value.(type) {
+	case []byte:
+		return int64(cap(v))
+	case *[]byte:
+		return int64(unsafe.Sizeof(*v)) + int64(cap(*v))
+	case int64, float64:
+		return 8
+	case *quicklist:
+		return quicklistUsage(v, samples)
+	case *ziplist:
+		return int64(unsafe.Sizeof(*v)) + int64(cap(v.data))
+	case *intset:
+		return int64(unsafe.Sizeof(*v)) + int64(cap(v.contents))
+	case *dict:
+		return dictUsage(v, samples)
+	case *zset:
+		return zsetUsage(v, samples)
+	default: // the nil value of a set member
+		return 0
+	}
+}
+
+func quicklistUsage(ql *quicklist, samples int) int64 {
+	n := int64(unsafe.Sizeof(*ql))
+	var sum int64
+	sampled := 0
+	for node := ql.head; node != nil && (samples == 0 || sampled < samples); node = node.next {
+		sum += int64(unsafe.Sizeof(*node)) + int64(unsafe.Sizeof(*node.zl)) + int64(cap(node.zl.data))
+		sampled++
+	}
+	if sampled == 0 {
+		return n
+	}
+	return n + sum*int64(ql.length)/int64(sampled)
+}
+
+func dictUsage(d *dict, samples int) int64 {
+	n := int64(unsafe.Sizeof(*d)) + d.tableBytes()
+	var sum int64
+	sampled := 0
+	iter := d.getIterator()
+	for e := iter.next(); e != nil && (samples == 0 || sampled < samples); e = iter.next() {
+		sum += objectUsage(e.key, e.value, samples)
+		sampled++
+	}
+	if sampled == 0 {
+		return n
+	}
+	return n + sum*int64(d.size())/int64(sampled)
+}
+
+// tableBytes returns the bytes of the bucket arrays of d and of their shard
+// counters.
+func (d *dict) tableBytes() int64 {
+	var n int64
+	for _, t := range d.tab {
+		n += int64(len(t.bucket))*int64(unsafe.Sizeof((*entry)(nil))) +
+			int64(len(t.used))*int64(unsafe.Sizeof(int(0)))
+	}
+	return n
+}
+
+// zsetUsage adds the skiplist nodes to the usage of the dict, the member
+// names are shared by both.
+func zsetUsage(zs *zset, samples int) int64 {
+	n := int64(unsafe.Sizeof(*zs)) + int64(unsafe.Sizeof(*zs.zsl)) + dictUsage(zs.dict, samples)
+	var sum int64
+	sampled := 0
+	for x := zs.zsl.header.level[0].forward; x != nil && (samples == 0 || sampled < samples); x = x.level[0].forward {
+		sum += int64(unsafe.Sizeof(*x)) + int64(len(x.level))*int64(unsafe.Sizeof(zskiplistLevel{}))
+		sampled++
+	}
+	if sampled == 0 {
+		return n
+	}
+	return n + sum*int64(zs.zsl.length)/int64(sampled)
+}
+
 func (c *client) getStringOrReply(i interface{}, emptymsg []byte, errmsg []byte) ([]byte, bool) {
 	s, ok := getString(i)
 	if !ok {
@@ -182,8 +464,8 @@ func (c *client) getListOrReply(i interface{}, emptymsg []byte) (interface{}, bo
 }
 
 func (c *client) getHashOrReply(i interface{}, emptymsg []byte) (interface{}, bool) {
-	switch i.(type) { //TODO: support ziplist
-	case *dict:
+	switch i.(type) {
+	case *ziplist, *dict:
 		return i, true
 	case nil:
 		if emptymsg != nil {
@@ -197,8 +479,8 @@ func (c *client) getHashOrReply(i interface{}, emptymsg []byte) (interface{}, bo
 }
 
 func (c *client) getSetOrReply(i interface{}, emptymsg []byte) (interface{}, bool) {
-	switch i.(type) { //TODO: support intset
-	case *dict:
+	switch i.(type) {
+	case *intset, *dict:
 		return i, true
 	case nil:
 		if emptymsg != nil {
@@ -227,10 +509,10 @@ func (c *client) getZsetOrReply(i interface{}, emptymsg []byte) (interface{}, bo
 }
 
 func (c *client) getSetZsetOrReply(i interface{}, emptymsg []byte) (interface{}, bool) {
-	switch i.(type) { //TODO: support ziplist and intset
+	switch i.(type) { //TODO: support ziplist
 	case *zset:
 		return i, true
-	case *dict:
+	case *intset, *dict:
 		return i, true
 	case nil:
 		if emptymsg != nil {
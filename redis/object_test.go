@@ -0,0 +1,42 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestObject(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	object := func(args ...string) string {
+		c.wBuffer.Reset()
+		c.argv = argv(append([]string{"OBJECT"}, args...)...)
+		c.argc = len(c.argv)
+		objectCommand(c)
+		return c.wBuffer.String()
+	}
+
+	fmt.Println("Report the encoding of each type of value.")
+	short := []byte(strings.Repeat("a", OBJECT_ENCSTR_SIZE_LIMIT))
+	long := append(short, 'a')
+	assertEqual(t, encodingName(int64(1)), "int")
+	assertEqual(t, encodingName(1.5), "embstr")
+	assertEqual(t, encodingName(short), "embstr")
+	assertEqual(t, encodingName(long), "raw")
+	assertEqual(t, encodingName(&long), "raw")
+	assertEqual(t, encodingName(&quicklist{}), "quicklist")
+	assertEqual(t, encodingName(&dict{}), "hashtable")
+	assertEqual(t, encodingName(&zset{}), "skiplist")
+
+	fmt.Println("Check the subcommand before the key.")
+	assertEqual(t, strings.HasPrefix(object("HELP"), "*4\r\n+ENCODING <key>"), true)
+	assertEqual(t, strings.HasPrefix(object("NOSUCH", "k"), "-ERR Unknown subcommand"), true)
+	assertEqual(t, strings.HasPrefix(object("ENCODING"), "-ERR Unknown subcommand"), true)
+	assertEqual(t, strings.HasPrefix(object("ENCODING", "k", "x"), "-ERR Unknown subcommand"), true)
+}
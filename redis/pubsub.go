@@ -0,0 +1,309 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Channels and patterns only live in volatile memory, subscriptions do not
+// survive a restart. PUBLISH runs in the goroutine of the publisher, so the
+// messages are queued for the writer goroutines of the receivers with
+// pushMessage, after the subscriptions are looked up. A receiver that does not
+// keep up is disconnected and never holds up the publisher.
+
+type pubsub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*client]struct{}
+	patterns map[string]map[*client]struct{}
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{channels: make(map[string]map[*client]struct{}),
+		patterns: make(map[string]map[*client]struct{})}
+}
+
+// allowedInSubscribe reports whether cmd may run while a RESP2 client is
+// subscribed. RESP3 clients get messages as push replies and may run any
+// command.
+func (cmd *redisCommand) allowedInSubscribe() bool {
+	switch cmd.name {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING":
+		return true
+	}
+	return false
+}
+
+func (c *client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *client) addReplyPubsubHead(kind string) {
+	c.addReplyPushLen(3)
+	c.addReplyBulk([]byte(kind))
+}
+
+// subscribe adds c to channel and replies the confirmation.
+func (c *client) subscribe(channel []byte) {
+	name := string(channel)
+	if _, ok := c.channels[name]; !ok {
+		c.channels[name] = struct{}{}
+		ps := c.s.pubsub
+		ps.mu.Lock()
+		if ps.channels[name] == nil {
+			ps.channels[name] = make(map[*client]struct{})
+		}
+		ps.channels[name][c] = struct{}{}
+		ps.mu.Unlock()
+	}
+	c.addReplyPubsubHead("subscribe")
+	c.addReplyBulk(channel)
+	c.addReplyLongLong(int64(c.subscriptionCount()))
+}
+
+// unsubscribe removes c from channel, replying the confirmation if notify is
+// set.
+func (c *client) unsubscribe(channel []byte, notify bool) {
+	name := string(channel)
+	if _, ok := c.channels[name]; ok {
+		delete(c.channels, name)
+		ps := c.s.pubsub
+		ps.mu.Lock()
+		delete(ps.channels[name], c)
+		if len(ps.channels[name]) == 0 {
+			delete(ps.channels, name)
+		}
+		ps.mu.Unlock()
+	}
+	if notify {
+		c.addReplyPubsubHead("unsubscribe")
+		c.addReplyBulk(channel)
+		c.addReplyLongLong(int64(c.subscriptionCount()))
+	}
+}
+
+func (c *client) psubscribe(pattern []byte) {
+	name := string(pattern)
+	if _, ok := c.patterns[name]; !ok {
+		c.patterns[name] = struct{}{}
+		ps := c.s.pubsub
+		ps.mu.Lock()
+		if ps.patterns[name] == nil {
+			ps.patterns[name] = make(map[*client]struct{})
+		}
+		ps.patterns[name][c] = struct{}{}
+		ps.mu.Unlock()
+	}
+	c.addReplyPubsubHead("psubscribe")
+	c.addReplyBulk(pattern)
+	c.addReplyLongLong(int64(c.subscriptionCount()))
+}
+
+func (c *client) punsubscribe(pattern []byte, notify bool) {
+	name := string(pattern)
+	if _, ok := c.patterns[name]; ok {
+		delete(c.patterns, name)
+		ps := c.s.pubsub
+		ps.mu.Lock()
+		delete(ps.patterns[name], c)
+		if len(ps.patterns[name]) == 0 {
+			delete(ps.patterns, name)
+		}
+		ps.mu.Unlock()
+	}
+	if notify {
+		c.addReplyPubsubHead("punsubscribe")
+		c.addReplyBulk(pattern)
+		c.addReplyLongLong(int64(c.subscriptionCount()))
+	}
+}
+
+// unsubscribeAll removes every channel subscription of c. If c had none and
+// notify is set, a single confirmation with a null channel is replied.
+func (c *client) unsubscribeAll(notify bool) {
+	if notify && len(c.channels) == 0 {
+		c.addReplyPubsubHead("unsubscribe")
+		c.addReplyNull()
+		c.addReplyLongLong(int64(c.subscriptionCount()))
+		return
+	}
+	for _, name := range sortedNames(c.channels) {
+		c.unsubscribe([]byte(name), notify)
+	}
+}
+
+func (c *client) punsubscribeAll(notify bool) {
+	if notify && len(c.patterns) == 0 {
+		c.addReplyPubsubHead("punsubscribe")
+		c.addReplyNull()
+		c.addReplyLongLong(int64(c.subscriptionCount()))
+		return
+	}
+	for _, name := range sortedNames(c.patterns) {
+		c.punsubscribe([]byte(name), notify)
+	}
+}
+
+func sortedNames(m map[string]struct{}) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// publish sends message to the subscribers of channel and of the patterns
+// matching it, and returns the number of receivers.
+func (s *Server) publish(channel, message []byte) int {
+	type receiver struct {
+		c       *client
+		pattern []byte
+	}
+	var receivers []receiver
+	ps := s.pubsub
+	ps.mu.RLock()
+	for r := range ps.channels[string(channel)] {
+		receivers = append(receivers, receiver{r, nil})
+	}
+	for pattern, clients := range ps.patterns {
+		if !stringmatch([]byte(pattern), channel, false) {
+			continue
+		}
+		for r := range clients {
+			receivers = append(receivers, receiver{r, []byte(pattern)})
+		}
+	}
+	ps.mu.RUnlock()
+	for _, r := range receivers {
+		if r.pattern == nil {
+			r.c.pushMessage([]byte("message"), channel, message)
+		} else {
+			r.c.pushMessage([]byte("pmessage"), r.pattern, channel, message)
+		}
+	}
+	return len(receivers)
+}
+
+// encodePush encodes a push reply of bulk strings, an array in RESP2.
+func encodePush(resp int, parts ...[]byte) []byte {
+	var b bytes.Buffer
+	if resp == 2 {
+		b.Write(shared.arrayhead)
+	} else {
+		b.Write(shared.pushhead)
+	}
+	b.WriteString(strconv.Itoa(len(parts)))
+	b.Write(shared.crlf)
+	for _, p := range parts {
+		b.Write(shared.bulkhead)
+		b.WriteString(strconv.Itoa(len(p)))
+		b.Write(shared.crlf)
+		b.Write(p)
+		b.Write(shared.crlf)
+	}
+	return b.Bytes()
+}
+
+// SUBSCRIBE channel [channel ...]
+func subscribeCommand(c *client) {
+	for _, channel := range c.argv[1:] {
+		c.subscribe(channel)
+	}
+}
+
+// UNSUBSCRIBE [channel ...]
+func unsubscribeCommand(c *client) {
+	if c.argc == 1 {
+		c.unsubscribeAll(true)
+		return
+	}
+	for _, channel := range c.argv[1:] {
+		c.unsubscribe(channel, true)
+	}
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func psubscribeCommand(c *client) {
+	for _, pattern := range c.argv[1:] {
+		c.psubscribe(pattern)
+	}
+}
+
+// PUNSUBSCRIBE [pattern ...]
+func punsubscribeCommand(c *client) {
+	if c.argc == 1 {
+		c.punsubscribeAll(true)
+		return
+	}
+	for _, pattern := range c.argv[1:] {
+		c.punsubscribe(pattern, true)
+	}
+}
+
+// PUBLISH channel message
+func publishCommand(c *client) {
+	c.addReplyLongLong(int64(c.s.publish(c.argv[1], c.argv[2])))
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT | HELP
+func pubsubCommand(c *client) {
+	ps := c.s.pubsub
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	sub := c.argv[1]
+	if bytes.EqualFold(sub, []byte("help")) && c.argc == 2 {
+		help := []string{
+			"CHANNELS [<pattern>] -- Return the currently active channels matching a pattern (default: all).",
+			"NUMPAT -- Return number of subscriptions to patterns.",
+			"NUMSUB [channel-1 .. channel-N] -- Returns the number of subscribers for the specified channels (excluding patterns, default: none)."}
+		c.addReplyMultiBulkLen(len(help))
+		for _, h := range help {
+			c.addReplyStatus(h)
+		}
+	} else if bytes.EqualFold(sub, []byte("channels")) && (c.argc == 2 || c.argc == 3) {
+		var names []string
+		for name := range ps.channels {
+			if c.argc == 2 || stringmatch(c.argv[2], []byte(name), false) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		c.addReplyMultiBulkLen(len(names))
+		for _, name := range names {
+			c.addReplyBulk([]byte(name))
+		}
+	} else if bytes.EqualFold(sub, []byte("numsub")) && c.argc >= 2 {
+		c.addReplyMultiBulkLen((c.argc - 2) * 2)
+		for _, channel := range c.argv[2:] {
+			c.addReplyBulk(channel)
+			c.addReplyLongLong(int64(len(ps.channels[string(channel)])))
+		}
+	} else if bytes.EqualFold(sub, []byte("numpat")) && c.argc == 2 {
+		numpat := 0
+		for _, clients := range ps.patterns {
+			numpat += len(clients)
+		}
+		c.addReplyLongLong(int64(numpat))
+	} else {
+		c.addReplyError([]byte(fmt.Sprintf(
+			"Unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", sub)))
+	}
+}
+
+// subscribeModeError is replied to RESP2 clients that run a command other
+// than the pubsub ones while subscribed.
+func (c *client) subscribeModeError() {
+	c.addReplyError([]byte(fmt.Sprintf(
+		"Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+		strings.ToLower(c.cmd.name))))
+}
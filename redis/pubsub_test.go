@@ -0,0 +1,185 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPubsub(t *testing.T) {
+	createSharedObjects()
+	s := NewServer(DefaultConfig())
+	s.populateCommandTable()
+	sub, pub := s.newClient(nil), s.newClient(nil)
+	reply := func(c *client) string {
+		r := c.wBuffer.String()
+		c.wBuffer.Reset()
+		return r
+	}
+	run := func(c *client, proc func(*client), args ...string) {
+		c.argv = argv(args...)
+		c.argc = len(c.argv)
+		c.lookupCommand()
+		proc(c)
+	}
+
+	fmt.Println("Subscribe to channels and patterns.")
+	run(sub, subscribeCommand, "SUBSCRIBE", "news", "news")
+	assertEqual(t, reply(sub), "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"+
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	run(sub, psubscribeCommand, "PSUBSCRIBE", "n[ae]ws.*")
+	assertEqual(t, reply(sub), "*3\r\n$10\r\npsubscribe\r\n$9\r\nn[ae]ws.*\r\n:2\r\n")
+
+	fmt.Println("Publish to channel and pattern subscribers.")
+	run(pub, publishCommand, "PUBLISH", "news", "hi")
+	assertEqual(t, reply(pub), ":1\r\n")
+	assertEqual(t, reply(sub), "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n")
+	run(pub, publishCommand, "PUBLISH", "naws.sport", "goal")
+	assertEqual(t, reply(pub), ":1\r\n")
+	assertEqual(t, reply(sub), "*4\r\n$8\r\npmessage\r\n$9\r\nn[ae]ws.*\r\n$10\r\nnaws.sport\r\n$4\r\ngoal\r\n")
+	run(pub, publishCommand, "PUBLISH", "nows.sport", "goal")
+	assertEqual(t, reply(pub), ":0\r\n")
+
+	fmt.Println("Introspect with PUBSUB.")
+	run(pub, pubsubCommand, "PUBSUB", "CHANNELS", "n*")
+	assertEqual(t, reply(pub), "*1\r\n$4\r\nnews\r\n")
+	run(pub, pubsubCommand, "PUBSUB", "NUMSUB", "news", "other")
+	assertEqual(t, reply(pub), "*4\r\n$4\r\nnews\r\n:1\r\n$5\r\nother\r\n:0\r\n")
+	run(pub, pubsubCommand, "PUBSUB", "NUMPAT")
+	assertEqual(t, reply(pub), ":1\r\n")
+
+	fmt.Println("Restrict commands of subscribed RESP2 clients.")
+	sub.argv = argv("GET", "a")
+	sub.argc = 2
+	sub.processCommand()
+	assertEqual(t, reply(sub), "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")
+	run(sub, pingCommand, "PING")
+	assertEqual(t, reply(sub), "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	fmt.Println("Push messages to RESP3 clients.")
+	sub.resp = 3
+	run(pub, publishCommand, "PUBLISH", "news", "hi")
+	assertEqual(t, reply(sub), ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n")
+	sub.resp = 2
+
+	fmt.Println("Unsubscribe from everything.")
+	run(sub, unsubscribeCommand, "UNSUBSCRIBE")
+	assertEqual(t, reply(sub), "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	run(sub, punsubscribeCommand, "PUNSUBSCRIBE")
+	assertEqual(t, reply(sub), "*3\r\n$12\r\npunsubscribe\r\n$9\r\nn[ae]ws.*\r\n:0\r\n")
+	run(sub, unsubscribeCommand, "UNSUBSCRIBE")
+	assertEqual(t, reply(sub), "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n")
+	assertEqual(t, len(s.pubsub.channels), 0)
+	assertEqual(t, len(s.pubsub.patterns), 0)
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	createSharedObjects()
+	cfg := DefaultConfig()
+	cfg.Set("notify-keyspace-events", "KEl")
+	s := NewServer(cfg)
+	sub := s.newClient(nil)
+	reply := func() string {
+		r := sub.wBuffer.String()
+		sub.wBuffer.Reset()
+		return r
+	}
+	sub.psubscribe([]byte("__key*@0__:*"))
+	reply()
+
+	fmt.Println("Publish keyspace and keyevent messages of enabled classes.")
+	s.notifyKeyspaceEvent(NOTIFY_LIST, "lpush", []byte("mylist"), 0)
+	assertEqual(t, reply(),
+		"*4\r\n$8\r\npmessage\r\n$12\r\n__key*@0__:*\r\n$21\r\n__keyspace@0__:mylist\r\n$5\r\nlpush\r\n"+
+			"*4\r\n$8\r\npmessage\r\n$12\r\n__key*@0__:*\r\n$20\r\n__keyevent@0__:lpush\r\n$6\r\nmylist\r\n")
+
+	fmt.Println("Skip disabled classes.")
+	s.notifyKeyspaceEvent(NOTIFY_STRING, "set", []byte("a"), 0)
+	assertEqual(t, reply(), "")
+
+	fmt.Println("Publish the events of a command once it has committed.")
+	c := newTestClient(1)
+	c.s.cfg.Set("notify-keyspace-events", "E$")
+	sub = c.s.newClient(nil)
+	sub.subscribe([]byte("__keyevent@0__:set"))
+	reply()
+	c.argv = argv("SET", "a", "1")
+	c.argc = len(c.argv)
+	c.cmd = &redisCommand{name: "SETCHECK", proc: func(c *client) {
+		setCommand(c)
+		assertEqual(t, reply(), "")
+	}}
+	c.call()
+	assertEqual(t, reply(), "*3\r\n$7\r\nmessage\r\n$18\r\n__keyevent@0__:set\r\n$1\r\na\r\n")
+
+	fmt.Println("Drop the events of a command that panics.")
+	c.cmd = &redisCommand{name: "SETPANIC", proc: func(c *client) {
+		setCommand(c)
+		panic("after the write")
+	}}
+	c.call()
+	assertEqual(t, reply(), "")
+
+	fmt.Println("Report reads of missing keys as keymiss.")
+	c.s.cfg.Set("notify-keyspace-events", "Em")
+	sub.subscribe([]byte("__keyevent@0__:keymiss"))
+	reply()
+	runCommand(c, "GET", "a")
+	assertEqual(t, reply(), "")
+	runCommand(c, "GET", "nokey")
+	assertEqual(t, reply(), "*3\r\n$7\r\nmessage\r\n$22\r\n__keyevent@0__:keymiss\r\n$5\r\nnokey\r\n")
+}
+
+func TestPubsubSlowSubscriber(t *testing.T) {
+	createSharedObjects()
+	s := NewServer(DefaultConfig())
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := s.newClient(conn)
+	written := make(chan struct{})
+	go sub.writeOutput(written)
+	sub.subscribe([]byte("news"))
+
+	fmt.Println("Publish to a subscriber that never reads.")
+	message := make([]byte, 1024*1024)
+	done := make(chan int)
+	go func() {
+		n := 0
+		for i := 0; i < 2*CLIENT_OUTPUT_LIMIT/len(message); i++ {
+			n += s.publish([]byte("news"), message)
+		}
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		assertEqual(t, n, 2*CLIENT_OUTPUT_LIMIT/len(message))
+	case <-time.After(10 * time.Second):
+		t.Fatal("publish waits for the subscriber")
+	}
+
+	fmt.Println("The subscriber is disconnected over the output limit.")
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the writer of the subscriber is still running")
+	}
+	assertEqual(t, sub.out.push([]byte("+OK\r\n"), CLIENT_OUTPUT_LIMIT, false), false)
+}
@@ -7,6 +7,7 @@ package redis
 
 import (
 	"fmt"
+	"unsafe"
 
 	"github.com/vmware/go-pmem-transaction/transaction"
 )
@@ -50,6 +51,14 @@ func quicklistCreate() *quicklist {
 	return ql
 }
 
+func (ql *quicklist) swizzle() {
+	inPMem(unsafe.Pointer(ql))
+	for n := ql.head; n != nil; n = n.next {
+		inPMem(unsafe.Pointer(n))
+		inPMem(unsafe.Pointer(n.zl))
+	}
+}
+
 func quicklistNew(fill, compress int) *quicklist {
 	ql := quicklistCreate()
 	ql.SetOptions(fill, compress)
@@ -0,0 +1,99 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scanTable builds a volatile table of size buckets holding keys 0..n-1, key
+// h is placed in bucket h&mask as if h were its hash.
+func scanTable(size, n int) table {
+	t := table{bucket: make([]*entry, size), mask: size - 1}
+	for h := 0; h < n; h++ {
+		i := h & t.mask
+		t.bucket[i] = &entry{key: []byte(strconv.Itoa(h)), next: t.bucket[i]}
+	}
+	return t
+}
+
+func TestDictScan(t *testing.T) {
+	createSharedObjects()
+	scanAll := func(d *dict, seen map[string]int, v uint64) uint64 {
+		return d.scan(v, func(e *entry) {
+			seen[string(e.key)]++
+		})
+	}
+
+	fmt.Println("Visit every bucket once in reverse binary order.")
+	assertEqual(t, incrReverse(0, 7), uint64(4))
+	assertEqual(t, incrReverse(4, 7), uint64(2))
+	assertEqual(t, incrReverse(7, 7), uint64(0))
+	d := &dict{tab: [2]table{scanTable(8, 20), {mask: -1}}, rehashIdx: -1}
+	seen := make(map[string]int)
+	calls := 0
+	for v := scanAll(d, seen, 0); v != 0; v = scanAll(d, seen, v) {
+		calls++
+	}
+	assertEqual(t, calls, 7)
+	assertEqual(t, len(seen), 20)
+	for _, n := range seen {
+		assertEqual(t, n, 1)
+	}
+
+	fmt.Println("Visit both tables while rehashing.")
+	d = &dict{tab: [2]table{scanTable(2, 10), scanTable(8, 10)}, rehashIdx: 0}
+	seen = make(map[string]int)
+	v := scanAll(d, seen, 0)
+	assertEqual(t, v, uint64(1))
+	assertEqual(t, len(seen), 10/2)
+	scanAll(d, seen, v)
+	assertEqual(t, len(seen), 10)
+
+	fmt.Println("Return every key once the table grew between calls.")
+	d = &dict{tab: [2]table{scanTable(4, 30), {mask: -1}}, rehashIdx: -1}
+	seen = make(map[string]int)
+	v = scanAll(d, seen, scanAll(d, seen, 0))
+	d.tab[0] = scanTable(16, 30)
+	for v != 0 {
+		v = scanAll(d, seen, v)
+	}
+	assertEqual(t, len(seen), 30)
+
+	fmt.Println("Scan the keyspace and skip the expired keys.")
+	c := newTestClient(1)
+	for i := 0; i < 100; i++ {
+		runCommand(c, "SET", strconv.Itoa(i), "v")
+	}
+	c.db.expire.set(shadowCopyToPmem([]byte("7")), int64(1))
+	d = c.db.dict
+	seen = make(map[string]int)
+	for v := d.scanShared(0, func(e *entry) { seen[string(e.key)]++ }); v != 0; {
+		v = d.scanShared(v, func(e *entry) { seen[string(e.key)]++ })
+	}
+	assertEqual(t, len(seen), 100)
+	keys := 0
+	for cursor := "0"; ; {
+		reply := runCommand(c, "SCAN", cursor, "COUNT", "20")
+		lines := strings.Split(reply, "\r\n")
+		cursor = lines[2]
+		keys += (len(lines) - 5) / 2
+		assertEqual(t, strings.Contains(reply, "\r\n$1\r\n7\r\n"), false)
+		if cursor == "0" {
+			break
+		}
+	}
+	assertEqual(t, keys, 99)
+
+	fmt.Println("Reject a malformed cursor.")
+	c = newParserClient()
+	_, ok := c.parseScanCursorOrReply([]byte("-1"))
+	assertEqual(t, ok, false)
+	assertEqual(t, c.wBuffer.String(), "-ERR invalid cursor\r\n")
+}
@@ -7,40 +7,107 @@ package redis
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/vmware/go-pmem-transaction/pmem"
 	"github.com/vmware/go-pmem-transaction/transaction"
 )
 
 type (
-	server struct {
-		db       *redisDb
+	Server struct {
+		cfg      Config
+		root     *redisRoot
+		hashRoot *hashRoot
+		dbs      []*redisDb // the databases in root, indexed by SELECT
 		commands map[string](*redisCommand)
+		pubsub   *pubsub
+		blocking *blocking
+		stats    serverStats
+
+		// lastRunClean reports whether the pool was closed by Shutdown.
+		lastRunClean bool
+
+		mu       sync.Mutex // protects listener and clients
+		listener *net.TCPListener
+		clients  map[*client]struct{}
+
+		inflight sync.RWMutex   // held shared by running commands and bgResize, see exclusive
+		crons    sync.WaitGroup // background rehash and expire goroutines
+		quit     chan struct{}  // closed once shutdown begins
+		stopped  chan struct{}  // closed once shutdown returns
+		quitOnce sync.Once
+		stopOnce sync.Once
+	}
+
+	// redisRoot is the pmem root object of the server. A server only opens
+	// pools of its POOL_VERSION, pools of the first layout are converted,
+	// see upgrade.go.
+	redisRoot struct {
+		magic   int
+		version int // layout of the pool, set with magic
+		dbs     []*redisDb
+		clean   bool // set by Shutdown, cleared again at startup
+		gen     int  // bumped on every startup, see lastVersion
+	}
+
+	// hashRoot is a second pmem root object, so that pools written before
+	// the hash was seeded keep the layout of their redisRoot.
+	hashRoot struct {
+		seed   [2]uint64 // see hashSeed
+		legacy bool      // entries are still placed by dumbhash, see legacyHash
 	}
 
 	redisDb struct {
 		dict   *dict
 		expire *dict
-		magic  int
+
+		// Volatile, set at startup.
+		id       int32        // index in Server.dbs, changed by SWAPDB
+		expired  *expireQueue // keys found expired by readers, see expireCron
+		metas    *sync.Map    // *keyMeta of the entries of dict, see meta
+		used     int64        // estimated bytes of the keys with maxmemory set
+		overhead int64        // bytes of the dicts with maxmemory set, see updateOverhead
+		cfg      *Config
+		stats    *serverStats
+
+		// notify publishes keyspace events.
+		notify func(class int, event string, key []byte)
 	}
 
 	redisCommand struct {
-		name string
-		proc func(*client)
-		flag int
+		name  string
+		proc  func(*client)
+		arity int // number of arguments including the name, -N means >= N
+		flag  int
+
+		// Position of the first and last key argument and the step between
+		// keys, 0 if the command has no keys. A negative lastkey counts from
+		// the end, e.g., -1 is the last argument.
+		firstkey, lastkey, keystep int
 	}
 
 	client struct {
-		s       *server
-		db      *redisDb
+		s       *Server
+		dbid    int      // selected database
+		db      *redisDb // s.dbs[dbid], set before each command runs
 		conn    *net.TCPConn
 		rBuffer *bufio.Reader
-		wBuffer *bufio.Writer
+		wBuffer *bytes.Buffer // replies not yet sent, see flush
+		out     *outQueue     // output waiting for the writer goroutine
+		wmu     sync.Mutex    // protects resp against publishers, see pushMessage
 
 		argc int
 		argv [][]byte
@@ -48,151 +115,255 @@ type (
 		querybuf     []byte
 		multibulklen int
 		bulklen      int
-		replybuf     [][]byte
+		replybuf     *bytes.Buffer // replies held back by a deferred length
+
+		id   int64  // unique client id, starting from 1
+		resp int    // protocol version negotiated with HELLO, 2 or 3
+		name []byte // set by HELLO SETNAME
 
 		cmd *redisCommand
+
+		multi     bool       // inside MULTI, commands are queued
+		dirtyExec bool       // a command failed to queue, EXEC will abort
+		mstate    []multiCmd // commands queued by MULTI
+		batch     bool       // EXEC holds the locks of all queued keys
+		watched   []watchedKey
+
+		channels map[string]struct{} // subscribed channels
+		patterns map[string]struct{} // subscribed patterns
+
+		bstate    *blockState     // set while blocked by BLPOP and friends
+		readyKeys []blockKey      // keys pushed to waiters, woken after commit
+		events    []keyspaceEvent // published after commit, see notifyKeyspaceEvent
 	}
 
 	sharedObjects struct {
 		crlf, czero, cone, cnegone,
-		ok, nullbulk, emptybulk, emptymultibulk, pong,
-		syntaxerr, wrongtypeerr, outofrangeerr, nokeyerr,
-		bulkhead, inthead, arrayhead,
+		ok, nullbulk, nullmultibulk, emptybulk, emptymultibulk, emptyscan, pong, null, ctrue, cfalse,
+		syntaxerr, wrongtypeerr, outofrangeerr, nokeyerr, execaborterr, oomerr, queued,
+		bulkhead, inthead, arrayhead, maphead, sethead, doublehead, pushhead,
 		maxstring, minstring []byte
 	}
 )
 
 const (
-	DATABASE string = "./database"
-	PORT     string = ":6379"
-	MAGIC    int    = 0x3F4F357F7C9824B3
+	MAGIC int = 0x3F4F357F7C9824B3
+
+	// POOL_VERSION is the layout of the pmem objects written by this server.
+	// Bump it whenever a persistent struct changes, and convert older pools
+	// in upgrade.go.
+	POOL_VERSION int = 1
 
-	CMD_WRITE    int = 1 << 0
-	CMD_READONLY int = 1 << 1
-	CMD_LARGE    int = 1 << 2
+	// REDIS_VERSION is the redis release whose protocol and commands are
+	// implemented, as reported by HELLO.
+	REDIS_VERSION = "6.0.0"
+
+	CMD_WRITE     int = 1 << 0
+	CMD_READONLY  int = 1 << 1
+	CMD_LARGE     int = 1 << 2
+	CMD_ALLKEYS   int = 1 << 3 // may touch any key, EXEC locks whole tables
+	CMD_PUBSUB    int = 1 << 4
+	CMD_ALLDBS    int = 1 << 5 // may touch other dbs, EXEC locks every table
+	CMD_EXCLUSIVE int = 1 << 6 // runs while no other command does
+	CMD_DENYOOM   int = 1 << 7 // may grow memory, rejected over maxmemory
+
+	// Query parser limits, same as redis.
+	PROTO_INLINE_MAX_SIZE   int = 1024 * 64   // max length of a line without newline
+	PROTO_MAX_MULTIBULK_LEN int = 1024 * 1024 // max arguments of one query
+
+	// Output queued for a client beyond which publishers disconnect it, the
+	// hard pubsub client-output-buffer-limit of redis. Its own replies wait
+	// for the connection instead.
+	CLIENT_OUTPUT_LIMIT int = 32 * 1024 * 1024
 )
 
 var (
 	shared            sharedObjects
 	redisCommandTable = [...]redisCommand{
-		redisCommand{"PING", pingCommand, CMD_READONLY},
-		redisCommand{"GET", getCommand, CMD_READONLY},
-		redisCommand{"GETRANGE", getrangeCommand, CMD_READONLY},
-		redisCommand{"MGET", mgetCommand, CMD_READONLY},
-		redisCommand{"LLEN", llenCommand, CMD_READONLY},
-		redisCommand{"LINDEX", lindexCommand, CMD_READONLY},
-		redisCommand{"LRANGE", lrangeCommand, CMD_READONLY},
-		redisCommand{"HGET", hgetCommand, CMD_READONLY},
-		redisCommand{"HMGET", hmgetCommand, CMD_READONLY},
-		redisCommand{"HLEN", hlenCommand, CMD_READONLY},
-		redisCommand{"HSTRLEN", hstrlenCommand, CMD_READONLY},
-		redisCommand{"HKEYS", hkeysCommand, CMD_READONLY},
-		redisCommand{"HVALS", hvalsCommand, CMD_READONLY},
-		redisCommand{"HGETALL", hgetallCommand, CMD_READONLY},
-		redisCommand{"HEXISTS", hexistsCommand, CMD_READONLY},
-		redisCommand{"SCARD", scardCommand, CMD_READONLY},
-		redisCommand{"SISMEMBER", sismemberCommand, CMD_READONLY},
-		redisCommand{"ZCARD", zcardCommand, CMD_READONLY},
-		redisCommand{"ZSCORE", zscoreCommand, CMD_READONLY},
-		redisCommand{"ZRANK", zrankCommand, CMD_READONLY},
-		redisCommand{"ZREVRANK", zrevrankCommand, CMD_READONLY},
-		redisCommand{"ZCOUNT", zcountCommand, CMD_READONLY},
-		redisCommand{"ZLEXCOUNT", zlexcountCommand, CMD_READONLY},
-		redisCommand{"ZRANGE", zrangeCommand, CMD_READONLY},
-		redisCommand{"ZREVRANGE", zrevrangeCommand, CMD_READONLY},
-		redisCommand{"ZRANGEBYSCORE", zrangebyscoreCommand, CMD_READONLY},
-		redisCommand{"ZREVRANGEBYSCORE", zrevrangebyscoreCommand, CMD_READONLY},
-		redisCommand{"ZRANGEBYLEX", zrangebylexCommand, CMD_READONLY},
-		redisCommand{"ZREVRANGEBYLEX", zrevrangebylexCommand, CMD_READONLY},
-		redisCommand{"EXISTS", existsCommand, CMD_READONLY},
-		redisCommand{"DBSIZE", dbsizeCommand, CMD_READONLY},
-		redisCommand{"SELECT", selectCommand, CMD_READONLY},
-		redisCommand{"RANDOMKEY", randomkeyCommand, CMD_READONLY},
-		redisCommand{"STRLEN", strlenCommand, CMD_READONLY},
-		redisCommand{"TTL", ttlCommand, CMD_READONLY},
-		redisCommand{"PTTL", pttlCommand, CMD_READONLY},
-		redisCommand{"APPEND", appendCommand, CMD_WRITE},
-		redisCommand{"SET", setCommand, CMD_WRITE},
-		redisCommand{"SETNX", setnxCommand, CMD_WRITE},
-		redisCommand{"SETEX", setexCommand, CMD_WRITE},
-		redisCommand{"SINTER", sinterCommand, CMD_READONLY},
-		redisCommand{"SDIFF", sdiffCommand, CMD_READONLY},
-		redisCommand{"SUNION", sunionCommand, CMD_READONLY},
-		redisCommand{"SMEMBERS", sinterCommand, CMD_READONLY},
-		redisCommand{"SRANDMEMBER", srandmemberCommand, CMD_READONLY},
-		redisCommand{"PSETEX", psetexCommand, CMD_WRITE},
-		redisCommand{"SETRANGE", setrangeCommand, CMD_WRITE},
-		redisCommand{"GETSET", getsetCommand, CMD_WRITE},
-		redisCommand{"MSET", msetCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"MSETNX", msetnxCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"INCR", incrCommand, CMD_WRITE},
-		redisCommand{"INCRBY", incrbyCommand, CMD_WRITE},
-		redisCommand{"INCRBYFLOAT", incrbyfloatCommand, CMD_WRITE},
-		redisCommand{"DECR", decrCommand, CMD_WRITE},
-		redisCommand{"DECRBY", decrbyCommand, CMD_WRITE},
-		redisCommand{"LPUSH", lpushCommand, CMD_WRITE},
-		redisCommand{"RPUSH", rpushCommand, CMD_WRITE},
-		redisCommand{"LPUSHX", lpushxCommand, CMD_WRITE},
-		redisCommand{"RPUSHX", rpushxCommand, CMD_WRITE},
-		redisCommand{"LINSERT", linsertCommand, CMD_WRITE},
-		redisCommand{"LSET", lsetCommand, CMD_WRITE},
-		redisCommand{"LPOP", lpopCommand, CMD_WRITE},
-		redisCommand{"RPOP", rpopCommand, CMD_WRITE},
-		redisCommand{"RPOPLPUSH", rpoplpushCommand, CMD_WRITE},
-		redisCommand{"LREM", lremCommand, CMD_WRITE},
-		redisCommand{"LTRIM", ltrimCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"HSET", hsetCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"HSETNX", hsetnxCommand, CMD_WRITE},
-		redisCommand{"HINCRBY", hincrbyCommand, CMD_WRITE},
-		redisCommand{"HINCRBYFLOAT", hincrbyfloatCommand, CMD_WRITE},
-		redisCommand{"HMSET", hsetCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"HDEL", hdelCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"SADD", saddCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"SREM", sremCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"SMOVE", smoveCommand, CMD_WRITE},
-		redisCommand{"SPOP", spopCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"SINTERSTORE", sinterstoreCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"SDIFFSTORE", sdiffstoreCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"SUNIONSTORE", sunionstoreCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZADD", zaddCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZINCRBY", zincrbyCommand, CMD_WRITE},
-		redisCommand{"ZREM", zremCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZREMRANGEBYSCORE", zremrangebyscoreCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZREMRANGEBYRANK", zremrangebyrankCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZREMRANGEBYLEX", zremrangebylexCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZUNIONSTORE", zunionstoreCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"ZINTERSTORE", zinterstoreCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"DEL", delCommand, CMD_WRITE | CMD_LARGE},
-		redisCommand{"FLUSHDB", flushdbCommand, CMD_WRITE},
-		redisCommand{"EXPIRE", expireCommand, CMD_WRITE},
-		redisCommand{"EXPIREAT", expireatCommand, CMD_WRITE},
-		redisCommand{"PEXPIRE", pexpireCommand, CMD_WRITE},
-		redisCommand{"PEXPIREAT", pexpireatCommand, CMD_WRITE},
-		redisCommand{"PERSIST", persistCommand, CMD_WRITE}}
+		redisCommand{"PING", pingCommand, -1, CMD_READONLY, 0, 0, 0},
+		redisCommand{"SHUTDOWN", shutdownCommand, -1, CMD_READONLY, 0, 0, 0},
+		redisCommand{"HELLO", helloCommand, -1, CMD_READONLY, 0, 0, 0},
+		redisCommand{"COMMAND", commandCommand, -1, CMD_READONLY, 0, 0, 0},
+		redisCommand{"INFO", infoCommand, -1, CMD_READONLY | CMD_ALLDBS, 0, 0, 0},
+		redisCommand{"CONFIG", configCommand, -2, CMD_READONLY, 0, 0, 0},
+		redisCommand{"MEMORY", memoryCommand, -2, CMD_READONLY | CMD_ALLDBS, 0, 0, 0},
+		redisCommand{"MULTI", multiCommand, 1, 0, 0, 0, 0},
+		redisCommand{"EXEC", execCommand, 1, 0, 0, 0, 0},
+		redisCommand{"DISCARD", discardCommand, 1, 0, 0, 0, 0},
+		redisCommand{"WATCH", watchCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"UNWATCH", unwatchCommand, 1, CMD_READONLY, 0, 0, 0},
+		redisCommand{"SUBSCRIBE", subscribeCommand, -2, CMD_PUBSUB, 0, 0, 0},
+		redisCommand{"UNSUBSCRIBE", unsubscribeCommand, -1, CMD_PUBSUB, 0, 0, 0},
+		redisCommand{"PSUBSCRIBE", psubscribeCommand, -2, CMD_PUBSUB, 0, 0, 0},
+		redisCommand{"PUNSUBSCRIBE", punsubscribeCommand, -1, CMD_PUBSUB, 0, 0, 0},
+		redisCommand{"PUBLISH", publishCommand, 3, CMD_PUBSUB, 0, 0, 0},
+		redisCommand{"PUBSUB", pubsubCommand, -2, CMD_PUBSUB, 0, 0, 0},
+		redisCommand{"GET", getCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"GETRANGE", getrangeCommand, 4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"MGET", mgetCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"LLEN", llenCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"LINDEX", lindexCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"LRANGE", lrangeCommand, 4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HGET", hgetCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HMGET", hmgetCommand, -3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HLEN", hlenCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HSTRLEN", hstrlenCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HKEYS", hkeysCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HVALS", hvalsCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HGETALL", hgetallCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"HEXISTS", hexistsCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"SCARD", scardCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"SISMEMBER", sismemberCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZCARD", zcardCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZSCORE", zscoreCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZRANK", zrankCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZREVRANK", zrevrankCommand, 3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZCOUNT", zcountCommand, 4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZLEXCOUNT", zlexcountCommand, 4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZRANGE", zrangeCommand, -4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZREVRANGE", zrevrangeCommand, -4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZRANGEBYSCORE", zrangebyscoreCommand, -4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZREVRANGEBYSCORE", zrevrangebyscoreCommand, -4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZRANGEBYLEX", zrangebylexCommand, -4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZREVRANGEBYLEX", zrevrangebylexCommand, -4, CMD_READONLY, 1, 1, 1},
+		redisCommand{"EXISTS", existsCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"TOUCH", touchCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"TYPE", typeCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"OBJECT", objectCommand, -2, CMD_READONLY, 2, 2, 1},
+		redisCommand{"DBSIZE", dbsizeCommand, 1, CMD_READONLY | CMD_ALLKEYS, 0, 0, 0},
+		redisCommand{"SELECT", selectCommand, 2, CMD_READONLY, 0, 0, 0},
+		redisCommand{"MOVE", moveCommand, 3, CMD_WRITE | CMD_ALLDBS, 1, 1, 1},
+		redisCommand{"SWAPDB", swapdbCommand, 3, CMD_WRITE | CMD_ALLDBS | CMD_EXCLUSIVE, 0, 0, 0},
+		redisCommand{"RANDOMKEY", randomkeyCommand, 1, CMD_READONLY | CMD_ALLKEYS, 0, 0, 0},
+		redisCommand{"KEYS", keysCommand, 2, CMD_READONLY | CMD_ALLKEYS, 0, 0, 0},
+		redisCommand{"SCAN", scanCommand, -2, CMD_READONLY | CMD_ALLKEYS, 0, 0, 0},
+		redisCommand{"HSCAN", hscanCommand, -3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"SSCAN", sscanCommand, -3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"ZSCAN", zscanCommand, -3, CMD_READONLY, 1, 1, 1},
+		redisCommand{"STRLEN", strlenCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"TTL", ttlCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"PTTL", pttlCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"APPEND", appendCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"SET", setCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"SETNX", setnxCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"SETEX", setexCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"SINTER", sinterCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"SDIFF", sdiffCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"SUNION", sunionCommand, -2, CMD_READONLY, 1, -1, 1},
+		redisCommand{"SMEMBERS", sinterCommand, 2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"SRANDMEMBER", srandmemberCommand, -2, CMD_READONLY, 1, 1, 1},
+		redisCommand{"PSETEX", psetexCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"SETRANGE", setrangeCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"GETSET", getsetCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"MSET", msetCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, -1, 2},
+		redisCommand{"MSETNX", msetnxCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, -1, 2},
+		redisCommand{"INCR", incrCommand, 2, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"INCRBY", incrbyCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"INCRBYFLOAT", incrbyfloatCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"DECR", decrCommand, 2, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"DECRBY", decrbyCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"LPUSH", lpushCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"RPUSH", rpushCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"LPUSHX", lpushxCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"RPUSHX", rpushxCommand, -3, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"LINSERT", linsertCommand, 5, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"LSET", lsetCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"LPOP", lpopCommand, 2, CMD_WRITE, 1, 1, 1},
+		redisCommand{"RPOP", rpopCommand, 2, CMD_WRITE, 1, 1, 1},
+		redisCommand{"RPOPLPUSH", rpoplpushCommand, 3, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+		redisCommand{"LMOVE", lmoveCommand, 5, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+		redisCommand{"BLPOP", blpopCommand, -3, CMD_WRITE, 1, -2, 1},
+		redisCommand{"BRPOP", brpopCommand, -3, CMD_WRITE, 1, -2, 1},
+		redisCommand{"BRPOPLPUSH", brpoplpushCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+		redisCommand{"BLMOVE", blmoveCommand, 6, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+		redisCommand{"LREM", lremCommand, 4, CMD_WRITE, 1, 1, 1},
+		redisCommand{"LTRIM", ltrimCommand, 4, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"HSET", hsetCommand, -4, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, 1, 1},
+		redisCommand{"HSETNX", hsetnxCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"HINCRBY", hincrbyCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"HINCRBYFLOAT", hincrbyfloatCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"HMSET", hsetCommand, -4, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, 1, 1},
+		redisCommand{"HDEL", hdelCommand, -3, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"SADD", saddCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, 1, 1},
+		redisCommand{"SREM", sremCommand, -3, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"SMOVE", smoveCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 2, 1},
+		redisCommand{"SPOP", spopCommand, -2, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"SINTERSTORE", sinterstoreCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, -1, 1},
+		redisCommand{"SDIFFSTORE", sdiffstoreCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, -1, 1},
+		redisCommand{"SUNIONSTORE", sunionstoreCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, -1, 1},
+		redisCommand{"ZADD", zaddCommand, -4, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 1, 1, 1},
+		redisCommand{"ZINCRBY", zincrbyCommand, 4, CMD_WRITE | CMD_DENYOOM, 1, 1, 1},
+		redisCommand{"ZREM", zremCommand, -3, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"ZREMRANGEBYSCORE", zremrangebyscoreCommand, 4, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"ZREMRANGEBYRANK", zremrangebyrankCommand, 4, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"ZREMRANGEBYLEX", zremrangebylexCommand, 4, CMD_WRITE | CMD_LARGE, 1, 1, 1},
+		redisCommand{"ZUNIONSTORE", zunionstoreCommand, -4, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 0, 0, 0},
+		redisCommand{"ZINTERSTORE", zinterstoreCommand, -4, CMD_WRITE | CMD_DENYOOM | CMD_LARGE, 0, 0, 0},
+		redisCommand{"DEL", delCommand, -2, CMD_WRITE | CMD_LARGE, 1, -1, 1},
+		redisCommand{"UNLINK", unlinkCommand, -2, CMD_WRITE | CMD_LARGE, 1, -1, 1},
+		redisCommand{"RENAME", renameCommand, 3, CMD_WRITE, 1, 2, 1},
+		redisCommand{"RENAMENX", renamenxCommand, 3, CMD_WRITE, 1, 2, 1},
+		redisCommand{"COPY", copyCommand, -3, CMD_WRITE | CMD_DENYOOM | CMD_LARGE | CMD_ALLDBS, 1, 2, 1},
+		redisCommand{"FLUSHDB", flushdbCommand, -1, CMD_WRITE | CMD_ALLKEYS, 0, 0, 0},
+		redisCommand{"FLUSHALL", flushallCommand, -1, CMD_WRITE | CMD_ALLDBS, 0, 0, 0},
+		redisCommand{"EXPIRE", expireCommand, 3, CMD_WRITE, 1, 1, 1},
+		redisCommand{"EXPIREAT", expireatCommand, 3, CMD_WRITE, 1, 1, 1},
+		redisCommand{"PEXPIRE", pexpireCommand, 3, CMD_WRITE, 1, 1, 1},
+		redisCommand{"PEXPIREAT", pexpireatCommand, 3, CMD_WRITE, 1, 1, 1},
+		redisCommand{"PERSIST", persistCommand, 2, CMD_WRITE, 1, 1, 1}}
 
 	pstart, pend uintptr
+
+	nextClientId int64 // last client id handed out, accessed atomically
+
+	// ErrServerClosed is returned by Start after Shutdown has been called.
+	ErrServerClosed = errors.New("redis: Server closed")
 )
 
+// RunServer starts a server with the default configuration.
 func RunServer() {
-	s := new(server)
-	s.Start()
+	NewServer(DefaultConfig()).Start()
+}
+
+// NewServer returns a server that will use the given configuration once
+// started.
+func NewServer(cfg Config) *Server {
+	return &Server{cfg: cfg,
+		pubsub:   newPubsub(),
+		blocking: newBlocking(),
+		clients:  make(map[*client]struct{}),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{})}
 }
 
-func (s *server) Start() {
+// Start opens the pool and serves clients until Shutdown is called. It then
+// waits for Shutdown to finish and returns ErrServerClosed.
+func (s *Server) Start() error {
+	s.stats.startTime = time.Now()
 	// Initialize database
-	s.init(DATABASE)
+	s.init(s.cfg.PoolPath)
 	// accept client connections
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", PORT)
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", s.cfg.Addr)
 	fatalError(err)
 
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	fatalError(err)
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	if s.closing() {
+		listener.Close()
+	}
 
-	go s.Cron()
+	s.Cron()
 	fmt.Println("Go-redis is ready to accept connections")
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
+			if s.closing() {
+				<-s.stopped
+				return ErrServerClosed
+			}
 			continue
 		}
 		// run as a goroutine
@@ -200,40 +371,245 @@ func (s *server) Start() {
 	}
 }
 
-func populateDb(db *redisDb) {
+// Shutdown gracefully stops the server. It stops accepting connections, waits
+// for running commands and background resizes to commit, stops the crons,
+// closes client connections and closes the pool: it is marked cleanly closed
+// so that the next start can skip the recovery walk, and nothing writes to it
+// afterwards. The go-pmem runtime has no call to unmap a pool, the mapping
+// goes away with the process. If ctx expires first, its error is returned
+// and the pool is left marked unclean.
+func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.stopOnce.Do(func() { close(s.stopped) })
+	s.quitOnce.Do(func() {
+		close(s.quit)
+		s.mu.Lock()
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.mu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		// Commands and resizes started after quit was closed return without
+		// running, so this only waits for the ones already in flight.
+		s.inflight.Lock()
+		s.inflight.Unlock()
+		s.crons.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	if s.root != nil {
+		txn("undo") {
+			s.root.clean = true
+		}
+	}
+	fmt.Println("Go-redis is shut down")
+	return nil
+}
+
+// LastRunClean reports whether the previous run ended with Shutdown. It is
+// only meaningful once Start has opened the pool.
+func (s *Server) LastRunClean() bool {
+	return s.lastRunClean
+}
+
+func (s *Server) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) populateDb(db *redisDb) {
 	txn("undo") {
-		db.dict = NewDict(1024, 32)
-		db.expire = NewDict(128, 1)
-		db.magic = MAGIC
+		db.dict = NewDict(s.cfg.DictInitSize, s.cfg.DictBucketPerShard)
+		db.expire = NewDict(s.cfg.ExpireInitSize, s.cfg.ExpireBucketPerShard)
 	}
 }
 
-func (s *server) init(path string) {
+// growDbs adds empty databases to root until it holds as many as configured.
+// Databases beyond the configured number are kept but not served.
+func (s *Server) growDbs(root *redisRoot) {
+	if len(root.dbs) >= s.cfg.Databases {
+		return
+	}
+	txn("undo") {
+		dbs := pmake([]*redisDb, s.cfg.Databases)
+		for i := range dbs {
+			if i < len(root.dbs) {
+				dbs[i] = root.dbs[i]
+			} else {
+				dbs[i] = pnew(redisDb)
+				s.populateDb(dbs[i])
+			}
+		}
+		root.dbs = dbs
+	}
+}
+
+func (s *Server) init(path string) {
+	fatalError(preallocPool(path, s.cfg.PoolSize))
 	firstInit := pmem.Init(path)
 
-	if firstInit { // indicates a first time initialization
-		var dbr *redisDb
-		db := (*redisDb)(pmem.New("dbRoot", dbr))
-		populateDb(db)
-		s.db = db
+	var root *redisRoot
+	if !firstInit {
+		root = (*redisRoot)(pmem.Get("redisRoot", root))
+	}
+	if root == nil {
+		root = (*redisRoot)(pmem.New("redisRoot", root))
+	}
+	if root.magic == MAGIC && root.version != POOL_VERSION {
+		fatalError(fmt.Errorf("pool %s has layout version %d, this server only opens version %d",
+			path, root.version, POOL_VERSION))
+	}
+	var (
+		legacy *legacyRoot
+		hr     *hashRoot
+	)
+	if !firstInit {
+		legacy = (*legacyRoot)(pmem.Get("dbRoot", legacy))
+		hr = (*hashRoot)(pmem.Get("hashRoot", hr))
+	}
+	if hr == nil {
+		hr = (*hashRoot)(pmem.New("hashRoot", hr))
+	}
+	if hr.seed == [2]uint64{} {
+		// A new pool, or one written before the hash was seeded, whose
+		// databases have to be migrated from dumbhash.
+		seed := newHashSeed()
+		txn("undo") {
+			hr.seed = seed
+			hr.legacy = root.magic == MAGIC || (legacy != nil && legacy.magic == MAGIC)
+		}
+	}
+	hashSeed = hr.seed
+	if hr.legacy {
+		atomic.StoreInt32(&legacyHash, 1)
+	}
+	s.hashRoot = hr
+	if root.magic != MAGIC {
+		// First initialization, or the previous one did not complete
+		// successfully. Populate the databases from scratch, or from the
+		// database of a pool of the first layout.
+		var db0 *redisDb
+		if legacy != nil && legacy.magic == MAGIC {
+			start := time.Now()
+			db0 = s.convertLegacyDb(legacy)
+			fmt.Println("Converted the database of the first pool layout in", time.Since(start))
+		}
+		// The new databases are unreachable until this transaction
+		// publishes them, and the old ones are only dropped by it.
+		txn("undo") {
+			root.dbs = nil
+			if db0 != nil {
+				root.dbs = pmake([]*redisDb, 1)
+				root.dbs[0] = db0
+			}
+			s.growDbs(root)
+			if legacy != nil {
+				legacy.dict = nil
+				legacy.expire = nil
+				legacy.magic = 0
+			}
+			root.version = POOL_VERSION
+			root.magic = MAGIC
+		}
 	} else {
-		var dbr *redisDb
-		db := (*redisDb)(pmem.Get("dbRoot", dbr))
-		if db.magic != MAGIC {
-			// Previous initialization did not complete successfully. Re-populate
-			// data members in db.
-			populateDb(db)
-		}
-		s.db = db
 		txn("undo") {
-			s.db.swizzle()
+			root.gen++
+		}
+		// the versions of this run are above the ones kept in the pool,
+		// 2^40 modifications per run before they reach the next run's.
+		atomic.StoreUint64(&lastVersion, uint64(root.gen)<<40)
+		s.lastRunClean = root.clean
+		if s.lastRunClean {
+			// Nothing was in flight when the pool was closed, so only the
+			// volatile locks need rebuilding.
+			fmt.Println("Previous run shut down cleanly, skipping recovery")
+			for _, db := range root.dbs {
+				txn("undo") {
+					db.swizzleLocks()
+				}
+			}
+		} else {
+			start := time.Now()
+			for _, db := range root.dbs {
+				txn("undo") {
+					db.swizzle()
+				}
+			}
+			s.stats.recoveryTime = time.Since(start)
+			fmt.Println("Recovered the databases in", s.stats.recoveryTime)
+		}
+		txn("undo") {
+			root.clean = false
 		}
+		s.growDbs(root)
+	}
+	s.root = root
+	s.dbs = root.dbs[:s.cfg.Databases]
+	for i, db := range s.dbs {
+		s.initDb(i, db)
+	}
+	if s.cfg.MaxMemory > 0 {
+		start := time.Now()
+		for _, db := range s.dbs {
+			db.computeUsage()
+		}
+		fmt.Println("Estimated the memory used by the keys in", time.Since(start))
 	}
 	s.populateCommandTable()
 	createSharedObjects()
 }
 
-func (s *server) populateCommandTable() {
+// initDb sets the volatile fields of the database at index i.
+func (s *Server) initDb(i int, db *redisDb) {
+	txn("undo") {
+		db.id = int32(i)
+		db.expired = newExpireQueue()
+		db.metas = new(sync.Map)
+		db.used = 0
+		db.overhead = 0
+		db.cfg = &s.cfg
+		db.stats = &s.stats
+		db.notify = func(class int, event string, key []byte) {
+			s.notifyKeyspaceEvent(class, event, key, int(atomic.LoadInt32(&db.id)))
+		}
+	}
+}
+
+// preallocPool creates a pool file of the given size if none exists yet, so
+// that an undersized device is reported at startup.
+func preallocPool(path string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
+
+func (s *Server) populateCommandTable() {
 	s.commands = make(map[string](*redisCommand))
 	for i, v := range redisCommandTable {
 		s.commands[v.name] = &redisCommandTable[i]
@@ -248,79 +624,158 @@ func createSharedObjects() {
 		cnegone:        []byte(":-1\r\n"),
 		ok:             []byte("+OK\r\n"),
 		nullbulk:       []byte("$-1\r\n"),
+		nullmultibulk:  []byte("*-1\r\n"),
 		emptybulk:      []byte("$0\r\n\r\n"),
 		emptymultibulk: []byte("*0\r\n"),
+		emptyscan:      []byte("*2\r\n$1\r\n0\r\n*0\r\n"),
 		pong:           []byte("+PONG\r\n"),
+		null:           []byte("_\r\n"),
+		ctrue:          []byte("#t\r\n"),
+		cfalse:         []byte("#f\r\n"),
 		syntaxerr:      []byte("-ERR syntax error\r\n"),
 		wrongtypeerr:   []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"),
 		outofrangeerr:  []byte("-ERR index out of range\r\n"),
 		nokeyerr:       []byte("-ERR no such key\r\n"),
+		execaborterr:   []byte("-EXECABORT Transaction discarded because of previous errors.\r\n"),
+		oomerr:         []byte("-OOM command not allowed when used memory > 'maxmemory'.\r\n"),
+		queued:         []byte("+QUEUED\r\n"),
 		bulkhead:       []byte("$"),
 		inthead:        []byte(":"),
 		arrayhead:      []byte("*"),
+		maphead:        []byte("%"),
+		sethead:        []byte("~"),
+		doublehead:     []byte(","),
+		pushhead:       []byte(">"),
 		maxstring:      []byte("maxstring"),
 		minstring:      []byte("minstring")}
 }
 
-func (s *server) Cron() {
-	go s.db.Cron()
+// Cron starts the background goroutines of every database.
+func (s *Server) Cron() {
+	for _, db := range s.dbs {
+		db.Cron(s.cfg.RehashInterval, s.cfg.ExpireInterval, s.quit, &s.crons)
+	}
+	if s.hashRoot != nil && s.hashRoot.legacy {
+		s.crons.Add(1)
+		go s.migrateHash()
+	}
+}
+
+// migrateHash moves the entries of a pool written before the hash was seeded
+// to their seeded buckets while clients are served, and marks the pool as
+// migrated once done. A shutdown interrupts it, the next start resumes it.
+func (s *Server) migrateHash() {
+	defer s.crons.Done()
+	fmt.Println("Migrating the databases to the seeded hash")
+	// SWAPDB reorders root.dbs while it runs exclusively.
+	s.inflight.RLock()
+	dbs := append([]*redisDb(nil), s.root.dbs...)
+	s.inflight.RUnlock()
+	for _, db := range dbs {
+		if !db.expire.migrateHash(nil, s.quit) || !db.dict.migrateHash(migrateValue, s.quit) {
+			return
+		}
+	}
+	txn("undo") {
+		s.hashRoot.legacy = false
+	}
+	atomic.StoreInt32(&legacyHash, 0)
+	fmt.Println("Migrated the databases to the seeded hash")
 }
 
-func (s *server) handleClient(conn *net.TCPConn) {
+func (s *Server) handleClient(conn *net.TCPConn) {
 	c := s.newClient(conn)
 	c.conn.SetNoDelay(false) // try batching packet to improve tp.
+	atomic.AddInt64(&s.stats.numConnections, 1)
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+	written := make(chan struct{})
+	go c.writeOutput(written)
 	c.processInput()
+	c.out.close()
+	<-written // the last replies still go out
 	conn.Close()
+	c.unblock()
+	c.unsubscribeAll(false)
+	c.punsubscribeAll(false)
+	s.mu.Lock()
+	delete(s.clients, c)
+	s.mu.Unlock()
 }
 
-func (s *server) newClient(conn *net.TCPConn) *client {
+func (s *Server) newClient(conn *net.TCPConn) *client {
 	return &client{s: s,
-		db:           s.db,
 		conn:         conn,
 		rBuffer:      bufio.NewReader(conn),
-		wBuffer:      bufio.NewWriter(conn),
+		wBuffer:      new(bytes.Buffer),
+		out:          newOutQueue(),
 		argc:         0,
 		argv:         nil,
 		querybuf:     make([]byte, 1024),
 		multibulklen: 0,
 		bulklen:      -1,
 		replybuf:     nil,
-		cmd:          nil}
+		id:           atomic.AddInt64(&nextClientId, 1),
+		resp:         2,
+		cmd:          nil,
+		channels:     make(map[string]struct{}),
+		patterns:     make(map[string]struct{})}
 }
 
 // Process input buffer and call command.
 func (c *client) processInput() {
+	err := c.readQueries(c.conn)
+	if perr, ok := err.(protocolError); ok {
+		fmt.Println("Protocol error from client", c.conn.RemoteAddr(), ":", perr)
+		c.addReplyError([]byte(perr.Error()))
+		c.flush()
+	} else if err == io.EOF {
+		fmt.Println("Client closed connection")
+	} else if err != nil && err != ErrServerClosed {
+		fmt.Println("Reading from client:", err)
+	}
+}
+
+// readQueries reads queries from r and runs them until reading fails, the
+// client sends a malformed query or the server shuts down. The returned error
+// tells which one happened.
+func (c *client) readQueries(r io.Reader) error {
 	pos := 0        // current buffer pos for network reading
 	curr := 0       // curr pos of processing
 	finish := false // finish processing a query
 	for {
-		n, err := c.conn.Read(c.querybuf[pos:])
-		if err != nil { // TODO: check error
-			fmt.Println("Reading from client:", err)
-			return
+		n, err := r.Read(c.querybuf[pos:])
+		if err != nil {
+			return err
 		}
 		if n == 0 {
-			fmt.Println("Client closed connection")
-			return
+			return io.EOF
 		}
 
 		//fmt.Printf("%d, %d, %d, %q\n", pos, curr, n, string(c.querybuf[pos:pos+n]))
 		pos += n
 		//fmt.Println("Input buffer ", pos, n, len(c.querybuf), curr)
 
-		// process multi bulk buffer
-		curr, finish = c.processMultibulkBuffer(curr, pos)
+		// process query buffer
+		curr, finish, err = c.processQueryBuffer(curr, pos)
 		for finish {
 			// Get one full query
 			if c.argc > 0 {
 				//fmt.Println("Process command")
-				c.processCommand()
+				if !c.processCommand() {
+					return ErrServerClosed
+				}
 			}
 			c.reset()
-			curr, finish = c.processMultibulkBuffer(curr, pos)
+			curr, finish, err = c.processQueryBuffer(curr, pos)
+		}
+		if err != nil {
+			return err
 		}
 
-		// expand query buffer if full. TODO: set max query buffer length.
+		// expand query buffer if full. Its length is bounded by the multibulk
+		// and bulk length limits checked by the parser.
 		if pos == len(c.querybuf) {
 			nBuf := make([]byte, len(c.querybuf)*2)
 			copy(nBuf, c.querybuf[curr:pos])
@@ -332,28 +787,79 @@ func (c *client) processInput() {
 			pos = 0
 			curr = 0
 		}
-		c.wBuffer.Flush()
+		c.flush()
 	}
 }
 
+// protocolError is returned by the query parser for malformed input. The
+// client gets it as an error reply and is disconnected.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// Parse the next query with the parser its first byte asks for: RESP arrays
+// start with '*', anything else is an inline command.
+func (c *client) processQueryBuffer(begin, end int) (int, bool, error) {
+	if c.multibulklen == 0 && begin < end && c.querybuf[begin] != '*' {
+		return c.processInlineBuffer(begin, end)
+	}
+	return c.processMultibulkBuffer(begin, end)
+}
+
+// Process inline command of space separated arguments, e.g., "LLEN mylist\r\n",
+// as sent by telnet sessions and simple health checks.
+func (c *client) processInlineBuffer(begin, end int) (int, bool, error) {
+	newline := -1
+	for i, b := range c.querybuf[begin:end] {
+		if b == '\n' {
+			newline = i
+			break
+		}
+	}
+	if newline == -1 {
+		if end-begin > PROTO_INLINE_MAX_SIZE {
+			return begin, false, protocolError("too big inline request")
+		}
+		return begin, false, nil
+	}
+	line := c.querybuf[begin : begin+newline]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	argv, ok := splitArgs(line)
+	if !ok {
+		return begin, false, protocolError("unbalanced quotes in request")
+	}
+	// splitArgs copies the arguments, so the query buffer can be reused.
+	c.argc = len(argv)
+	c.argv = append(c.argv, argv...)
+	return begin + newline + 1, true, nil
+}
+
 // Process RESP array of bulk strings, e.g., "*2\r\n$4\r\nLLEN\r\n$6\r\nmylist\r\n"
-func (c *client) processMultibulkBuffer(begin, end int) (int, bool) {
+func (c *client) processMultibulkBuffer(begin, end int) (int, bool, error) {
 	newline := -1
 	if c.multibulklen == 0 {
 		newline = findNewLine(c.querybuf[begin:end])
 		if newline == -1 {
-			return begin, false
+			if end-begin > PROTO_INLINE_MAX_SIZE {
+				return begin, false, protocolError("too big mbulk count string")
+			}
+			return begin, false, nil
 		}
 		if c.querybuf[begin] != '*' {
-			fmt.Println("Protocal error! expected '*' for multibulk len ", begin, string(c.querybuf[begin:]))
-			os.Exit(1)
+			return begin, false, protocolError(fmt.Sprintf("expected '*', got '%c'", c.querybuf[begin]))
 		}
-		// has to exclude '*'/'\r' with +1/-1
-		size, err := slice2i(c.querybuf[begin+1 : begin+newline-1])
-		fatalError(err)
-		begin += newline + 1
+		// has to exclude '*' with +1
+		size, err := slice2i(c.querybuf[begin+1 : begin+newline])
+		if err != nil || size > PROTO_MAX_MULTIBULK_LEN {
+			return begin, false, protocolError("invalid multibulk length")
+		}
+		begin += newline + 2
 		if size <= 0 {
-			return begin, true
+			return begin, true, nil
 		}
 		c.multibulklen = size
 	}
@@ -362,23 +868,27 @@ func (c *client) processMultibulkBuffer(begin, end int) (int, bool) {
 		if c.bulklen == -1 {
 			newline = findNewLine(c.querybuf[begin:end])
 			if newline == -1 {
-				return begin, false
+				if end-begin > PROTO_INLINE_MAX_SIZE {
+					return begin, false, protocolError("too big bulk count string")
+				}
+				return begin, false, nil
 			}
 			if c.querybuf[begin] != '$' {
-				fmt.Println("Protocal error! expected '$' for bulk len ", begin, string(c.querybuf[begin:]))
-				os.Exit(1)
+				return begin, false, protocolError(fmt.Sprintf("expected '$', got '%c'", c.querybuf[begin]))
+			}
+			// has to exclude '$' with +1
+			size, err := slice2i(c.querybuf[begin+1 : begin+newline])
+			if err != nil || size < 0 || int64(size) > c.s.cfg.ProtoMaxBulkLen {
+				return begin, false, protocolError("invalid bulk length")
 			}
-			// has to exclude '$'/'\r' with +1/-1
-			size, err := slice2i(c.querybuf[begin+1 : begin+newline-1])
-			fatalError(err)
 			c.bulklen = size
-			begin += newline + 1
+			begin += newline + 2
 		}
 
 		// read bulk argument
 		if end-begin < c.bulklen+2 {
 			// not enough data (+2 == trailing \r\n)
-			return begin, false
+			return begin, false, nil
 		} else {
 			arg := make([]byte, c.bulklen)
 			copy(arg, c.querybuf[begin:])
@@ -390,13 +900,13 @@ func (c *client) processMultibulkBuffer(begin, end int) (int, bool) {
 		}
 	}
 	// successuflly process the whole mutlibulk query if reach here
-	return begin, true
+	return begin, true, nil
 }
 
-// Return index of newline in slice, -1 if not found
+// Return index of "\r\n" in slice, -1 if not found
 func findNewLine(buf []byte) int {
-	for i, c := range buf[:] {
-		if c == '\n' {
+	for i := 0; i+1 < len(buf); i++ {
+		if buf[i] == '\r' && buf[i+1] == '\n' {
 			return i
 		}
 	}
@@ -414,20 +924,122 @@ func (c *client) reset() {
 	c.bulklen = -1
 }
 
-// currenlty only support simple SET/GET that is used by memtierbenchmark
-func (c *client) processCommand() {
+// currenlty only support simple SET/GET that is used by memtierbenchmark.
+// Returns false if the server is shutting down and the command was not run.
+func (c *client) processCommand() bool {
 	c.lookupCommand()
 	if c.cmd == nil {
+		c.flagTransaction()
 		c.notSupported()
+		return true
+	}
+	if !c.cmd.checkArity(c.argc) {
+		c.flagTransaction()
+		c.addReplyError([]byte(fmt.Sprintf("wrong number of arguments for '%s' command",
+			strings.ToLower(c.cmd.name))))
+		return true
+	}
+	if c.resp == 2 && c.subscriptionCount() > 0 && !c.cmd.allowedInSubscribe() {
+		c.subscribeModeError()
+		return true
+	}
+	if c.cmd.flag&CMD_DENYOOM != 0 && !c.freeMemoryIfNeeded() {
+		c.flagTransaction()
+		c.addReply(shared.oomerr)
+		return true
+	}
+	if c.multi && c.cmd.queueable() {
+		c.queueMultiCommand()
+		return true
+	}
+	// c.printCommand()
+	if !c.callInflight() {
+		return false
+	}
+	// A blocked client runs its command again each time it is woken, until
+	// the command is served or times out.
+	for c.bstate != nil {
+		if !c.waitForKeys() {
+			return false
+		}
+		if c.bstate != nil && !c.callInflight() {
+			return false
+		}
+	}
+	return true
+}
+
+// callInflight runs the command on the selected db unless the server is
+// shutting down.
+func (c *client) callInflight() bool {
+	if c.exclusive() {
+		c.s.inflight.Lock()
+		defer c.s.inflight.Unlock()
 	} else {
-		// c.printCommand()
-		txn ("undo") {
-		c.cmd.proc(c)
-		// TODO: mohitv remove below...used for crash
-		//fmt.Println("going to sleep before committing tx, crash now")
-		//time.Sleep(2 * time.Second)
-		//fmt.Println("oops...woke up!")
+		c.s.inflight.RLock()
+		defer c.s.inflight.RUnlock()
+	}
+	if c.s.closing() {
+		return false
+	}
+	c.db = c.s.dbs[c.dbid]
+	c.call()
+	return true
+}
+
+// exclusive reports whether the command, or a command queued for EXEC, has
+// to run while no other command does. SWAPDB does, since commands resolve
+// their db by index before taking any lock.
+func (c *client) exclusive() bool {
+	if c.cmd.flag&CMD_EXCLUSIVE != 0 {
+		return true
+	}
+	if c.cmd.name == "EXEC" {
+		for _, mc := range c.mstate {
+			if mc.cmd.flag&CMD_EXCLUSIVE != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// call runs the command handler in one undo transaction. The txn blocks of
+// the handler nest in it, so a panic in the handler aborts them all: their
+// pmem updates are rolled back and the locks they took are released, see
+// TestCallPanic. The client then gets an error instead of the partial reply,
+// and the server keeps serving.
+func (c *client) call() {
+	mark := c.wBuffer.Len()
+	tx := transaction.NewUndo()
+	tx.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Abort()
+			transaction.Release(tx)
+			fmt.Printf("Panic in command %s: %v\n%s", c.cmd.name, r, debug.Stack())
+			c.replybuf = nil
+			c.readyKeys = nil
+			c.events = nil
+			c.unblock()
+			c.wBuffer.Truncate(mark)
+			c.addReplyError([]byte("internal error"))
 		}
+	}()
+	c.cmd.proc(c)
+	atomic.AddInt64(&c.s.stats.numCommands, 1)
+	// TODO: mohitv remove below...used for crash
+	//fmt.Println("going to sleep before committing tx, crash now")
+	//time.Sleep(2 * time.Second)
+	//fmt.Println("oops...woke up!")
+	tx.End()
+	transaction.Release(tx)
+	if len(c.events) > 0 {
+		c.publishEvents()
+	}
+	if len(c.readyKeys) > 0 {
+		c.s.blocking.wakeReady(c.readyKeys)
+		c.readyKeys = nil
 	}
 }
 
@@ -449,62 +1061,267 @@ func (c *client) notSupported() {
 	}
 	fmt.Print("\n")
 	c.addReply(shared.syntaxerr)
-	c.wBuffer.Flush()
+	c.flush()
 }
 
-func (c *client) addReply(s []byte) {
-	c.wBuffer.Write(s)
+// flush hands the buffered replies to the writer goroutine of the client,
+// waiting while its queue is over CLIENT_OUTPUT_LIMIT. Clients without a
+// connection, like fake clients in redis, keep them buffered.
+func (c *client) flush() {
+	if c.conn != nil && c.wBuffer.Len() > 0 {
+		b := make([]byte, c.wBuffer.Len())
+		copy(b, c.wBuffer.Bytes())
+		c.wBuffer.Reset()
+		c.out.push(b, CLIENT_OUTPUT_LIMIT, true)
+	}
 }
 
-func (c *client) addReplyBulk(s []byte) {
+// pushMessage sends a push reply of bulk strings from another goroutine, e.g.,
+// a message published by another client. It goes out between two flushes, so
+// it never splits the replies of c. It never waits for the connection of c, a
+// client too slow to take its messages is disconnected instead.
+func (c *client) pushMessage(parts ...[]byte) {
+	c.wmu.Lock()
+	msg := encodePush(c.resp, parts...)
+	if c.conn == nil {
+		c.wBuffer.Write(msg)
+		c.wmu.Unlock()
+		return
+	}
+	c.wmu.Unlock()
+	if !c.out.push(msg, CLIENT_OUTPUT_LIMIT, false) && c.out.close() {
+		fmt.Println("Client", c.conn.RemoteAddr(), "closed for overcoming of output buffer limits.")
+		c.conn.Close()
+	}
+}
+
+// writeOutput writes the output queued for c to its connection until the queue
+// is closed and drained, then closes done. A failed write closes the
+// connection, so the reading goroutine of c stops too.
+func (c *client) writeOutput(done chan<- struct{}) {
+	defer close(done)
+	for {
+		bufs := c.out.take()
+		if bufs == nil {
+			return
+		}
+		if _, err := bufs.WriteTo(c.conn); err != nil {
+			c.out.close()
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// outQueue holds the output of a connected client until its writer goroutine
+// sends it, so that nobody but that goroutine ever waits for the connection.
+type outQueue struct {
+	mu      sync.Mutex
+	cond    sync.Cond // signaled when bufs grows, shrinks or the queue closes
+	bufs    net.Buffers
+	pending int // bytes in bufs
+	closed  bool
+}
+
+func newOutQueue() *outQueue {
+	q := new(outQueue)
+	q.cond.L = &q.mu
+	return q
+}
+
+// push queues b unless the queue is closed. Over limit, it waits for the
+// writer if wait is set and fails otherwise.
+func (q *outQueue) push(b []byte, limit int, wait bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for wait && !q.closed && q.pending > limit {
+		q.cond.Wait()
+	}
+	if q.closed || q.pending+len(b) > limit && !wait {
+		return false
+	}
+	q.bufs = append(q.bufs, b)
+	q.pending += len(b)
+	q.cond.Broadcast()
+	return true
+}
+
+// take waits for queued output and removes all of it. It returns nil once the
+// queue is closed and empty.
+func (q *outQueue) take() net.Buffers {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.bufs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	bufs := q.bufs
+	q.bufs = nil
+	q.pending = 0
+	q.cond.Broadcast()
+	return bufs
+}
+
+// close stops the queue from taking more output, and reports whether it was
+// still open. Output queued before is still taken.
+func (q *outQueue) close() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	return true
+}
+
+// write buffers encoded reply bytes for the client, or holds them back while a
+// deferred length is pending.
+func (c *client) write(b []byte) {
 	if c.replybuf == nil {
-		c.wBuffer.Write(shared.bulkhead)
-		c.wBuffer.Write([]byte(strconv.Itoa(len(s)))) // not efficient
-		c.wBuffer.Write(shared.crlf)
-		c.wBuffer.Write(s)
-		c.wBuffer.Write(shared.crlf)
+		c.wBuffer.Write(b)
 	} else {
-		c.replybuf = append(c.replybuf, s)
+		c.replybuf.Write(b)
 	}
 }
 
+func (c *client) addReply(s []byte) {
+	c.write(s)
+}
+
+func (c *client) addReplyBulk(s []byte) {
+	c.write(shared.bulkhead)
+	c.write([]byte(strconv.Itoa(len(s)))) // not efficient
+	c.write(shared.crlf)
+	c.write(s)
+	c.write(shared.crlf)
+}
+
 func (c *client) addReplyLongLong(ll int64) {
-	c.wBuffer.Write(shared.inthead)
-	c.wBuffer.Write([]byte(strconv.FormatInt(ll, 10))) // not efficient
-	c.wBuffer.Write(shared.crlf)
+	c.write(shared.inthead)
+	c.write([]byte(strconv.FormatInt(ll, 10))) // not efficient
+	c.write(shared.crlf)
 }
 
+// addReplyDouble replies a RESP3 double, or a bulk string in RESP2.
 func (c *client) addReplyDouble(d float64) {
 	s := strconv.FormatFloat(d, 'g', -1, 64)
-	c.addReplyBulk([]byte(s))
+	if c.resp == 2 {
+		c.addReplyBulk([]byte(s))
+		return
+	}
+	switch {
+	case math.IsInf(d, 1):
+		s = "inf"
+	case math.IsInf(d, -1):
+		s = "-inf"
+	case math.IsNaN(d):
+		s = "nan"
+	}
+	c.write(shared.doublehead)
+	c.write([]byte(s))
+	c.write(shared.crlf)
+}
+
+// addReplyNull replies a RESP3 null, or a null bulk string in RESP2.
+func (c *client) addReplyNull() {
+	if c.resp == 2 {
+		c.write(shared.nullbulk)
+	} else {
+		c.write(shared.null)
+	}
+}
+
+// addReplyNullArray replies a RESP3 null, or a null array in RESP2.
+func (c *client) addReplyNullArray() {
+	if c.resp == 2 {
+		c.write(shared.nullmultibulk)
+	} else {
+		c.write(shared.null)
+	}
+}
+
+// addReplyBool replies a RESP3 boolean, or the integer 1 or 0 in RESP2.
+func (c *client) addReplyBool(b bool) {
+	if c.resp == 2 {
+		if b {
+			c.write(shared.cone)
+		} else {
+			c.write(shared.czero)
+		}
+	} else if b {
+		c.write(shared.ctrue)
+	} else {
+		c.write(shared.cfalse)
+	}
+}
+
+func (c *client) addReplyAggregateLen(ll int, head []byte) {
+	c.write(head)
+	c.write([]byte(strconv.Itoa(ll))) // not efficient
+	c.write(shared.crlf)
 }
 
 func (c *client) addReplyMultiBulkLen(ll int) {
-	c.wBuffer.Write(shared.arrayhead)
-	c.wBuffer.Write([]byte(strconv.Itoa(ll))) // not efficient
-	c.wBuffer.Write(shared.crlf)
+	c.addReplyAggregateLen(ll, shared.arrayhead)
 }
 
+// addReplyMapLen starts a map of ll key/value pairs. RESP2 clients get a flat
+// array of 2*ll elements instead.
+func (c *client) addReplyMapLen(ll int) {
+	if c.resp == 2 {
+		c.addReplyAggregateLen(ll*2, shared.arrayhead)
+	} else {
+		c.addReplyAggregateLen(ll, shared.maphead)
+	}
+}
+
+// addReplyPushLen starts a push reply of ll elements, an array in RESP2.
+func (c *client) addReplyPushLen(ll int) {
+	if c.resp == 2 {
+		c.addReplyAggregateLen(ll, shared.arrayhead)
+	} else {
+		c.addReplyAggregateLen(ll, shared.pushhead)
+	}
+}
+
+// addReplySetLen starts a set of ll elements, an array in RESP2.
+func (c *client) addReplySetLen(ll int) {
+	if c.resp == 2 {
+		c.addReplyAggregateLen(ll, shared.arrayhead)
+	} else {
+		c.addReplyAggregateLen(ll, shared.sethead)
+	}
+}
+
+// addDeferredMultiBulkLength holds back the following replies until their
+// count is known and set with setDeferredMultiBulkLength or setDeferredSetLen.
 func (c *client) addDeferredMultiBulkLength() {
-	c.replybuf = make([][]byte, 1)
+	c.replybuf = new(bytes.Buffer)
 }
 
 func (c *client) setDeferredMultiBulkLength(ll int) {
-	replies := c.replybuf[1:]
+	c.setDeferredAggregateLen(ll, c.addReplyMultiBulkLen)
+}
+
+func (c *client) setDeferredSetLen(ll int) {
+	c.setDeferredAggregateLen(ll, c.addReplySetLen)
+}
+
+func (c *client) setDeferredAggregateLen(ll int, addLen func(int)) {
+	replies := c.replybuf
 	c.replybuf = nil
-	if ll != len(replies) {
-		panic("setDeferredMultiBulkLength: length does not match!")
-	}
-	c.addReplyMultiBulkLen(ll)
-	for _, r := range replies {
-		c.addReplyBulk(r)
-	}
+	addLen(ll)
+	c.write(replies.Bytes())
+}
+
+func (c *client) addReplyStatus(status string) {
+	c.write([]byte("+" + status + "\r\n"))
 }
 
 func (c *client) addReplyError(err []byte) {
-	c.wBuffer.Write([]byte("-ERR "))
-	c.wBuffer.Write(err)
-	c.wBuffer.Write(shared.crlf)
+	c.write([]byte("-ERR "))
+	c.write(err)
+	c.write(shared.crlf)
 }
 
 func (c *client) cleanup() {
@@ -513,13 +1330,13 @@ func (c *client) cleanup() {
 
 func fatalError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Fatal error: %s", err.Error())
+		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
 		os.Exit(1)
 	}
 }
 
 func getClient() net.Conn {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", PORT)
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", DefaultConfig().Addr)
 	fatalError(err)
 
 	conn, err := net.DialTCP("tcp", nil, tcpAddr)
@@ -529,9 +1346,98 @@ func getClient() net.Conn {
 }
 
 func pingCommand(c *client) {
+	if c.argc > 2 {
+		c.addReplyError([]byte("wrong number of arguments for 'ping' command"))
+		return
+	}
+	// Subscribed RESP2 clients can only parse arrays.
+	if c.resp == 2 && c.subscriptionCount() > 0 {
+		c.addReplyMultiBulkLen(2)
+		c.addReplyBulk([]byte("pong"))
+		if c.argc == 1 {
+			c.addReplyBulk(nil)
+		} else {
+			c.addReplyBulk(c.argv[1])
+		}
+		return
+	}
 	if c.argc == 1 {
 		c.addReply(shared.pong)
 	} else {
 		c.addReply(c.argv[1])
 	}
 }
+
+func shutdownCommand(c *client) {
+	// Every write is durable once its command returns, so SAVE and NOSAVE
+	// behave the same.
+	if c.argc > 2 || (c.argc == 2 && !bytes.EqualFold(c.argv[1], []byte("save")) &&
+		!bytes.EqualFold(c.argv[1], []byte("nosave"))) {
+		c.addReply(shared.syntaxerr)
+		return
+	}
+	// Shutdown waits for this command to commit, so it cannot run inline. Like
+	// redis, nothing is replied; the connection is simply closed.
+	go c.s.Shutdown(context.Background())
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *client) {
+	ver := c.resp
+	if c.argc >= 2 {
+		v, err := slice2i(c.argv[1])
+		if err != nil {
+			c.addReplyError([]byte("Protocol version is not an integer or out of range"))
+			return
+		}
+		if v < 2 || v > 3 {
+			c.addReply([]byte("-NOPROTO unsupported protocol version\r\n"))
+			return
+		}
+		ver = v
+	}
+
+	var name []byte
+	for j := 2; j < c.argc; j++ {
+		more := c.argc - j - 1
+		if bytes.EqualFold(c.argv[j], []byte("auth")) && more >= 2 {
+			// There are no passwords, so only the default user exists and it
+			// accepts any password.
+			if !bytes.Equal(c.argv[j+1], []byte("default")) {
+				c.addReply([]byte("-WRONGPASS invalid username-password pair\r\n"))
+				return
+			}
+			j += 2
+		} else if bytes.EqualFold(c.argv[j], []byte("setname")) && more >= 1 {
+			name = c.argv[j+1]
+			j++
+		} else {
+			c.addReplyError([]byte(fmt.Sprintf("Syntax error in HELLO option '%s'", c.argv[j])))
+			return
+		}
+	}
+	if name != nil {
+		c.name = name
+	}
+
+	// The reply already uses the new protocol version. Publishers read it
+	// under wmu.
+	c.wmu.Lock()
+	c.resp = ver
+	c.wmu.Unlock()
+	c.addReplyMapLen(7)
+	c.addReplyBulk([]byte("server"))
+	c.addReplyBulk([]byte("redis"))
+	c.addReplyBulk([]byte("version"))
+	c.addReplyBulk([]byte(REDIS_VERSION))
+	c.addReplyBulk([]byte("proto"))
+	c.addReplyLongLong(int64(c.resp))
+	c.addReplyBulk([]byte("id"))
+	c.addReplyLongLong(c.id)
+	c.addReplyBulk([]byte("mode"))
+	c.addReplyBulk([]byte("standalone"))
+	c.addReplyBulk([]byte("role"))
+	c.addReplyBulk([]byte("master"))
+	c.addReplyBulk([]byte("modules"))
+	c.addReplyMultiBulkLen(0)
+}
@@ -0,0 +1,450 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// newParserClient returns a client that is not backed by a connection, so
+// its replies stay in wBuffer. Its server has no commands, so parsed queries
+// are only answered with errors and never touch the database.
+func newParserClient() *client {
+	s := NewServer(DefaultConfig())
+	return s.newClient(nil)
+}
+
+// newTestClient returns a client like newParserClient, whose server has its
+// commands and n empty databases in the test pool, set up like init does.
+func newTestClient(n int) *client {
+	createSharedObjects()
+	s := NewServer(DefaultConfig())
+	s.populateCommandTable()
+	for i := 0; i < n; i++ {
+		db := pnew(redisDb)
+		s.populateDb(db)
+		s.initDb(i, db)
+		s.dbs = append(s.dbs, db)
+	}
+	c := s.newClient(nil)
+	c.db = s.dbs[0]
+	return c
+}
+
+// runCommand runs a query on c and returns its reply.
+func runCommand(c *client, args ...string) string {
+	c.wBuffer.Reset()
+	c.argv = argv(args...)
+	c.argc = len(c.argv)
+	c.processCommand()
+	return c.wBuffer.String()
+}
+
+func TestMultibulkParse(t *testing.T) {
+	fmt.Println("Parse pipelined queries.")
+	c := newParserClient()
+	c.querybuf = []byte("*2\r\n$4\r\nLLEN\r\n$6\r\nmylist\r\n*0\r\n*1\r\n$0\r\n\r\n*1\r\n$3\r\nGE")
+	end := len(c.querybuf)
+	curr, finish, err := c.processMultibulkBuffer(0, end)
+	assertEqual(t, err, nil)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argc, 2)
+	assertEqual(t, c.argv[0], []byte("LLEN"))
+	assertEqual(t, c.argv[1], []byte("mylist"))
+	c.reset()
+	curr, finish, err = c.processMultibulkBuffer(curr, end)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argc, 0)
+	curr, finish, err = c.processMultibulkBuffer(curr, end)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argv[0], []byte{})
+	c.reset()
+	curr, finish, err = c.processMultibulkBuffer(curr, end)
+	assertEqual(t, err, nil)
+	assertEqual(t, finish, false)
+	assertEqual(t, c.multibulklen, 1)
+	assertEqual(t, c.bulklen, 3)
+}
+
+func TestInlineParse(t *testing.T) {
+	fmt.Println("Parse inline queries next to multibulk ones.")
+	c := newParserClient()
+	c.querybuf = []byte("PING\r\n\r\nset 'a b' \"x\\ty\"\n*1\r\n$4\r\nPING\r\nGET a")
+	end := len(c.querybuf)
+	curr, finish, err := c.processQueryBuffer(0, end)
+	assertEqual(t, err, nil)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argc, 1)
+	assertEqual(t, c.argv[0], []byte("PING"))
+	c.reset()
+	curr, finish, err = c.processQueryBuffer(curr, end)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argc, 0)
+	curr, finish, err = c.processQueryBuffer(curr, end)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argc, 3)
+	assertEqual(t, c.argv[1], []byte("a b"))
+	assertEqual(t, c.argv[2], []byte("x\ty"))
+	c.reset()
+	curr, finish, err = c.processQueryBuffer(curr, end)
+	assertEqual(t, finish, true)
+	assertEqual(t, c.argv[0], []byte("PING"))
+	c.reset()
+	curr, finish, err = c.processQueryBuffer(curr, end)
+	assertEqual(t, err, nil)
+	assertEqual(t, finish, false)
+	assertEqual(t, curr, end-5)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	fmt.Println("Reply protocol errors instead of exiting.")
+	cases := map[string]string{
+		"GET \"a\r\n":                           "unbalanced quotes in request",
+		"GET " + string(make([]byte, 70000)):    "too big inline request",
+		"*x\r\n":                                "invalid multibulk length",
+		"*1048577\r\n":                          "invalid multibulk length",
+		"*1\r\n+OK\r\n":                         "expected '$', got '+'",
+		"*1\r\n$-5\r\n":                         "invalid bulk length",
+		"*1\r\n$abc\r\n":                        "invalid bulk length",
+		"*1\r\n$536870913\r\n":                  "invalid bulk length",
+		"*" + string(make([]byte, 70000)):       "too big mbulk count string",
+		"*1\r\n$" + string(make([]byte, 70000)): "too big bulk count string",
+	}
+	for in, msg := range cases {
+		c := newParserClient()
+		err := c.readQueries(bytes.NewReader([]byte(in)))
+		perr, ok := err.(protocolError)
+		assertEqual(t, ok, true)
+		assertEqual(t, perr.Error(), "Protocol error: "+msg)
+	}
+
+	fmt.Println("Wait for more data on incomplete queries.")
+	for _, in := range []string{"*", "*2\r\n$3\r\nGET\r\n", "*1\r\n$10\r\nabc", "*1\r\n$3\r\nabc\r"} {
+		c := newParserClient()
+		assertEqual(t, c.readQueries(bytes.NewReader([]byte(in))), io.EOF)
+	}
+}
+
+// TestProtocolFuzz feeds random and mutated queries to the parser, split into
+// random chunks, and checks that it never panics and only fails with
+// protocol errors.
+func TestProtocolFuzz(t *testing.T) {
+	fmt.Println("Fuzz the query parser.")
+	pieces := []string{"*", "$", "\r\n", "\r", "\n", "-1", "0", "1", "2", "3",
+		"10", "65536", "1048576", "536870912", "9223372036854775808", "GET",
+		"key", " ", "+", ":", "\x00", "\xff", "\"", "'", "\\", "\\x4", "PING\n"}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		var buf bytes.Buffer
+		for j := r.Intn(6); j >= 0; j-- {
+			// start from a valid query, then damage it
+			argc := r.Intn(4)
+			buf.WriteString("*" + strconv.Itoa(argc) + "\r\n")
+			for k := 0; k < argc; k++ {
+				arg := make([]byte, r.Intn(20))
+				r.Read(arg)
+				buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+				buf.Write(arg)
+				buf.WriteString("\r\n")
+			}
+		}
+		in := buf.Bytes()
+		for j := r.Intn(4); j > 0 && len(in) > 0; j-- {
+			p := r.Intn(len(in))
+			switch r.Intn(3) {
+			case 0:
+				in = append(in[:p:p], append([]byte(pieces[r.Intn(len(pieces))]), in[p:]...)...)
+			case 1:
+				in = append(in[:p:p], in[p+1:]...)
+			case 2:
+				in[p] = byte(r.Intn(256))
+			}
+		}
+		var rd io.Reader = bytes.NewReader(in)
+		switch r.Intn(10) {
+		case 0, 1, 2:
+			rd = iotest.OneByteReader(rd)
+		case 3, 4, 5:
+			rd = iotest.HalfReader(rd)
+		case 6:
+			// long lines are rescanned on every read, so read them at once
+			in = make([]byte, r.Intn(100000))
+			r.Read(in)
+			rd = bytes.NewReader(in)
+		}
+		c := newParserClient()
+		c.querybuf = make([]byte, 1+r.Intn(64))
+		func() {
+			defer func() {
+				if p := recover(); p != nil {
+					t.Fatalf("parser panic %v on input %q", p, in)
+				}
+			}()
+			err := c.readQueries(rd)
+			if _, ok := err.(protocolError); !ok && err != io.EOF {
+				t.Fatalf("unexpected error %v on input %q", err, in)
+			}
+		}()
+	}
+}
+
+func TestResp3Replies(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	reply := func() string {
+		s := c.wBuffer.String()
+		c.wBuffer.Reset()
+		return s
+	}
+
+	fmt.Println("Replies default to RESP2.")
+	c.addReplyMapLen(1)
+	c.addReplyBulk([]byte("k"))
+	c.addReplyDouble(1.5)
+	c.addReplyNull()
+	c.addReplyBool(true)
+	assertEqual(t, reply(), "*2\r\n$1\r\nk\r\n$3\r\n1.5\r\n$-1\r\n:1\r\n")
+
+	fmt.Println("HELLO 3 switches the client to RESP3.")
+	c.argv = [][]byte{[]byte("HELLO"), []byte("3"), []byte("SETNAME"), []byte("app")}
+	c.argc = len(c.argv)
+	helloCommand(c)
+	assertEqual(t, c.resp, 3)
+	assertEqual(t, c.name, []byte("app"))
+	assertEqual(t, strings.HasPrefix(reply(), "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n"), true)
+
+	c.addReplyMapLen(1)
+	c.addReplyBulk([]byte("k"))
+	c.addReplyDouble(math.Inf(-1))
+	c.addReplyNull()
+	c.addReplyBool(false)
+	c.addReplySetLen(0)
+	assertEqual(t, reply(), "%1\r\n$1\r\nk\r\n,-inf\r\n_\r\n#f\r\n~0\r\n")
+
+	fmt.Println("Deferred lengths hold back every reply type.")
+	c.addDeferredMultiBulkLength()
+	c.addReplyScoredElement([]byte("a"), 2, true)
+	c.addReplyScoredElement([]byte("b"), 3, true)
+	c.setDeferredMultiBulkLength(2)
+	assertEqual(t, reply(), "*2\r\n*2\r\n$1\r\na\r\n,2\r\n*2\r\n$1\r\nb\r\n,3\r\n")
+
+	fmt.Println("Unsupported protocol versions are refused.")
+	c.argv = [][]byte{[]byte("HELLO"), []byte("4")}
+	c.argc = len(c.argv)
+	helloCommand(c)
+	assertEqual(t, c.resp, 3)
+	assertEqual(t, reply(), "-NOPROTO unsupported protocol version\r\n")
+}
+
+func TestSelectDb(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	c.s.populateCommandTable()
+	c.s.dbs = []*redisDb{{id: 0}, {id: 1}}
+	reply := func() string {
+		s := c.wBuffer.String()
+		c.wBuffer.Reset()
+		return s
+	}
+	query := func(args ...string) {
+		c.argv = argv(args...)
+		c.argc = len(c.argv)
+		c.lookupCommand()
+	}
+
+	fmt.Println("SELECT switches the db of the client.")
+	query("SELECT", "1")
+	selectCommand(c)
+	assertEqual(t, reply(), "+OK\r\n")
+	assertEqual(t, c.dbid, 1)
+	assertEqual(t, c.db == c.s.dbs[1], true)
+	query("SELECT", "2")
+	selectCommand(c)
+	query("SELECT", "x")
+	selectCommand(c)
+	assertEqual(t, reply(), "-ERR DB index is out of range\r\n-ERR invalid DB index\r\n")
+	assertEqual(t, c.dbid, 1)
+
+	fmt.Println("SWAPDB runs while no other command does.")
+	assertEqual(t, c.exclusive(), false)
+	query("SWAPDB", "0", "1")
+	assertEqual(t, c.exclusive(), true)
+	c.mstate = []multiCmd{{c.cmd, c.argv}}
+	query("EXEC")
+	assertEqual(t, c.exclusive(), true)
+
+	fmt.Println("MOVE a key with its expire time and publish move_from and move_to.")
+	c = newTestClient(2)
+	c.s.cfg.Set("notify-keyspace-events", "Eg")
+	sub := c.s.newClient(nil)
+	sub.psubscribe([]byte("__keyevent@*__:move_*"))
+	sub.wBuffer.Reset()
+	runCommand(c, "SET", "k", "v", "EX", "100")
+	assertEqual(t, runCommand(c, "MOVE", "k", "1"), ":1\r\n")
+	assertEqual(t, runCommand(c, "MOVE", "k", "1"), ":0\r\n")
+	assertEqual(t, sub.wBuffer.String(),
+		"*4\r\n$8\r\npmessage\r\n$21\r\n__keyevent@*__:move_*\r\n$24\r\n__keyevent@0__:move_from\r\n$1\r\nk\r\n"+
+			"*4\r\n$8\r\npmessage\r\n$21\r\n__keyevent@*__:move_*\r\n$22\r\n__keyevent@1__:move_to\r\n$1\r\nk\r\n")
+	runCommand(c, "SELECT", "1")
+	assertEqual(t, runCommand(c, "GET", "k"), "$1\r\nv\r\n")
+	assertEqual(t, runCommand(c, "TTL", "k") != ":-1\r\n", true)
+	assertEqual(t, runCommand(c, "MOVE", "k", "1"), "-ERR source and destination objects are the same\r\n")
+}
+
+func TestCallPanic(t *testing.T) {
+	c := newTestClient(1)
+	runCommand(c, "SET", "k", "v1")
+
+	fmt.Println("Roll back the nested transactions of a command that panics.")
+	c.wBuffer.Reset()
+	c.argv = argv("SET", "k", "v2")
+	c.argc = len(c.argv)
+	c.cmd = &redisCommand{name: "SETPANIC", proc: func(c *client) {
+		setCommand(c)
+		panic("after the write")
+	}}
+	c.call()
+	assertEqual(t, c.wBuffer.String(), "-ERR internal error\r\n")
+
+	fmt.Println("Release the key locks taken by the aborted command.")
+	reply := make(chan string)
+	go func() {
+		c2 := c.s.newClient(nil)
+		c2.db = c.s.dbs[0]
+		reply <- runCommand(c2, "GET", "k")
+	}()
+	select {
+	case r := <-reply:
+		assertEqual(t, r, "$2\r\nv1\r\n")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the key is still locked")
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+	createSharedObjects()
+	c := newParserClient()
+	c.s.dbs = []*redisDb{{id: 0}, {id: 1}}
+	c.db = c.s.dbs[0]
+
+	fmt.Println("Name the type of values.")
+	set := &dict{tab: [2]table{{bucket: []*entry{{key: []byte("m")}}}, {mask: -1}}, rehashIdx: -1}
+	hash := &dict{tab: [2]table{{bucket: []*entry{{key: []byte("f"), value: int64(1)}}}, {mask: -1}},
+		rehashIdx: -1}
+	for _, v := range []struct {
+		value interface{}
+		name  string
+	}{
+		{nil, "none"}, {[]byte("v"), "string"}, {int64(1), "string"}, {&quicklist{}, "list"},
+		{set, "set"}, {hash, "hash"}, {&zset{}, "zset"},
+	} {
+		assertEqual(t, typeName(v.value), v.name)
+	}
+
+	fmt.Println("COPY checks its options before looking up keys.")
+	for _, q := range [][]string{
+		{"COPY", "a", "a"},
+		{"COPY", "a", "b", "DB", "2"},
+		{"COPY", "a", "b", "DB"},
+		{"COPY", "a", "b", "NOREPLACE"},
+	} {
+		c.argv = argv(q...)
+		c.argc = len(q)
+		copyCommand(c)
+	}
+	assertEqual(t, c.wBuffer.String(), "-ERR source and destination objects are the same\r\n"+
+		"-ERR DB index is out of range\r\n-ERR syntax error\r\n-ERR syntax error\r\n")
+
+	c = newTestClient(2)
+	value := func(db *redisDb, key string) interface{} {
+		_, _, _, e := db.dict.find([]byte(key))
+		if e == nil {
+			return nil
+		}
+		return e.value
+	}
+	woken := func(c *client) bool {
+		select {
+		case <-c.bstate.ready:
+			c.unblock()
+			return true
+		default:
+			return false
+		}
+	}
+
+	fmt.Println("RENAME moves the value and its expire time.")
+	runCommand(c, "RPUSH", "l", "a", "b")
+	runCommand(c, "EXPIRE", "l", "100")
+	l := value(c.db, "l")
+	assertEqual(t, runCommand(c, "RENAME", "l", "m"), "+OK\r\n")
+	assertEqual(t, value(c.db, "l"), nil)
+	assertEqual(t, value(c.db, "m") == l, true)
+	assertEqual(t, runCommand(c, "TTL", "m"), ":100\r\n")
+	assertEqual(t, runCommand(c, "RENAME", "l", "m"), "-ERR no such key\r\n")
+	runCommand(c, "SET", "k", "v")
+	assertEqual(t, runCommand(c, "RENAME", "k", "m"), "+OK\r\n")
+	assertEqual(t, runCommand(c, "TTL", "m"), ":-1\r\n")
+	assertEqual(t, runCommand(c, "GET", "m"), "$1\r\nv\r\n")
+
+	fmt.Println("RENAMENX keeps an existing destination.")
+	runCommand(c, "SET", "k", "w")
+	assertEqual(t, runCommand(c, "RENAMENX", "k", "m"), ":0\r\n")
+	assertEqual(t, runCommand(c, "GET", "m"), "$1\r\nv\r\n")
+	assertEqual(t, runCommand(c, "RENAMENX", "k", "n"), ":1\r\n")
+	assertEqual(t, runCommand(c, "EXISTS", "k", "n"), ":1\r\n")
+
+	fmt.Println("COPY duplicates values deeply, with their expire time.")
+	runCommand(c, "RPUSH", "l", "a", "b")
+	runCommand(c, "HSET", "h", "f", "v")
+	runCommand(c, "ZADD", "z", "1", "m")
+	runCommand(c, "PEXPIRE", "z", "100000")
+	for _, key := range []string{"l", "h", "z"} {
+		assertEqual(t, runCommand(c, "COPY", key, key+"2"), ":1\r\n")
+		assertEqual(t, value(c.db, key+"2") != value(c.db, key), true)
+	}
+	runCommand(c, "RPUSH", "l", "c")
+	runCommand(c, "HSET", "h", "f", "w")
+	runCommand(c, "ZADD", "z", "2", "m")
+	assertEqual(t, runCommand(c, "LLEN", "l2"), ":2\r\n")
+	assertEqual(t, runCommand(c, "HGET", "h2", "f"), "$1\r\nv\r\n")
+	assertEqual(t, runCommand(c, "ZSCORE", "z2", "m"), "$1\r\n1\r\n")
+	assertEqual(t, runCommand(c, "TTL", "z2"), ":100\r\n")
+	assertEqual(t, runCommand(c, "TTL", "h2"), ":-1\r\n")
+	assertEqual(t, runCommand(c, "COPY", "l", "h2"), ":0\r\n")
+	assertEqual(t, runCommand(c, "COPY", "l", "h2", "REPLACE"), ":1\r\n")
+	assertEqual(t, runCommand(c, "LLEN", "h2"), ":3\r\n")
+	assertEqual(t, runCommand(c, "COPY", "z", "z", "DB", "1"), ":1\r\n")
+	assertEqual(t, value(c.s.dbs[1], "z") != value(c.db, "z"), true)
+	assertEqual(t, c.s.dbs[1].getExpire([]byte("z")), c.db.getExpire([]byte("z")))
+	assertEqual(t, runCommand(c, "COPY", "nokey", "x"), ":0\r\n")
+
+	fmt.Println("Wake the waiters of a list moved to their key.")
+	w0, w1 := c.s.newClient(nil), c.s.newClient(nil)
+	w1.dbid = 1
+	w0.blockForKeys(argv("q"), time.Time{}, (*client).addReplyNullArray)
+	w1.blockForKeys(argv("q"), time.Time{}, (*client).addReplyNullArray)
+	runCommand(c, "RENAME", "h", "q")
+	assertEqual(t, woken(w0), false)
+	runCommand(c, "RENAME", "l", "q")
+	assertEqual(t, woken(w0), true)
+	runCommand(c, "COPY", "q", "q", "DB", "1")
+	assertEqual(t, woken(w1), true)
+
+	fmt.Println("UNLINK deletes like DEL.")
+	assertEqual(t, runCommand(c, "UNLINK", "l", "q", "nokey"), ":1\r\n")
+	assertEqual(t, runCommand(c, "EXISTS", "q"), ":0\r\n")
+	assertEqual(t, runCommand(c, "ZSCORE", "z", "m"), "$1\r\n2\r\n")
+}
@@ -0,0 +1,27 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSiphash(t *testing.T) {
+	fmt.Println("Match the SipHash-2-4 reference vectors.")
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	assertEqual(t, siphash(k0, k1, msg[:0]), uint64(0x726fdb47dd0e0e31))
+	assertEqual(t, siphash(k0, k1, msg[:8]), uint64(0x93f5f5799a932462))
+	assertEqual(t, siphash(k0, k1, msg), uint64(0xa129ca6149be45e5))
+
+	fmt.Println("Spread keys by the seed.")
+	assertEqual(t, siphash(1, 2, []byte("user:1")) != siphash(1, 3, []byte("user:1")), true)
+	assertEqual(t, newHashSeed() != newHashSeed(), true)
+}
@@ -10,6 +10,11 @@ package redis
 // only or will also update the outter hash value). Therefore, there is no extra
 // lock required for field access within the hash value. However, the outter
 // lock also prevents concurrent writes or read/write into the same hash value.
+//
+// Like in redis, a new hash is a ziplist of alternating fields and values.
+// hashTypeSet converts it to a dict once it has more than
+// hash-max-ziplist-entries fields, or a field or value longer than
+// hash-max-ziplist-value. Hashes are never converted back to ziplists.
 
 import (
 	"math"
@@ -20,21 +25,27 @@ import (
 )
 
 type hashTypeIterator struct {
-	subject interface{}
-	di      *dictIterator
-	de      *entry
+	subject    interface{}
+	fpos, vpos int // ziplist offsets of the current field and value
+	di         *dictIterator
+	de         *entry
 }
 
 // ============== hash type commands ====================
 
 func hsetnxCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+	if o == nil {
+		return
+	}
 
 	if hashTypeExists(o, c.argv[2]) {
 		c.addReply(shared.czero)
 	} else {
-		hashTypeSet(c, o, shadowCopyToPmem(c.argv[2]), shadowCopyToPmemI(c.argv[3]))
+		hashTypeSet(c, o, c.argv[2], c.argv[3])
+		c.db.signalModifiedKey(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_HASH, "hset", c.argv[1])
 		c.addReply(shared.cone)
 	}
 }
@@ -45,7 +56,7 @@ func hsetCommand(c *client) {
 		return
 	}
 
-	c.db.lockKeysWrite(c.argv[1:], 2)
+	c.lockKeysWrite(c.argv[1:], 2)
 
 	o := hashTypeLookupWriteOrCreate(c, c.argv[1])
 	if o == nil {
@@ -54,10 +65,14 @@ func hsetCommand(c *client) {
 
 	var created int64
 	for i := 2; i < c.argc; i += 2 {
-		if !hashTypeSet(c, o, shadowCopyToPmem(c.argv[i]), shadowCopyToPmemI(c.argv[i+1])) {
+		var update bool
+		// the hash may be converted to a dict by any of the fields.
+		if o, update = hashTypeSet(c, o, c.argv[i], c.argv[i+1]); !update {
 			created++
 		}
 	}
+	c.db.signalModifiedKey(c.argv[1])
+	c.notifyKeyspaceEvent(NOTIFY_HASH, "hset", c.argv[1])
 
 	cmdname := c.argv[0]
 	if cmdname[1] == 's' || cmdname[1] == 'S' { // HSET
@@ -68,20 +83,20 @@ func hsetCommand(c *client) {
 }
 
 func hgetCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		if o, ok := c.getHashOrReply(c.db.lookupKeyRead(c.argv[1]), nil); ok {
+	if c.lockKeyRead(c.argv[1]) {
+		if o, ok := c.getHashOrReply(c.lookupKeyRead(c.argv[1]), nil); ok {
 			c.addHashFieldToReply(o, c.argv[2])
 		}
 	} else { // expired
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
 	}
 }
 
 func hmgetCommand(c *client) {
 	var o interface{}
 	var ok bool
-	if c.db.lockKeyRead(c.argv[1]) {
-		if o, ok = c.getHashOrReply(c.db.lookupKeyRead(c.argv[1]), nil); !ok {
+	if c.lockKeyRead(c.argv[1]) {
+		if o, ok = c.getHashOrReply(c.lookupKeyRead(c.argv[1]), nil); !ok {
 			return
 		}
 	}
@@ -94,7 +109,7 @@ func hmgetCommand(c *client) {
 func hdelCommand(c *client) {
 	var deleted int64
 	removed := false
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o, ok := c.getHashOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.czero)
 	if ok && o != nil {
 		for i := 2; i < c.argc; i++ {
@@ -108,8 +123,11 @@ func hdelCommand(c *client) {
 			}
 		}
 		if deleted > 0 {
+			c.notifyKeyspaceEvent(NOTIFY_HASH, "hdel", c.argv[1])
 			if removed {
-				// key space event notifications
+				c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+			} else {
+				c.db.signalModifiedKey(c.argv[1])
 			}
 		}
 		c.addReplyLongLong(deleted)
@@ -117,7 +135,7 @@ func hdelCommand(c *client) {
 }
 
 func hlenCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
+	if c.lockKeyRead(c.argv[1]) {
 		o, ok := c.getHashOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.czero)
 		if ok && o != nil {
 			c.addReplyLongLong(int64(hashTypeLength(o)))
@@ -128,8 +146,8 @@ func hlenCommand(c *client) {
 }
 
 func hstrlenCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		o, ok := c.getHashOrReply(c.db.lookupKeyRead(c.argv[1]), shared.czero)
+	if c.lockKeyRead(c.argv[1]) {
+		o, ok := c.getHashOrReply(c.lookupKeyRead(c.argv[1]), shared.czero)
 		if ok && o != nil {
 			c.addReplyLongLong(int64(hashTypeGetValueLength(o, c.argv[2])))
 		}
@@ -151,8 +169,8 @@ func hgetallCommand(c *client) {
 }
 
 func genericHgetallCommand(c *client, getK, getV bool) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		o, ok := c.getHashOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	if c.lockKeyRead(c.argv[1]) {
+		o, ok := c.getHashOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 		if ok && o != nil {
 			multiplier := 0
 			if getK {
@@ -161,8 +179,12 @@ func genericHgetallCommand(c *client, getK, getV bool) {
 			if getV {
 				multiplier++
 			}
-			length := hashTypeLength(o) * multiplier
-			c.addReplyMultiBulkLen(length)
+			length := hashTypeLength(o)
+			if multiplier == 2 {
+				c.addReplyMapLen(length)
+			} else {
+				c.addReplyMultiBulkLen(length)
+			}
 
 			hi := hashTypeInitIterator(o)
 			for hi.hashTypeNext() {
@@ -175,8 +197,8 @@ func genericHgetallCommand(c *client, getK, getV bool) {
 }
 
 func hexistsCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		o, ok := c.getHashOrReply(c.db.lookupKeyRead(c.argv[1]), shared.czero)
+	if c.lockKeyRead(c.argv[1]) {
+		o, ok := c.getHashOrReply(c.lookupKeyRead(c.argv[1]), shared.czero)
 		if ok && o != nil {
 			if hashTypeExists(o, c.argv[2]) {
 				c.addReply(shared.cone)
@@ -191,8 +213,11 @@ func hexistsCommand(c *client) {
 
 func hincrbyCommand(c *client) {
 	if incr, ok := c.getLongLongOrReply(c.argv[3], nil); ok {
-		c.db.lockKeyWrite(c.argv[1])
+		c.lockKeyWrite(c.argv[1])
 		o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+		if o == nil {
+			return
+		}
 
 		if v, ok := c.getLongLongOrReply(hashTypeGetValue(o, c.argv[2]),
 			[]byte("-ERR hash value is not an integer\r\n")); ok {
@@ -202,7 +227,9 @@ func hincrbyCommand(c *client) {
 				return
 			}
 			v += incr
-			hashTypeSet(c, o, shadowCopyToPmem(c.argv[2]), v)
+			hashTypeSet(c, o, c.argv[2], v)
+			c.db.signalModifiedKey(c.argv[1])
+			c.notifyKeyspaceEvent(NOTIFY_HASH, "hincrby", c.argv[1])
 			c.addReplyLongLong(v)
 		}
 	}
@@ -210,8 +237,11 @@ func hincrbyCommand(c *client) {
 
 func hincrbyfloatCommand(c *client) {
 	if incr, ok := c.getLongDoubleOrReply(c.argv[3], nil); ok {
-		c.db.lockKeyWrite(c.argv[1])
+		c.lockKeyWrite(c.argv[1])
 		o := hashTypeLookupWriteOrCreate(c, c.argv[1])
+		if o == nil {
+			return
+		}
 
 		if v, ok := c.getLongDoubleOrReply(hashTypeGetValue(o, c.argv[2]),
 			[]byte("-ERR hash value is not a float\r\n")); ok {
@@ -220,7 +250,9 @@ func hincrbyfloatCommand(c *client) {
 				c.addReplyError([]byte("increment would produce NaN or Infinity"))
 				return
 			}
-			hashTypeSet(c, o, shadowCopyToPmem(c.argv[2]), v)
+			hashTypeSet(c, o, c.argv[2], v)
+			c.db.signalModifiedKey(c.argv[1])
+			c.notifyKeyspaceEvent(NOTIFY_HASH, "hincrbyfloat", c.argv[1])
 			c.addReplyBulk([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
 		}
 	}
@@ -232,15 +264,61 @@ func hashTypeLookupWriteOrCreate(c *client, key []byte) interface{} {
 	o, ok := c.getHashOrReply(c.db.lookupKeyWrite(key), nil)
 	if ok {
 		if o == nil {
-			o = NewDict(4, 4) // implicitly convert to interface
+			o = ziplistNew() // implicitly convert to interface
 			c.db.setKey(shadowCopyToPmem(key), o)
 		}
 	}
 	return o
 }
 
+// hashTypeConvert converts the ziplist hash zl stored at c.argv[1] to a dict.
+// zl is only read, and the dict replaces it in the transaction of the
+// command, so a crash leaves the key with either of them and all of its
+// fields. Like setTypeConvert, the key is only updated if it still holds zl.
+func hashTypeConvert(c *client, zl *ziplist) *dict {
+	d := NewDict(hashTypeLength(zl), 4)
+	hi := hashTypeInitIterator(zl)
+	for hi.hashTypeNext() {
+		field, value := hi.hashTypeCurrentFromZiplist()
+		f, _ := getString(field)
+		d.set(shadowCopyToPmem(f), hashTypeDictValue(value))
+	}
+	txn("undo") {
+	if _, _, _, e := c.db.dict.find(c.argv[1]); e != nil && e.value == interface{}(zl) {
+		c.db.dict.set(c.argv[1], d)
+	}
+	}
+	return d
+}
+
+// hashTypeZiplistValue returns the string a ziplist hash stores for value,
+// which the ziplist encodes as an integer when it can.
+func hashTypeZiplistValue(value interface{}) []byte {
+	if f, ok := value.(float64); ok {
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	s, _ := getString(value)
+	return s
+}
+
+// hashTypeDictValue returns value as stored in a dict hash, a string value is
+// copied to pmem. A float is stored as the string hashTypeZiplistValue
+// returns, so both encodings reply it the same.
+func hashTypeDictValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return shadowCopyToPmemI(v)
+	case float64:
+		return shadowCopyToPmemI(hashTypeZiplistValue(v))
+	default:
+		return value
+	}
+}
+
 func hashTypeExists(o interface{}, field []byte) bool {
 	switch d := o.(type) {
+	case *ziplist:
+		return d.Find(field, 1) >= 0
 	case *dict:
 		if hashTypeGetFromHashTable(d, field) != nil {
 			return true
@@ -252,33 +330,61 @@ func hashTypeExists(o interface{}, field []byte) bool {
 	}
 }
 
-func hashTypeSet(c *client, o interface{}, field []byte, value interface{}) bool {
+// hashTypeSet sets field to value, a string or a number, in the hash o stored
+// at c.argv[1]. It returns the hash, which is a new dict if o was converted,
+// and whether the field already existed.
+func hashTypeSet(c *client, o interface{}, field []byte, value interface{}) (interface{}, bool) {
 	var update bool
+	if zl, ok := o.(*ziplist); ok {
+		v := hashTypeZiplistValue(value)
+		if len(field) > c.s.cfg.HashMaxZiplistValue || len(v) > c.s.cfg.HashMaxZiplistValue {
+			o = hashTypeConvert(c, zl)
+		} else {
+			if pos := zl.Find(field, 1); pos >= 0 {
+				// replace the value entry following the field.
+				pos = zl.Next(pos)
+				zl.Delete(pos)
+				zl.insert(pos, v)
+				return zl, true
+			}
+			zl.Push(field, false)
+			zl.Push(v, false)
+			if hashTypeLength(zl) > c.s.cfg.HashMaxZiplistEntries {
+				return hashTypeConvert(c, zl), false
+			}
+			return zl, false
+		}
+	}
 	switch d := o.(type) {
 	case *dict:
 		_, _, _, de := d.find(field)
 		if de != nil {
 			txn("undo") {
-			de.value = value
+			de.value = hashTypeDictValue(value)
 			update = true
 			}
 		} else {
-			d.set(field, value)
-			go hashTypeBgResize(c.db, c.argv[1])
+			d.set(shadowCopyToPmem(field), hashTypeDictValue(value))
+			c.bgResize(c.argv[1])
 		}
 	default:
 		panic("Unknown hash encoding")
 	}
-	return update
+	return o, update
 }
 
 func hashTypeDelete(c *client, o interface{}, field []byte) bool {
 	deleted := false
 	switch d := o.(type) {
+	case *ziplist:
+		if pos := d.Find(field, 1); pos >= 0 {
+			d.delete(pos, 2)
+			deleted = true
+		}
 	case *dict:
 		if d.delete(field) != nil {
 			deleted = true
-			go hashTypeBgResize(c.db, c.argv[1])
+			c.bgResize(c.argv[1])
 		}
 	default:
 		panic("Unknown hash encoding")
@@ -286,6 +392,20 @@ func hashTypeDelete(c *client, o interface{}, field []byte) bool {
 	return deleted
 }
 
+// bgResize runs hashTypeBgResize on key of the selected db in a goroutine.
+// Like a command it holds inflight shared, so Shutdown waits for it, and it
+// does not start once shutdown began.
+func (c *client) bgResize(key []byte) {
+	s, db := c.s, c.db
+	go func() {
+		s.inflight.RLock()
+		defer s.inflight.RUnlock()
+		if !s.closing() {
+			hashTypeBgResize(db, key)
+		}
+	}()
+}
+
 func hashTypeBgResize(db *redisDb, key []byte) {
 	if key == nil {
 		return
@@ -295,11 +415,14 @@ func hashTypeBgResize(db *redisDb, key []byte) {
 	if p > 5 {
 		return
 	}
+	expired := false
 	txn("undo") {
 	rehash := true
 	for rehash {
 		// need to lock and get kv pair in every transaction
-		db.lockKeyWrite(key)
+		if db.lockKeyWrite(key) {
+			expired = true
+		}
 		o := db.lookupKeyWrite(key)
 		var d *dict
 		switch v := o.(type) {
@@ -327,12 +450,35 @@ func hashTypeBgResize(db *redisDb, key []byte) {
 		}
 	}
 	}
+	if expired {
+		db.notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key)
+	}
+}
+
+// hashTypeDup returns a copy of the hash o, sized for its fields so that it
+// does not need to rehash.
+func hashTypeDup(o interface{}) interface{} {
+	switch d := o.(type) {
+	case *ziplist:
+		return d.deepCopy()
+	case *dict:
+		dup := NewDict(d.size(), 4)
+		iter := d.getIterator()
+		for de := iter.next(); de != nil; de = iter.next() {
+			dup.set(shadowCopyToPmem(de.key), dupStringValue(de.value))
+		}
+		return dup
+	default:
+		panic("Unknown hash encoding")
+	}
 }
 
 // need to check o != nil outside
 func hashTypeLength(o interface{}) int {
 	length := 0
 	switch d := o.(type) {
+	case *ziplist:
+		length = int(d.entries / 2)
 	case *dict:
 		length = d.size()
 	default:
@@ -343,6 +489,8 @@ func hashTypeLength(o interface{}) int {
 
 func hashTypeGetValue(o interface{}, field []byte) interface{} {
 	switch h := o.(type) {
+	case *ziplist:
+		return hashTypeGetFromZiplist(h, field)
 	case *dict:
 		return hashTypeGetFromHashTable(h, field)
 	default:
@@ -351,15 +499,17 @@ func hashTypeGetValue(o interface{}, field []byte) interface{} {
 }
 
 func hashTypeGetValueLength(o interface{}, field []byte) int {
-	length := 0
-	switch d := o.(type) {
-	case *dict:
-		v, _ := getString(hashTypeGetFromHashTable(d, field))
-		length = len(v)
-	default:
-		panic("Unknown hash encoding")
+	v, _ := getString(hashTypeGetValue(o, field))
+	return len(v)
+}
+
+// hashTypeGetFromZiplist returns the value of field, either an int64 or a
+// []byte pointing into the ziplist.
+func hashTypeGetFromZiplist(zl *ziplist, field []byte) interface{} {
+	if pos := zl.Find(field, 1); pos >= 0 {
+		return zl.Get(zl.Next(pos))
 	}
-	return length
+	return nil
 }
 
 func hashTypeGetFromHashTable(d *dict, key []byte) interface{} {
@@ -375,6 +525,8 @@ func hashTypeInitIterator(o interface{}) *hashTypeIterator {
 	hi := new(hashTypeIterator)
 	hi.subject = o
 	switch d := o.(type) {
+	case *ziplist:
+		hi.fpos, hi.vpos = -1, -1
 	case *dict:
 		hi.di = d.getIterator()
 	default:
@@ -384,7 +536,17 @@ func hashTypeInitIterator(o interface{}) *hashTypeIterator {
 }
 
 func (hi *hashTypeIterator) hashTypeNext() bool {
-	switch hi.subject.(type) {
+	switch zl := hi.subject.(type) {
+	case *ziplist:
+		if hi.vpos < 0 {
+			hi.fpos = zl.Index(0)
+		} else {
+			hi.fpos = zl.Next(hi.vpos)
+		}
+		if hi.fpos < 0 {
+			return false
+		}
+		hi.vpos = zl.Next(hi.fpos)
 	case *dict:
 		hi.de = hi.di.next()
 		if hi.de == nil {
@@ -396,6 +558,11 @@ func (hi *hashTypeIterator) hashTypeNext() bool {
 	return true
 }
 
+func (hi *hashTypeIterator) hashTypeCurrentFromZiplist() (interface{}, interface{}) {
+	zl := hi.subject.(*ziplist)
+	return zl.Get(hi.fpos), zl.Get(hi.vpos)
+}
+
 func (hi *hashTypeIterator) hashTypeCurrentFromHashTable() ([]byte, interface{}) {
 	if hi.de == nil {
 		return nil, nil
@@ -404,36 +571,35 @@ func (hi *hashTypeIterator) hashTypeCurrentFromHashTable() ([]byte, interface{})
 }
 
 func (c *client) addHashIteratorCursorToReply(hi *hashTypeIterator, getK, getV bool) {
+	var key, value interface{}
 	switch hi.subject.(type) {
+	case *ziplist:
+		key, value = hi.hashTypeCurrentFromZiplist()
 	case *dict:
-		key, value := hi.hashTypeCurrentFromHashTable()
-		if getK {
-			c.addReplyBulk(key)
-		}
-		if getV {
-			if s, ok := getString(value); ok {
-				c.addReplyBulk(s)
-			}
-		}
+		key, value = hi.hashTypeCurrentFromHashTable()
 	default:
 		panic("Unknown hash value encoding")
 	}
+	if getK {
+		s, _ := getString(key)
+		c.addReplyBulk(s)
+	}
+	if getV {
+		if s, ok := getString(value); ok {
+			c.addReplyBulk(s)
+		}
+	}
 }
 
 func (c *client) addHashFieldToReply(o interface{}, field []byte) {
 	if o == nil {
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
 		return
 	}
-	switch d := o.(type) {
-	case *dict:
-		value, _ := getString(hashTypeGetFromHashTable(d, field))
-		if value == nil {
-			c.addReply(shared.nullbulk)
-		} else {
-			c.addReplyBulk(value)
-		}
-	default:
-		panic("Unknown hash encoding")
+	value, _ := getString(hashTypeGetValue(o, field))
+	if value == nil {
+		c.addReplyNull()
+	} else {
+		c.addReplyBulk(value)
 	}
 }
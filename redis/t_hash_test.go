@@ -0,0 +1,123 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashZiplistEncoding(t *testing.T) {
+	fmt.Println("Store the values of a ziplist hash as strings.")
+	assertEqual(t, hashTypeZiplistValue(1.5), []byte("1.5"))
+	assertEqual(t, hashTypeZiplistValue(int64(-3)), []byte("-3"))
+	assertEqual(t, hashTypeZiplistValue([]byte("v")), []byte("v"))
+
+	fmt.Println("Only encode canonical integers so fields read back unchanged.")
+	for _, s := range []string{"01", "+1", "-0", " 1", ""} {
+		v, _, encoding := zipTryEncoding([]byte(s))
+		assertEqual(t, v, []byte(s))
+		assertEqual(t, encoding, byte(0))
+	}
+	_, ll, _ := zipTryEncoding([]byte("-12"))
+	assertEqual(t, ll, int64(-12))
+
+	fmt.Println("Count and iterate the fields of a ziplist hash.")
+	zl := &ziplist{entries: 6}
+	assertEqual(t, hashTypeLength(zl), 3)
+	assertEqual(t, hashTypeInitIterator(&ziplist{}).hashTypeNext(), false)
+	assertEqual(t, typeName(zl), "hash")
+	assertEqual(t, encodingName(zl), "ziplist")
+}
+
+func TestHashCommands(t *testing.T) {
+	c := newTestClient(1)
+	c.s.cfg.HashMaxZiplistEntries, c.s.cfg.HashMaxZiplistValue = 4, 8
+	encoding := func(key string) string {
+		return runCommand(c, "OBJECT", "ENCODING", key)
+	}
+
+	fmt.Println("Set, get, delete and increment the fields of a ziplist hash.")
+	assertEqual(t, runCommand(c, "HSET", "h", "a", "1", "b", "x"), ":2\r\n")
+	assertEqual(t, runCommand(c, "HSET", "h", "a", "2"), ":0\r\n")
+	assertEqual(t, runCommand(c, "HGET", "h", "a"), "$1\r\n2\r\n")
+	assertEqual(t, runCommand(c, "HGET", "h", "c"), "$-1\r\n")
+	assertEqual(t, runCommand(c, "HINCRBY", "h", "a", "5"), ":7\r\n")
+	assertEqual(t, runCommand(c, "HINCRBY", "h", "c", "-3"), ":-3\r\n")
+	assertEqual(t, runCommand(c, "HINCRBY", "h", "b", "1"), "-ERR hash value is not an integer\r\n")
+	assertEqual(t, runCommand(c, "HGET", "h", "c"), "$2\r\n-3\r\n")
+	assertEqual(t, runCommand(c, "HDEL", "h", "b", "nofield"), ":1\r\n")
+	assertEqual(t, runCommand(c, "HLEN", "h"), ":2\r\n")
+	assertEqual(t, encoding("h"), "$7\r\nziplist\r\n")
+	assertEqual(t, runCommand(c, "HDEL", "h", "a", "c"), ":2\r\n")
+	assertEqual(t, runCommand(c, "EXISTS", "h"), ":0\r\n")
+
+	fmt.Println("Convert past hash-max-ziplist-entries.")
+	runCommand(c, "HSET", "h", "f1", "v1", "f2", "v2", "f3", "v3", "f4", "v4")
+	assertEqual(t, encoding("h"), "$7\r\nziplist\r\n")
+	assertEqual(t, runCommand(c, "HSET", "h", "f5", "v5"), ":1\r\n")
+	assertEqual(t, encoding("h"), "$9\r\nhashtable\r\n")
+	assertEqual(t, runCommand(c, "HLEN", "h"), ":5\r\n")
+	assertEqual(t, runCommand(c, "HGET", "h", "f1"), "$2\r\nv1\r\n")
+	assertEqual(t, runCommand(c, "HINCRBY", "h", "n", "2"), ":2\r\n")
+
+	fmt.Println("Store floats as the same strings in both encodings.")
+	runCommand(c, "HSET", "small", "a", "1")
+	for _, key := range []string{"small", "h"} {
+		assertEqual(t, runCommand(c, "HINCRBYFLOAT", key, "fl", "1.5"), "$3\r\n1.5\r\n")
+		assertEqual(t, runCommand(c, "HGET", key, "fl"), "$3\r\n1.5\r\n")
+		assertEqual(t, runCommand(c, "HINCRBYFLOAT", key, "fl", "0.25"), "$4\r\n1.75\r\n")
+		assertEqual(t, runCommand(c, "HSTRLEN", key, "fl"), ":4\r\n")
+	}
+	assertEqual(t, encoding("small"), "$7\r\nziplist\r\n")
+
+	fmt.Println("Convert past hash-max-ziplist-value, for fields and values.")
+	runCommand(c, "HSET", "v", "a", "12345678")
+	assertEqual(t, encoding("v"), "$7\r\nziplist\r\n")
+	runCommand(c, "HSET", "v", "b", "123456789")
+	assertEqual(t, encoding("v"), "$9\r\nhashtable\r\n")
+	assertEqual(t, runCommand(c, "HGET", "v", "a"), "$8\r\n12345678\r\n")
+	runCommand(c, "HSET", "f", "123456789", "v")
+	assertEqual(t, encoding("f"), "$9\r\nhashtable\r\n")
+	assertEqual(t, runCommand(c, "HGET", "f", "123456789"), "$1\r\nv\r\n")
+
+	fmt.Println("Leave the ziplist intact and only replace it at its key.")
+	runCommand(c, "HSET", "z", "a", "1", "b", "x")
+	_, _, _, e := c.db.dict.find([]byte("z"))
+	zl := e.value.(*ziplist)
+	data := append([]byte(nil), zl.data...)
+	c.argv = argv("HSET", "z")
+	d := hashTypeConvert(c, zl)
+	assertEqual(t, zl.data, data)
+	assertEqual(t, e.value == interface{}(d), true)
+	assertEqual(t, d.size(), 2)
+	assertEqual(t, runCommand(c, "HGET", "z", "b"), "$1\r\nx\r\n")
+	runCommand(c, "SET", "z", "s")
+	c.argv = argv("HSET", "z")
+	hashTypeConvert(c, zl)
+	assertEqual(t, runCommand(c, "GET", "z"), "$1\r\ns\r\n")
+}
+
+func TestHashConvertPanic(t *testing.T) {
+	c := newTestClient(1)
+	c.s.cfg.HashMaxZiplistEntries = 2
+	runCommand(c, "HSET", "h", "a", "1", "b", "2")
+
+	fmt.Println("Keep the ziplist and its fields if a conversion is rolled back.")
+	c.wBuffer.Reset()
+	c.argv = argv("HSET", "h", "c", "3")
+	c.argc = len(c.argv)
+	c.cmd = &redisCommand{name: "HSETPANIC", proc: func(c *client) {
+		hsetCommand(c)
+		panic("after the conversion")
+	}}
+	c.call()
+	assertEqual(t, c.wBuffer.String(), "-ERR internal error\r\n")
+	_, _, _, e := c.db.dict.find([]byte("h"))
+	_, ok := e.value.(*ziplist)
+	assertEqual(t, ok, true)
+	assertEqual(t, runCommand(c, "HGETALL", "h"), "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n")
+}
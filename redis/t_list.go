@@ -25,20 +25,37 @@ type (
 // ============== list type commands ====================
 func pushGenericCommand(c *client, head bool) {
 	pushed := 0
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	if o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), nil); ok {
 		for j := 2; j < c.argc; j++ {
 			if o == nil {
-				o = quicklistCreate() // TODO: set list option
+				o = quicklistNew(c.s.cfg.ListFill, 0)
 				c.db.setKey(shadowCopyToPmem(c.argv[1]), o)
 			}
 			listTypePush(o, c.argv[j], head)
 			pushed++
 		}
+		c.db.signalModifiedKey(c.argv[1])
+		c.signalKeyAsReady(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_LIST, pushEvent(head), c.argv[1])
 		c.addReplyLongLong(listTypeLength(o))
 	}
 }
 
+func pushEvent(head bool) string {
+	if head {
+		return "lpush"
+	}
+	return "rpush"
+}
+
+func popEvent(head bool) string {
+	if head {
+		return "lpop"
+	}
+	return "rpop"
+}
+
 func lpushCommand(c *client) {
 	pushGenericCommand(c, true)
 }
@@ -48,7 +65,7 @@ func rpushCommand(c *client) {
 }
 
 func pushxGenericCommand(c *client, head bool) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.czero)
 	if !ok || o == nil {
 		return
@@ -58,6 +75,8 @@ func pushxGenericCommand(c *client, head bool) {
 		listTypePush(o, c.argv[j], head)
 		pushed++
 	}
+	c.db.signalModifiedKey(c.argv[1])
+	c.notifyKeyspaceEvent(NOTIFY_LIST, pushEvent(head), c.argv[1])
 	c.addReplyLongLong(listTypeLength(o))
 }
 
@@ -80,7 +99,7 @@ func linsertCommand(c *client) {
 		return
 	}
 
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.czero)
 	if !ok || o == nil {
 		return
@@ -99,13 +118,15 @@ func linsertCommand(c *client) {
 	if !inserted {
 		c.addReply(shared.cnegone)
 	} else {
+		c.db.signalModifiedKey(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_LIST, "linsert", c.argv[1])
 		c.addReplyLongLong(listTypeLength(o))
 	}
 }
 
 func llenCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		if o, ok := c.getListOrReply(c.db.lookupKeyRead(c.argv[1]), nil); ok {
+	if c.lockKeyRead(c.argv[1]) {
+		if o, ok := c.getListOrReply(c.lookupKeyRead(c.argv[1]), nil); ok {
 			c.addReplyLongLong(listTypeLength(o))
 		}
 	} else {
@@ -114,9 +135,13 @@ func llenCommand(c *client) {
 }
 
 func lindexCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		o, ok := c.getListOrReply(c.db.lookupKeyRead(c.argv[1]), shared.nullbulk)
-		if !ok || o == nil {
+	if c.lockKeyRead(c.argv[1]) {
+		o, ok := c.getListOrReply(c.lookupKeyRead(c.argv[1]), nil)
+		if !ok {
+			return
+		}
+		if o == nil {
+			c.addReplyNull()
 			return
 		}
 		index, ok := c.getLongLongOrReply(c.argv[2], nil)
@@ -130,18 +155,18 @@ func lindexCommand(c *client) {
 				s, _ := getString(entry.value)
 				c.addReplyBulk(s)
 			} else {
-				c.addReply(shared.nullbulk)
+				c.addReplyNull()
 			}
 		default:
 			panic("Unknown list encoding")
 		}
 	} else {
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
 	}
 }
 
 func lsetCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.nokeyerr)
 	if !ok || o == nil {
 		return
@@ -156,6 +181,8 @@ func lsetCommand(c *client) {
 		if !replaced {
 			c.addReply(shared.outofrangeerr)
 		} else {
+			c.db.signalModifiedKey(c.argv[1])
+			c.notifyKeyspaceEvent(NOTIFY_LIST, "lset", c.argv[1])
 			c.addReply(shared.ok)
 		}
 	default:
@@ -164,20 +191,28 @@ func lsetCommand(c *client) {
 }
 
 func popGenericCommand(c *client, head bool) {
-	c.db.lockKeyWrite(c.argv[1])
-	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.nullbulk)
-	if !ok || o == nil {
+	c.lockKeyWrite(c.argv[1])
+	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), nil)
+	if !ok {
+		return
+	}
+	if o == nil {
+		c.addReplyNull()
 		return
 	}
 
 	val := listTypePop(o, head)
 	if val == nil {
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
 	} else {
 		s, _ := getString(val)
 		c.addReplyBulk(s)
+		c.notifyKeyspaceEvent(NOTIFY_LIST, popEvent(head), c.argv[1])
 		if listTypeLength(o) == 0 {
 			c.db.delete(c.argv[1])
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+		} else {
+			c.db.signalModifiedKey(c.argv[1])
 		}
 	}
 }
@@ -199,11 +234,11 @@ func lrangeCommand(c *client) {
 	if end, ok = c.getLongLongOrReply(c.argv[3], nil); !ok {
 		return
 	}
-	if !c.db.lockKeyRead(c.argv[1]) {
+	if !c.lockKeyRead(c.argv[1]) {
 		c.addReply(shared.emptymultibulk)
 		return
 	}
-	o, ok := c.getListOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	o, ok := c.getListOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 	if !ok || o == nil {
 		return
 	}
@@ -253,7 +288,7 @@ func ltrimCommand(c *client) {
 	if end, ok = c.getLongLongOrReply(c.argv[3], nil); !ok {
 		return
 	}
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.ok)
 	if !ok || o == nil {
 		return
@@ -287,6 +322,8 @@ func ltrimCommand(c *client) {
 	default:
 		panic("Unknown list encoding")
 	}
+	c.db.signalModifiedKey(c.argv[1])
+	c.notifyKeyspaceEvent(NOTIFY_LIST, "ltrim", c.argv[1])
 	c.addReply(shared.ok)
 }
 
@@ -301,7 +338,7 @@ func lremCommand(c *client) {
 	if toremove, ok = c.getLongLongOrReply(c.argv[2], nil); !ok {
 		return
 	}
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	o, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.ok)
 	if !ok || o == nil {
 		return
@@ -322,30 +359,144 @@ func lremCommand(c *client) {
 			}
 		}
 	}
+	if removed > 0 {
+		c.notifyKeyspaceEvent(NOTIFY_LIST, "lrem", c.argv[1])
+	}
 	if listTypeLength(o) == 0 {
 		c.db.delete(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+	} else if removed > 0 {
+		c.db.signalModifiedKey(c.argv[1])
 	}
 	c.addReplyLongLong(removed)
 }
 
 func rpoplpushCommand(c *client) {
-	c.db.lockKeysWrite(c.argv[1:3], 1)
-	sobj, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.nullbulk)
-	if !ok || sobj == nil {
+	lmoveGenericCommand(c, false, true)
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmoveCommand(c *client) {
+	wherefrom, ok := getListPosition(c.argv[3])
+	if !ok {
+		c.addReply(shared.syntaxerr)
+		return
+	}
+	whereto, ok := getListPosition(c.argv[4])
+	if !ok {
+		c.addReply(shared.syntaxerr)
+		return
+	}
+	lmoveGenericCommand(c, wherefrom, whereto)
+}
+
+func lmoveGenericCommand(c *client, wherefrom, whereto bool) {
+	c.lockKeysWrite(c.argv[1:3], 1)
+	sobj, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), nil)
+	if !ok {
+		return
+	}
+	if sobj == nil {
+		c.addReplyNull()
 		return
 	}
 	if listTypeLength(sobj) == 0 {
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
 	} else {
-		dobj, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[2]), nil)
+		lmoveHandlePop(c, sobj, wherefrom, whereto)
+	}
+}
+
+// BLPOP key [key ...] timeout
+func blpopCommand(c *client) {
+	blockingPopGenericCommand(c, true)
+}
+
+// BRPOP key [key ...] timeout
+func brpopCommand(c *client) {
+	blockingPopGenericCommand(c, false)
+}
+
+// Pop from the first non-empty list of the keys, or block until one of them
+// gets elements. A woken client runs the command again, see blocked.go.
+func blockingPopGenericCommand(c *client, head bool) {
+	timeout, ok := c.getTimeoutOrReply(c.argv[c.argc-1])
+	if !ok {
+		return
+	}
+	keys := c.argv[1 : c.argc-1]
+	c.lockKeysWrite(keys, 1)
+	for _, key := range keys {
+		o, ok := c.getListOrReply(c.db.lookupKeyWrite(key), nil)
 		if !ok {
+			c.unblock()
 			return
 		}
-		value := listTypePop(sobj, false)
-		rpoplpushHandlePush(c, c.argv[2], dobj, value)
-		if listTypeLength(sobj) == 0 {
-			c.db.delete(c.argv[1])
+		if listTypeLength(o) == 0 {
+			continue
+		}
+		c.unblock()
+		val := listTypePop(o, head)
+		s, _ := getString(val)
+		c.notifyKeyspaceEvent(NOTIFY_LIST, popEvent(head), key)
+		if listTypeLength(o) == 0 {
+			c.db.delete(key)
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+		} else {
+			c.db.signalModifiedKey(key)
+			c.signalKeyAsReady(key)
 		}
+		c.addReplyMultiBulkLen(2)
+		c.addReplyBulk(key)
+		c.addReplyBulk(s)
+		return
+	}
+	// Inside MULTI/EXEC there is nobody to push, so the lists stay empty.
+	if c.batch {
+		c.addReplyNullArray()
+		return
+	}
+	c.blockForKeys(keys, timeout, (*client).addReplyNullArray)
+}
+
+// BRPOPLPUSH source destination timeout
+func brpoplpushCommand(c *client) {
+	blockingMoveGenericCommand(c, false, true, c.argv[3])
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmoveCommand(c *client) {
+	wherefrom, ok := getListPosition(c.argv[3])
+	if !ok {
+		c.addReply(shared.syntaxerr)
+		return
+	}
+	whereto, ok := getListPosition(c.argv[4])
+	if !ok {
+		c.addReply(shared.syntaxerr)
+		return
+	}
+	blockingMoveGenericCommand(c, wherefrom, whereto, c.argv[5])
+}
+
+func blockingMoveGenericCommand(c *client, wherefrom, whereto bool, timeoutArg []byte) {
+	timeout, ok := c.getTimeoutOrReply(timeoutArg)
+	if !ok {
+		return
+	}
+	c.lockKeysWrite(c.argv[1:3], 1)
+	sobj, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[1]), nil)
+	if !ok {
+		c.unblock()
+		return
+	}
+	if listTypeLength(sobj) > 0 {
+		c.unblock()
+		lmoveHandlePop(c, sobj, wherefrom, whereto)
+	} else if c.batch {
+		c.addReplyNull()
+	} else {
+		c.blockForKeys(c.argv[1:2], timeout, (*client).addReplyNull)
 	}
 }
 
@@ -359,6 +510,22 @@ func listTypePush(o, val interface{}, head bool) {
 	}
 }
 
+// listTypeDup returns a copy of the list o in new pmem nodes.
+func listTypeDup(o interface{}) interface{} {
+	switch l := o.(type) {
+	case *quicklist:
+		dup := quicklistNew(l.fill, l.compress)
+		iter := l.GetIterator(true)
+		var entry quicklistEntry
+		for iter.Next(&entry) {
+			dup.PushTail(entry.value)
+		}
+		return dup
+	default:
+		panic("Unknown list encoding")
+	}
+}
+
 func listTypeLength(o interface{}) int64 {
 	switch l := o.(type) {
 	case *quicklist:
@@ -412,12 +579,44 @@ func listTypeDelete(li *listTypeIterator, entry *listTypeEntry) {
 	li.iter.DelEntry(&entry.entry)
 }
 
-func rpoplpushHandlePush(c *client, dstkey []byte, dstobj, value interface{}) {
+// lmoveHandlePop moves an element from the non-empty source list sobj to the
+// destination list and replies it.
+func lmoveHandlePop(c *client, sobj interface{}, wherefrom, whereto bool) {
+	dobj, ok := c.getListOrReply(c.db.lookupKeyWrite(c.argv[2]), nil)
+	if !ok {
+		return
+	}
+	value := listTypePop(sobj, wherefrom)
+	c.notifyKeyspaceEvent(NOTIFY_LIST, popEvent(wherefrom), c.argv[1])
+	lmoveHandlePush(c, c.argv[2], dobj, value, whereto)
+	if listTypeLength(sobj) == 0 {
+		c.db.delete(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+	} else {
+		c.db.signalModifiedKey(c.argv[1])
+		c.signalKeyAsReady(c.argv[1])
+	}
+}
+
+func lmoveHandlePush(c *client, dstkey []byte, dstobj, value interface{}, head bool) {
 	if dstobj == nil {
-		dstobj = quicklistCreate()
+		dstobj = quicklistNew(c.s.cfg.ListFill, 0)
 		c.db.setKey(shadowCopyToPmem(dstkey), dstobj)
 	}
-	listTypePush(dstobj, value, true)
+	listTypePush(dstobj, value, head)
+	c.db.signalModifiedKey(dstkey)
+	c.signalKeyAsReady(dstkey)
+	c.notifyKeyspaceEvent(NOTIFY_LIST, pushEvent(head), dstkey)
 	s, _ := getString(value)
 	c.addReplyBulk(s)
 }
+
+// getListPosition parses LEFT or RIGHT, LEFT being the head of the list.
+func getListPosition(arg []byte) (head, ok bool) {
+	if bytes.EqualFold(arg, []byte("left")) {
+		return true, true
+	} else if bytes.EqualFold(arg, []byte("right")) {
+		return false, true
+	}
+	return false, false
+}
@@ -7,6 +7,9 @@ package redis
 
 import (
 	"sort"
+	"strconv"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
 )
 
 type (
@@ -27,7 +30,7 @@ const (
 
 // ============== set commands ====================
 func saddCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	var added int64
 	if set, ok := c.getSetOrReply(c.db.lookupKeyWrite(c.argv[1]), nil); !ok {
 		return
@@ -37,16 +40,22 @@ func saddCommand(c *client) {
 			c.db.setKey(shadowCopyToPmem(c.argv[1]), set)
 		}
 		for j := 2; j < c.argc; j++ {
-			if setTypeAdd(c, c.argv[1], set, c.argv[j]) {
+			var inserted bool
+			// the set may be converted to a dict by any of the members.
+			if set, inserted = setTypeAdd(c, c.argv[1], set, c.argv[j]); inserted {
 				added++
 			}
 		}
 	}
+	if added > 0 {
+		c.db.signalModifiedKey(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_SET, "sadd", c.argv[1])
+	}
 	c.addReplyLongLong(added)
 }
 
 func sremCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	var deleted int64
 	set, ok := c.getSetOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.czero)
 	if !ok || set == nil {
@@ -62,11 +71,18 @@ func sremCommand(c *client) {
 			}
 		}
 	}
+	if deleted > 0 {
+		c.db.signalModifiedKey(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_SET, "srem", c.argv[1])
+		if setTypeSize(set) == 0 {
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+		}
+	}
 	c.addReplyLongLong(deleted)
 }
 
 func smoveCommand(c *client) {
-	c.db.lockKeysWrite(c.argv[1:3], 1)
+	c.lockKeysWrite(c.argv[1:3], 1)
 	var srcset, dstset interface{}
 	ele := c.argv[3]
 	ok := false
@@ -95,9 +111,14 @@ func smoveCommand(c *client) {
 		return
 	}
 
+	c.notifyKeyspaceEvent(NOTIFY_SET, "srem", c.argv[1])
+
 	// Remove the src set from the database when empty
 	if setTypeSize(srcset) == 0 {
 		c.db.delete(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+	} else {
+		c.db.signalModifiedKey(c.argv[1])
 	}
 
 	// Create the destination set when it doesn't exist
@@ -107,8 +128,9 @@ func smoveCommand(c *client) {
 	}
 
 	// An extra key has changed when ele was successfully added to dstset
-	if setTypeAdd(c, c.argv[2], dstset, ele) {
-		// notify key space event
+	if _, added := setTypeAdd(c, c.argv[2], dstset, ele); added {
+		c.db.signalModifiedKey(c.argv[2])
+		c.notifyKeyspaceEvent(NOTIFY_SET, "sadd", c.argv[2])
 	}
 	c.addReply(shared.cone)
 }
@@ -124,9 +146,13 @@ func spopCommand(c *client) {
 
 	// Make sure a key with the name inputted exists, and that it's type is
 	// indeed a set
-	c.db.lockKeyWrite(c.argv[1])
-	set, ok := c.getSetOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.nullbulk)
-	if !ok || set == nil {
+	c.lockKeyWrite(c.argv[1])
+	set, ok := c.getSetOrReply(c.db.lookupKeyWrite(c.argv[1]), nil)
+	if !ok {
+		return
+	}
+	if set == nil {
+		c.addReplyNull()
 		return
 	}
 
@@ -139,10 +165,14 @@ func spopCommand(c *client) {
 	// Add the element to the reply
 	reply, _ := getString(ele)
 	c.addReplyBulk(reply)
+	c.notifyKeyspaceEvent(NOTIFY_SET, "spop", c.argv[1])
 
 	// Delete the set if it's empty
 	if setTypeSize(set) == 0 {
 		c.db.delete(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+	} else {
+		c.db.signalModifiedKey(c.argv[1])
 	}
 }
 
@@ -159,9 +189,13 @@ func spopWithCountCommand(c *client) {
 
 	// Make sure a key with the name inputted exists, and that it's type is
 	// indeed a set. Otherwise, return nil
-	c.db.lockKeyWrite(c.argv[1])
-	set, ok2 := c.getSetOrReply(c.db.lookupKeyWrite(c.argv[1]), shared.nullbulk)
-	if !ok2 || set == nil {
+	c.lockKeyWrite(c.argv[1])
+	set, ok2 := c.getSetOrReply(c.db.lookupKeyWrite(c.argv[1]), nil)
+	if !ok2 {
+		return
+	}
+	if set == nil {
+		c.addReplyNull()
 		return
 	}
 
@@ -184,13 +218,15 @@ func spopWithCountCommand(c *client) {
 
 		// Delete the set as it is now empty
 		c.db.delete(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_SET, "spop", c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
 		return
 	}
 
 	// Case 2 and 3 require to replicate SPOP as a set of SREM commands.
 	// Prepare our replication argument vector. Also send the array length
 	// which is common to both the code paths.
-	c.addReplyMultiBulkLen(count)
+	c.addReplySetLen(count)
 
 	// If we are here, the number of requested elements is less than the
 	// number of elements inside the set. Also we are sure that count < size.
@@ -208,6 +244,8 @@ func spopWithCountCommand(c *client) {
 			reply, _ := getString(ele)
 			c.addReplyBulk(reply)
 		}
+		c.db.signalModifiedKey(c.argv[1])
+		c.notifyKeyspaceEvent(NOTIFY_SET, "spop", c.argv[1])
 	} else {
 		// CASE 3: The number of elements to return is very big, approaching
 		// the size of the set itself. After some time extracting random elements
@@ -221,13 +259,14 @@ func spopWithCountCommand(c *client) {
 		newset := setTypeCreate(nil)
 		for ; remaining > 0; remaining-- {
 			ele := setTypeRandomElement(set)
-			setTypeAdd(c, nil, newset, ele)
+			newset, _ = setTypeAdd(c, nil, newset, ele)
 			setTypeRemove(c, nil, set, ele)
 		}
 
 		// Assign the new set as the key value.
 		// No need to copy argv[1] into pmem as we already know key exists in db
 		c.db.setKey(c.argv[1], newset)
+		c.notifyKeyspaceEvent(NOTIFY_SET, "spop", c.argv[1])
 
 		// Tranfer the old set to the client.
 		si := setTypeInitIterator(set)
@@ -247,12 +286,16 @@ func srandmemberCommand(c *client) {
 		return
 	}
 
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
-		c.addReply(shared.nullbulk)
+	if !c.lockKeyRead(c.argv[1]) { // expired
+		c.addReplyNull()
 		return
 	}
-	set, ok := c.getSetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.nullbulk)
-	if !ok || set == nil {
+	set, ok := c.getSetOrReply(c.lookupKeyRead(c.argv[1]), nil)
+	if !ok {
+		return
+	}
+	if set == nil {
+		c.addReplyNull()
 		return
 	}
 
@@ -275,11 +318,11 @@ func srandmemberWithCountCommand(c *client) {
 	}
 	count := int(ll)
 
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
+	if !c.lockKeyRead(c.argv[1]) { // expired
 		c.addReply(shared.emptymultibulk)
 		return
 	}
-	set, ok := c.getSetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	set, ok := c.getSetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 	if !ok || set == nil {
 		return
 	}
@@ -355,7 +398,7 @@ func srandmemberWithCountCommand(c *client) {
 	}
 
 	// CASE 3 & 4: send the result to the user.
-	c.addReplyMultiBulkLen(count)
+	c.addReplySetLen(count)
 	di := d.getIterator()
 	for de := di.next(); de != nil; de = di.next() {
 		c.addReplyBulk(de.key)
@@ -376,12 +419,12 @@ func sinterGenericCommand(c *client, setkeys [][]byte, dstkey []byte) {
 	var alives []bool = nil
 	if dstkey == nil { // read only commands
 		keys = setkeys
-		alives = c.db.lockKeysRead(keys, 1)
+		alives = c.lockKeysRead(keys, 1)
 	} else { // write commands.
 		// TODO: write locks will be automatically aquired for all keys even we
 		// only need read locks for source keys.
 		keys = append(setkeys, dstkey)
-		c.db.lockKeysWrite(keys, 1)
+		c.lockKeysWrite(keys, 1)
 	}
 
 	sets := make([]interface{}, len(setkeys))
@@ -394,7 +437,9 @@ func sinterGenericCommand(c *client, setkeys [][]byte, dstkey []byte) {
 		} else {
 			if set == nil {
 				if dstkey != nil {
-					c.db.delete(dstkey)
+					if c.db.delete(dstkey) {
+						c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dstkey)
+					}
 					c.addReply(shared.czero)
 				} else {
 					c.addReply(shared.emptymultibulk)
@@ -445,22 +490,26 @@ func sinterGenericCommand(c *client, setkeys [][]byte, dstkey []byte) {
 				c.addReplyBulk(e)
 				cardinality++
 			} else {
-				setTypeAdd(c, dstkey, dstset, ele)
+				dstset, _ = setTypeAdd(c, dstkey, dstset, ele)
 			}
 		}
 		ele = setTypeNext(si)
 	}
 
 	if dstkey != nil {
-		c.db.delete(dstkey)
+		deleted := c.db.delete(dstkey)
 		if setTypeSize(dstset) > 0 {
 			c.db.setKey(shadowCopyToPmem(dstkey), dstset)
+			c.notifyKeyspaceEvent(NOTIFY_SET, "sinterstore", dstkey)
 			c.addReplyLongLong(int64(setTypeSize(dstset)))
 		} else {
+			if deleted {
+				c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dstkey)
+			}
 			c.addReply(shared.czero)
 		}
 	} else {
-		c.setDeferredMultiBulkLength(cardinality)
+		c.setDeferredSetLen(cardinality)
 	}
 }
 
@@ -487,12 +536,12 @@ func sunionDiffGenericCommand(c *client, setkeys [][]byte, dstkey []byte, op int
 	if op != SET_OP_UNION_NOLOCK {
 		if dstkey == nil { // read only commands
 			keys = setkeys
-			alives = c.db.lockKeysRead(keys, 1)
+			alives = c.lockKeysRead(keys, 1)
 		} else { // write commands.
 			// TODO: write locks will be automatically aquired for all keys even
 			// we only need read locks for source keys.
 			keys = append(setkeys, dstkey)
-			c.db.lockKeysWrite(keys, 1)
+			c.lockKeysWrite(keys, 1)
 		}
 	}
 
@@ -558,7 +607,8 @@ func sunionDiffGenericCommand(c *client, setkeys [][]byte, dstkey []byte, op int
 			si := setTypeInitIterator(sets[j])
 			ele := setTypeNext(si)
 			for ele != nil {
-				if setTypeAdd(c, dstkey, dstset, ele) {
+				var added bool
+				if dstset, added = setTypeAdd(c, dstkey, dstset, ele); added {
 					cardinality++
 				}
 				ele = setTypeNext(si)
@@ -588,7 +638,7 @@ func sunionDiffGenericCommand(c *client, setkeys [][]byte, dstkey []byte, op int
 			if j == len(sets) {
 				// There is no other set with this element. Add it.
 				// should be OK even if dstkey is nil
-				setTypeAdd(c, dstkey, dstset, ele)
+				dstset, _ = setTypeAdd(c, dstkey, dstset, ele)
 				cardinality++
 			}
 		}
@@ -607,7 +657,7 @@ func sunionDiffGenericCommand(c *client, setkeys [][]byte, dstkey []byte, op int
 			si := setTypeInitIterator(sets[j])
 			for ele := setTypeNext(si); ele != nil; ele = setTypeNext(si) {
 				if j == 0 {
-					setTypeAdd(c, dstkey, dstset, ele)
+					dstset, _ = setTypeAdd(c, dstkey, dstset, ele)
 					cardinality++
 				} else {
 					if setTypeRemove(c, dstkey, dstset, ele) {
@@ -625,7 +675,7 @@ func sunionDiffGenericCommand(c *client, setkeys [][]byte, dstkey []byte, op int
 
 	// Output the content of the resulting set, if not in STORE mode
 	if dstkey == nil {
-		c.addReplyMultiBulkLen(cardinality)
+		c.addReplySetLen(cardinality)
 		si := setTypeInitIterator(dstset)
 		for ele := setTypeNext(si); ele != nil; ele = setTypeNext(si) {
 			reply, _ := getString(ele)
@@ -634,19 +684,27 @@ func sunionDiffGenericCommand(c *client, setkeys [][]byte, dstkey []byte, op int
 	} else {
 		// If we have a target key where to store the resulting set
 		// create this key with the result set inside
-		c.db.delete(dstkey)
+		deleted := c.db.delete(dstkey)
 		if cardinality > 0 {
 			c.db.setKey(shadowCopyToPmem(dstkey), dstset)
+			if op == SET_OP_UNION {
+				c.notifyKeyspaceEvent(NOTIFY_SET, "sunionstore", dstkey)
+			} else {
+				c.notifyKeyspaceEvent(NOTIFY_SET, "sdiffstore", dstkey)
+			}
 			c.addReplyLongLong(int64(cardinality))
 		} else {
+			if deleted {
+				c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dstkey)
+			}
 			c.addReply(shared.czero)
 		}
 	}
 }
 
 func sismemberCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		o, ok := c.getSetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.czero)
+	if c.lockKeyRead(c.argv[1]) {
+		o, ok := c.getSetOrReply(c.lookupKeyRead(c.argv[1]), shared.czero)
 		if !ok || o == nil {
 			return
 		} else {
@@ -662,8 +720,8 @@ func sismemberCommand(c *client) {
 }
 
 func scardCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		o, ok := c.getSetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.czero)
+	if c.lockKeyRead(c.argv[1]) {
+		o, ok := c.getSetOrReply(c.lookupKeyRead(c.argv[1]), shared.czero)
 		if !ok || o == nil {
 			return
 		} else {
@@ -675,22 +733,78 @@ func scardCommand(c *client) {
 }
 
 // ============== settype helper functions ====================
+
+// Like in redis, a set of integers is an intset until it has more than
+// set-max-intset-entries members or a member that is not an integer, then it
+// is converted to a dict. Sets are never converted back to intsets.
+
+// setTypeCreate returns an empty set for the first member val, an intset
+// unless val is a string that is not an integer.
 func setTypeCreate(val interface{}) interface{} {
-	// TODO: create intset or hash based on val.
-	return NewDict(4, 4)
+	if s, ok := val.([]byte); ok {
+		if _, ok := string2ll(s); !ok {
+			return NewDict(4, 4)
+		}
+	}
+	return intsetNew()
 }
 
-func setTypeAdd(c *client, skey []byte, subject interface{}, k interface{}) bool {
+// setTypeInteger returns the integer value of a member, either a string or an
+// int64 from an intset.
+func setTypeInteger(k interface{}) (int64, bool) {
+	switch v := k.(type) {
+	case int64:
+		return v, true
+	case []byte:
+		return string2ll(v)
+	default:
+		return 0, false
+	}
+}
+
+// setTypeConvert converts the intset is to a dict. If is is the value of skey,
+// the dict replaces it in the transaction of the command, so a crash leaves
+// the key with either of them and all of its members. The sets of the STORE
+// commands are not the value of their key until they are complete.
+func setTypeConvert(c *client, skey []byte, is *intset) *dict {
+	d := NewDict(is.Len(), 4)
+	for i := 0; i < is.Len(); i++ {
+		d.set(shadowCopyToPmem(strconv.AppendInt(nil, is.Get(i), 10)), nil)
+	}
+	if skey != nil {
+		txn("undo") {
+		if _, _, _, e := c.db.dict.find(skey); e != nil && e.value == interface{}(is) {
+			c.db.dict.set(skey, d)
+		}
+		}
+	}
+	return d
+}
+
+// setTypeAdd adds k to the set subject stored at skey. It returns the set,
+// which is a new dict if subject was converted, and whether k was added.
+func setTypeAdd(c *client, skey []byte, subject interface{}, k interface{}) (interface{}, bool) {
 	switch s := subject.(type) {
+	case *intset:
+		if ll, ok := setTypeInteger(k); ok {
+			if !s.Add(ll) {
+				return s, false
+			}
+			if s.Len() > c.s.cfg.SetMaxIntsetEntries {
+				return setTypeConvert(c, skey, s), true
+			}
+			return s, true
+		}
+		return setTypeAdd(c, skey, setTypeConvert(c, skey, s), k)
 	case *dict:
 		key, _ := getString(k)
 		_, _, _, de := s.find(key)
 		if de == nil { // only add if not exist
 			s.set(shadowCopyToPmem(key), nil)
-			go hashTypeBgResize(c.db, skey)
-			return true
+			c.bgResize(skey)
+			return s, true
 		} else {
-			return false
+			return s, false
 		}
 	default:
 		panic("Unknown set encoding")
@@ -699,13 +813,16 @@ func setTypeAdd(c *client, skey []byte, subject interface{}, k interface{}) bool
 
 func setTypeRemove(c *client, skey []byte, subject interface{}, k interface{}) bool {
 	switch s := subject.(type) {
+	case *intset:
+		ll, ok := setTypeInteger(k)
+		return ok && s.Remove(ll)
 	case *dict:
 		key, _ := getString(k)
 		de := s.delete(key)
 		if de == nil {
 			return false
 		} else {
-			go hashTypeBgResize(c.db, skey)
+			c.bgResize(skey)
 			return true
 		}
 	default:
@@ -715,6 +832,9 @@ func setTypeRemove(c *client, skey []byte, subject interface{}, k interface{}) b
 
 func setTypeIsMember(subject interface{}, k interface{}) bool {
 	switch s := subject.(type) {
+	case *intset:
+		ll, ok := setTypeInteger(k)
+		return ok && s.Find(ll)
 	case *dict:
 		key, _ := getString(k)
 		_, _, _, de := s.find(key)
@@ -724,8 +844,14 @@ func setTypeIsMember(subject interface{}, k interface{}) bool {
 	}
 }
 
+// setTypeRandomElement returns a random member, an int64 for an intset.
 func setTypeRandomElement(subject interface{}) interface{} {
 	switch set := subject.(type) {
+	case *intset:
+		if set.Len() == 0 {
+			return nil
+		}
+		return set.Random()
 	case *dict:
 		de := set.randomKey()
 		if de == nil {
@@ -740,6 +866,8 @@ func setTypeRandomElement(subject interface{}) interface{} {
 
 func setTypeSize(subject interface{}) int {
 	switch s := subject.(type) {
+	case *intset:
+		return s.Len()
 	case *dict:
 		return s.size()
 	case nil:
@@ -749,10 +877,30 @@ func setTypeSize(subject interface{}) int {
 	}
 }
 
+// setTypeDup returns a copy of the set o, sized for its members so that it
+// does not need to rehash.
+func setTypeDup(o interface{}) interface{} {
+	switch s := o.(type) {
+	case *intset:
+		return s.deepCopy()
+	case *dict:
+		dup := NewDict(s.size(), 4)
+		iter := s.getIterator()
+		for de := iter.next(); de != nil; de = iter.next() {
+			dup.set(shadowCopyToPmem(de.key), nil)
+		}
+		return dup
+	default:
+		panic("Unknown set encoding")
+	}
+}
+
 func setTypeInitIterator(subject interface{}) *setTypeIterator {
 	si := new(setTypeIterator)
 	si.subject = subject
 	switch set := subject.(type) {
+	case *intset:
+		si.ii = 0
 	case *dict:
 		si.di = set.getIterator()
 	default:
@@ -761,8 +909,15 @@ func setTypeInitIterator(subject interface{}) *setTypeIterator {
 	return si
 }
 
+// setTypeNext returns the next member, an int64 for an intset, or nil.
 func setTypeNext(si *setTypeIterator) interface{} {
-	switch si.subject.(type) {
+	switch set := si.subject.(type) {
+	case *intset:
+		if si.ii >= set.Len() {
+			return nil
+		}
+		si.ii++
+		return set.Get(si.ii - 1)
 	case *dict:
 		de := si.di.next()
 		if de == nil {
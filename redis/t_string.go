@@ -91,21 +91,23 @@ func setGeneric(c *client, flags int, key, val []byte, expire []byte, ms bool, o
 		}
 	}
 
-	c.db.lockKeyWrite(key)
+	c.lockKeyWrite(key)
 	if ((flags&OBJ_SET_NX) > 0 && c.db.lookupKeyWrite(key) != nil) ||
 		((flags&OBJ_SET_XX) > 0 && c.db.lookupKeyWrite(key) == nil) {
 		if abortReply != nil {
 			c.addReply(abortReply)
 		} else {
-			c.addReply(shared.nullbulk)
+			c.addReplyNull()
 		}
 		return
 	}
 
 	c.db.setKey(shadowCopyToPmem(key), shadowCopyToPmemI(val))
+	c.notifyKeyspaceEvent(NOTIFY_STRING, "set", key)
 	if expire != nil {
 		when := time.Now().UnixNano() + ns
 		c.db.setExpire(key, when)
+		c.notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key)
 	}
 
 	if okReply != nil {
@@ -116,26 +118,29 @@ func setGeneric(c *client, flags int, key, val []byte, expire []byte, ms bool, o
 }
 
 func getCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
+	if c.lockKeyRead(c.argv[1]) {
 		getGeneric(c)
 	} else { // expired
-		c.addReply(shared.nullbulk)
+		c.addReplyNull()
 	}
 }
 
 func getsetCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	if !getGeneric(c) {
 		return
 	}
 	c.db.setKey(shadowCopyToPmem(c.argv[1]), shadowCopyToPmemI(c.argv[2]))
+	c.notifyKeyspaceEvent(NOTIFY_STRING, "set", c.argv[1])
 }
 
 func getGeneric(c *client) bool {
-	i := c.db.lookupKeyRead(c.argv[1])
-	v, ok := c.getStringOrReply(i, shared.nullbulk, shared.wrongtypeerr)
+	i := c.lookupKeyRead(c.argv[1])
+	v, ok := c.getStringOrReply(i, nil, shared.wrongtypeerr)
 	if v != nil {
 		c.addReplyBulk(v)
+	} else if ok {
+		c.addReplyNull()
 	}
 	return ok
 }
@@ -150,7 +155,7 @@ func setrangeCommand(c *client) {
 		return
 	}
 	update := c.argv[3]
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	v, ok := c.getStringOrReply(c.db.lookupKeyWrite(c.argv[1]), nil, shared.wrongtypeerr)
 	if !ok {
 		return
@@ -165,12 +170,15 @@ func setrangeCommand(c *client) {
 		}
 		if needed > len(v) {
 			c.db.setKey(shadowCopyToPmem(c.argv[1]), shadowConcatToPmemI(v, update, offset, needed))
+			c.notifyKeyspaceEvent(NOTIFY_STRING, "setrange", c.argv[1])
 			c.addReplyLongLong(int64(needed))
 		} else {
 			txn("undo") {
 			copy(v[offset:], update) // TODO: (mohitv) copy not supported yet
 			c.addReplyLongLong(int64(len(v)))
 			}
+			c.db.signalModifiedKey(c.argv[1])
+			c.notifyKeyspaceEvent(NOTIFY_STRING, "setrange", c.argv[1])
 		}
 	}
 }
@@ -187,8 +195,8 @@ func getrangeCommand(c *client) {
 
 	var v []byte
 	var ok bool
-	if c.db.lockKeyRead(c.argv[1]) { // not expired
-		v, ok = c.getStringOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptybulk, shared.wrongtypeerr)
+	if c.lockKeyRead(c.argv[1]) { // not expired
+		v, ok = c.getStringOrReply(c.lookupKeyRead(c.argv[1]), shared.emptybulk, shared.wrongtypeerr)
 		if v == nil || !ok {
 			return
 		}
@@ -221,15 +229,16 @@ func getrangeCommand(c *client) {
 
 func mgetCommand(c *client) {
 	c.addReplyMultiBulkLen(c.argc - 1)
-	alives := c.db.lockKeysRead(c.argv[1:], 1)
+	alives := c.lockKeysRead(c.argv[1:], 1)
 	for i, k := range c.argv[1:] {
 		if alives[i] {
-			v, _ := c.getStringOrReply(c.db.lookupKeyRead(k), shared.nullbulk, shared.nullbulk)
-			if v != nil {
+			if v, _ := getString(c.lookupKeyRead(k)); v != nil {
 				c.addReplyBulk(v)
+			} else {
+				c.addReplyNull()
 			}
 		} else { // expired key
-			c.addReply(shared.nullbulk)
+			c.addReplyNull()
 		}
 	}
 }
@@ -247,7 +256,7 @@ func msetGeneric(c *client, nx bool) {
 		c.addReplyError([]byte("wrong number of arguments for MSET"))
 		return
 	}
-	c.db.lockKeysWrite(c.argv[1:], 2)
+	c.lockKeysWrite(c.argv[1:], 2)
 	if nx {
 		for i := 1; i < c.argc; i += 2 {
 			if c.db.lookupKeyWrite(c.argv[i]) != nil {
@@ -259,6 +268,7 @@ func msetGeneric(c *client, nx bool) {
 
 	for i := 1; i < c.argc; i += 2 {
 		c.db.setKey(shadowCopyToPmem(c.argv[i]), shadowCopyToPmemI(c.argv[i+1]))
+		c.notifyKeyspaceEvent(NOTIFY_STRING, "set", c.argv[i])
 	}
 	if nx {
 		c.addReply(shared.cone)
@@ -269,7 +279,7 @@ func msetGeneric(c *client, nx bool) {
 
 func appendCommand(c *client) {
 	totlen := 0
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	v, ok := c.getStringOrReply(c.db.lookupKeyWrite(c.argv[1]), nil, shared.wrongtypeerr)
 	if !ok {
 		return
@@ -287,12 +297,13 @@ func appendCommand(c *client) {
 		// no need to copy c.argv[1] into pmem as we already know it exists in db in this case.
 		c.db.setKey(c.argv[1], shadowConcatToPmemI(v, c.argv[2], len(v), totlen))
 	}
+	c.notifyKeyspaceEvent(NOTIFY_STRING, "append", c.argv[1])
 	c.addReplyLongLong(int64(totlen))
 }
 
 func strlenCommand(c *client) {
-	if c.db.lockKeyRead(c.argv[1]) {
-		if v, _ := c.getStringOrReply(c.db.lookupKeyRead(c.argv[1]),
+	if c.lockKeyRead(c.argv[1]) {
+		if v, _ := c.getStringOrReply(c.lookupKeyRead(c.argv[1]),
 			shared.czero, shared.wrongtypeerr); v != nil {
 			c.addReplyLongLong(int64(len(v)))
 		}
@@ -330,7 +341,7 @@ func decrbyCommand(c *client) {
 }
 
 func incrDecrCommand(c *client, incr int64) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	if v, ok := c.getLongLongOrReply(c.db.lookupKeyWrite(c.argv[1]), nil); ok {
 		if (incr < 0 && v < 0 && incr < (math.MinInt64-v)) ||
 			(incr > 0 && v > 0 && incr > (math.MaxInt64-v)) {
@@ -342,12 +353,13 @@ func incrDecrCommand(c *client, incr int64) {
 
 		// TODO: use shared integers?
 		c.db.setKey(shadowCopyToPmem(c.argv[1]), v)
+		c.notifyKeyspaceEvent(NOTIFY_STRING, "incrby", c.argv[1])
 		c.addReplyLongLong(v)
 	}
 }
 
 func incrbyfloatCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	if v, ok := c.getLongDoubleOrReply(c.db.lookupKeyWrite(c.argv[1]), nil); ok {
 		if incr, ok := c.getLongDoubleOrReply(c.argv[2], nil); ok {
 			v += incr
@@ -356,6 +368,7 @@ func incrbyfloatCommand(c *client) {
 				return
 			}
 			c.db.setKey(shadowCopyToPmem(c.argv[1]), v)
+			c.notifyKeyspaceEvent(NOTIFY_STRING, "incrbyfloat", c.argv[1])
 			c.addReplyBulk([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
 		}
 	}
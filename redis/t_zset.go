@@ -189,9 +189,7 @@ func zaddGenericCommand(c *client, flags int) {
 	}
 
 	if incr && elements > 1 {
-		//c.addReplyError([]byte("INCR option supports a single increment-element pair"))
-		// TODO: check arity for cmd before the command function
-		c.addReplyError([]byte("wrong number of arguments"))
+		c.addReplyError([]byte("INCR option supports a single increment-element pair"))
 		return
 	}
 
@@ -213,7 +211,7 @@ func zaddGenericCommand(c *client, flags int) {
 	}
 
 	// Lookup the key and create the sorted set if does not exist.
-	c.db.lockKeyWrite(c.argv[1])
+	c.lockKeyWrite(c.argv[1])
 	zobj = c.db.lookupKeyWrite(c.argv[1])
 	if zobj == nil {
 		if xx {
@@ -259,7 +257,7 @@ reply_to_client:
 		if processed > 0 {
 			c.addReplyDouble(score)
 		} else {
-			c.addReply(shared.nullbulk)
+			c.addReplyNull()
 		}
 	} else { // ZADD.
 		if ch {
@@ -271,13 +269,18 @@ reply_to_client:
 
 cleanup:
 	if added > 0 || updated > 0 {
-		// TODO: notify key space event
+		c.db.signalModifiedKey(c.argv[1])
+		if incr {
+			c.notifyKeyspaceEvent(NOTIFY_ZSET, "zincr", c.argv[1])
+		} else {
+			c.notifyKeyspaceEvent(NOTIFY_ZSET, "zadd", c.argv[1])
+		}
 	}
 }
 
 func zremCommand(c *client) {
-	c.db.lockKeyWrite(c.argv[1])
-	zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	c.lockKeyWrite(c.argv[1])
+	zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 	if !ok || zobj == nil {
 		return
 	}
@@ -296,9 +299,11 @@ func zremCommand(c *client) {
 	}
 
 	if deleted > 0 {
-		// notify key space event
+		c.notifyKeyspaceEvent(NOTIFY_ZSET, "zrem", c.argv[1])
 		if keyremoved {
-
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.argv[1])
+		} else {
+			c.db.signalModifiedKey(c.argv[1])
 		}
 	}
 	c.addReplyLongLong(deleted)
@@ -347,7 +352,7 @@ func zremrangeGenericCommand(c *client, rangetype int) {
 	}
 
 	// Step 2: Lookup & range sanity checks if needed.
-	c.db.lockKeyWrite(key)
+	c.lockKeyWrite(key)
 	zobj, ok := c.getZsetOrReply(c.db.lookupKeyWrite(key), shared.czero)
 	if !ok || zobj == nil {
 		return
@@ -389,9 +394,10 @@ func zremrangeGenericCommand(c *client, rangetype int) {
 		}
 		if z.zsl.length == 0 {
 			c.db.delete(key)
+			keyremoved = true
 		}
 		if deleted > 0 {
-			go hashTypeBgResize(c.db, key)
+			c.bgResize(key)
 		}
 	default:
 		panic("Unknown sorted set encoding")
@@ -399,9 +405,17 @@ func zremrangeGenericCommand(c *client, rangetype int) {
 
 	// Step 4: Notifications and reply.
 	if deleted > 0 {
+		event := "zremrangebyrank"
+		if rangetype == ZRANGE_SCORE {
+			event = "zremrangebyscore"
+		} else if rangetype == ZRANGE_LEX {
+			event = "zremrangebylex"
+		}
+		c.notifyKeyspaceEvent(NOTIFY_ZSET, event, key)
 		if keyremoved {
-
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
 		}
+		c.db.signalModifiedKey(key)
 	}
 	c.addReplyLongLong(int64(deleted))
 }
@@ -414,6 +428,19 @@ func zrevrangeCommand(c *client) {
 	zrangeGenericCommand(c, true)
 }
 
+// addReplyScoredElement replies one element of a range, with its score if
+// requested. RESP3 clients get each element and score as a pair, RESP2 ones a
+// flat list.
+func (c *client) addReplyScoredElement(ele []byte, score float64, withscores bool) {
+	if withscores && c.resp > 2 {
+		c.addReplyMultiBulkLen(2)
+	}
+	c.addReplyBulk(ele)
+	if withscores {
+		c.addReplyDouble(score)
+	}
+}
+
 func zrangeGenericCommand(c *client, reverse bool) {
 	var (
 		start, end     int64
@@ -433,11 +460,11 @@ func zrangeGenericCommand(c *client, reverse bool) {
 		return
 	}
 
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
+	if !c.lockKeyRead(c.argv[1]) { // expired
 		c.addReply(shared.emptymultibulk)
 		return
 	}
-	zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 	if !ok || zobj == nil {
 		return
 	}
@@ -462,7 +489,7 @@ func zrangeGenericCommand(c *client, reverse bool) {
 	}
 	rangelen := end - start + 1
 	replylen := int(rangelen)
-	if withscores {
+	if withscores && c.resp == 2 {
 		replylen *= 2
 	}
 	c.addReplyMultiBulkLen(replylen)
@@ -485,10 +512,7 @@ func zrangeGenericCommand(c *client, reverse bool) {
 
 		for rangelen > 0 {
 			rangelen--
-			c.addReplyBulk(ln.ele)
-			if withscores {
-				c.addReplyDouble(ln.score)
-			}
+			c.addReplyScoredElement(ln.ele, ln.score, withscores)
 			if reverse {
 				ln = ln.backward
 			} else {
@@ -556,12 +580,12 @@ func genericZrangebyscoreCommand(c *client, reverse bool) {
 	}
 
 	// Ok, lookup the key and get the range
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
+	if !c.lockKeyRead(c.argv[1]) { // expired
 		c.addReply(shared.emptymultibulk)
 		return
 	}
 
-	zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 	if !ok || zobj == nil {
 		return
 	}
@@ -610,11 +634,7 @@ func genericZrangebyscoreCommand(c *client, reverse bool) {
 				}
 			}
 			rangelen++
-			c.addReplyBulk(ln.ele)
-
-			if withscores {
-				c.addReplyDouble(ln.score)
-			}
+			c.addReplyScoredElement(ln.ele, ln.score, withscores)
 
 			// Move to next node
 			if reverse {
@@ -628,7 +648,7 @@ func genericZrangebyscoreCommand(c *client, reverse bool) {
 		panic("Unknown sorted set encoding")
 	}
 
-	if withscores {
+	if withscores && c.resp == 2 {
 		rangelen *= 2
 	}
 	c.setDeferredMultiBulkLength(rangelen)
@@ -645,12 +665,12 @@ func zcountCommand(c *client) {
 	}
 
 	// Lookup the sorted set
-	if !c.db.lockKeyRead(key) { // expired
+	if !c.lockKeyRead(key) { // expired
 		c.addReply(shared.czero)
 		return
 	}
 	var count uint
-	if zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(key), shared.czero); ok && zobj != nil {
+	if zobj, ok := c.getZsetOrReply(c.lookupKeyRead(key), shared.czero); ok && zobj != nil {
 		switch zs := zobj.(type) {
 		case *zset:
 			// Find first element in range
@@ -685,12 +705,12 @@ func zlexcountCommand(c *client) {
 	}
 
 	// Lookup the sorted set
-	if !c.db.lockKeyRead(key) { // expired
+	if !c.lockKeyRead(key) { // expired
 		c.addReply(shared.czero)
 		return
 	}
 	var count uint
-	if zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(key), shared.czero); ok && zobj != nil {
+	if zobj, ok := c.getZsetOrReply(c.lookupKeyRead(key), shared.czero); ok && zobj != nil {
 		switch zs := zobj.(type) {
 		case *zset:
 			// Find first element in range
@@ -767,12 +787,12 @@ func genericZrangebylexCommand(c *client, reverse bool) {
 	}
 
 	// Ok, lookup the key and get the range
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
+	if !c.lockKeyRead(c.argv[1]) { // expired
 		c.addReply(shared.emptymultibulk)
 		return
 	}
 
-	zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
+	zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), shared.emptymultibulk)
 	if !ok || zobj == nil {
 		return
 	}
@@ -838,27 +858,29 @@ func genericZrangebylexCommand(c *client, reverse bool) {
 }
 
 func zcardCommand(c *client) {
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
+	if !c.lockKeyRead(c.argv[1]) { // expired
 		c.addReply(shared.czero)
 		return
 	}
 
-	if zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.czero); ok && zobj != nil {
+	if zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), shared.czero); ok && zobj != nil {
 		c.addReplyLongLong(int64(zsetLength(zobj)))
 	}
 }
 
 func zscoreCommand(c *client) {
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
-		c.addReply(shared.nullbulk)
+	if !c.lockKeyRead(c.argv[1]) { // expired
+		c.addReplyNull()
 		return
 	}
 
-	if zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.nullbulk); ok && zobj != nil {
+	if zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), nil); ok && zobj == nil {
+		c.addReplyNull()
+	} else if ok {
 		if score, ok := zsetScore(zobj, c.argv[2]); ok {
 			c.addReplyDouble(score)
 		} else {
-			c.addReply(shared.nullbulk)
+			c.addReplyNull()
 		}
 	}
 }
@@ -872,16 +894,18 @@ func zrevrankCommand(c *client) {
 }
 
 func zrankGenericCommand(c *client, reverse bool) {
-	if !c.db.lockKeyRead(c.argv[1]) { // expired
-		c.addReply(shared.nullbulk)
+	if !c.lockKeyRead(c.argv[1]) { // expired
+		c.addReplyNull()
 		return
 	}
 
-	if zobj, ok := c.getZsetOrReply(c.db.lookupKeyRead(c.argv[1]), shared.nullbulk); ok && zobj != nil {
+	if zobj, ok := c.getZsetOrReply(c.lookupKeyRead(c.argv[1]), nil); ok && zobj == nil {
+		c.addReplyNull()
+	} else if ok {
 		if rank, ok := zsetRank(zobj, c.argv[2], reverse); ok {
 			c.addReplyLongLong(int64(rank))
 		} else {
-			c.addReply(shared.nullbulk)
+			c.addReplyNull()
 		}
 	}
 }
@@ -920,7 +944,7 @@ func zunionInterGenericCommand(c *client, dstkey []byte, op int) {
 	keys := make([][]byte, setnum+1)
 	keys[0] = dstkey
 	copy(keys[1:], c.argv[3:])
-	c.db.lockKeysWrite(keys, 1)
+	c.lockKeysWrite(keys, 1)
 
 	src := make([]zsetopsrc, setnum)
 	for i := 0; i < setnum; i++ {
@@ -1047,11 +1071,19 @@ func zunionInterGenericCommand(c *client, dstkey []byte, op int) {
 	} else {
 		panic("Unknown operator")
 	}
-	c.db.delete(dstkey)
+	deleted := c.db.delete(dstkey)
 	if dstzset.zsl.length > 0 {
 		c.db.setKey(shadowCopyToPmem(dstkey), dstzset)
+		if op == SET_OP_UNION {
+			c.notifyKeyspaceEvent(NOTIFY_ZSET, "zunionstore", dstkey)
+		} else {
+			c.notifyKeyspaceEvent(NOTIFY_ZSET, "zinterstore", dstkey)
+		}
 		c.addReplyLongLong(int64(dstzset.zsl.length))
 	} else {
+		if deleted {
+			c.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dstkey)
+		}
 		c.addReply(shared.czero)
 	}
 }
@@ -1066,6 +1098,27 @@ func zsetCreate() *zset {
 	return zs
 }
 
+// zsetDup returns a copy of the sorted set o. The dict entries share the
+// elements of the new skiplist nodes like zsetAdd does.
+func zsetDup(o interface{}) interface{} {
+	switch zs := o.(type) {
+	case *zset:
+		dup := pnew(zset)
+		txn("undo") {
+		dup.dict = NewDict(int(zs.zsl.length), 4)
+		dup.zsl = zslCreate()
+		}
+		for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			ele := shadowCopyToPmem(x.ele)
+			dup.zsl.insert(x.score, ele)
+			dup.dict.set(ele, x.score)
+		}
+		return dup
+	default:
+		panic("Unknown sorted set encoding")
+	}
+}
+
 func zsetAdd(c *client, zobj interface{}, score float64, ele []byte, flags int) (int, float64, int) {
 	incr := (flags & ZADD_INCR) != 0
 	nx := (flags & ZADD_NX) != 0
@@ -1111,7 +1164,7 @@ func zsetAdd(c *client, zobj interface{}, score float64, ele []byte, flags int)
 			ele = shadowCopyToPmem(ele)
 			zs.zsl.insert(score, ele)
 			zs.dict.set(ele, score)
-			go hashTypeBgResize(c.db, c.argv[1])
+			c.bgResize(c.argv[1])
 			return 1, score, flags | ZADD_ADDED
 		} else {
 			return 1, 0, flags | ZADD_NOP
@@ -1133,7 +1186,7 @@ func zsetDel(c *client, zobj interface{}, ele []byte) bool {
 				panic("Zset dict and skiplist does not match!")
 			}
 			// TODO: resize
-			go hashTypeBgResize(c.db, c.argv[1])
+			c.bgResize(c.argv[1])
 			return true
 		}
 	default:
@@ -1670,6 +1723,8 @@ func (op *zsetopsrc) zuiLength() uint {
 		return s.zsl.length
 	case *dict:
 		return uint(s.size())
+	case *intset:
+		return uint(s.Len())
 	case nil:
 		return 0
 	default:
@@ -1684,6 +1739,8 @@ func (op *zsetopsrc) zuiInitIterator() {
 			node: s.zsl.header.level[0].forward}
 	case *dict:
 		op.iter = s.getIterator()
+	case *intset:
+		op.iter = setTypeInitIterator(s)
 	case nil:
 		op.iter = nil
 	default:
@@ -1710,6 +1767,14 @@ func (op *zsetopsrc) zuiNext(target *zsetopval) bool {
 			target.score = 1
 			return true
 		}
+	case *setTypeIterator:
+		ele := setTypeNext(it)
+		if ele == nil {
+			return false
+		}
+		target.ele, _ = getString(ele)
+		target.score = 1
+		return true
 	case nil:
 		return false
 	default:
@@ -1759,6 +1824,11 @@ func (op *zsetopsrc) zuiFind(val *zsetopval) (float64, bool) {
 		} else {
 			return 1, true
 		}
+	case *intset:
+		if setTypeIsMember(s, val.ele) {
+			return 1, true
+		}
+		return 0, false
 	case nil:
 		return 0, false
 	default:
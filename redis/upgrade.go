@@ -0,0 +1,133 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/vmware/go-pmem-transaction/transaction"
+)
+
+// Pools of the first layout hold a single database as the root object
+// "dbRoot", laid out as legacyRoot. Their dicts and entries are smaller than
+// the current ones, so they cannot be used in place. init copies them bucket
+// for bucket into a database of the current layout and publishes it in the
+// transaction that sets the magic of the new root. The entries keep their
+// dumbhash buckets, Server.migrateHash moves them online like the entries of
+// any other pool written before the hash was seeded.
+
+type (
+	legacyRoot struct {
+		dict   *legacyDict
+		expire *legacyDict
+		magic  int
+	}
+
+	legacyDict struct {
+		lock *sync.RWMutex
+		tab  [2]legacyTable
+
+		rehashLock *sync.RWMutex
+		rehashIdx  int
+
+		initSize       int
+		bucketPerShard int
+	}
+
+	legacyTable struct {
+		bucketlock []sync.RWMutex
+		bucket     []*legacyEntry
+		used       []int
+		mask       int
+	}
+
+	legacyEntry struct {
+		key   []byte
+		value interface{}
+		next  *legacyEntry
+	}
+)
+
+// convertLegacyDb returns a new database holding the keys of the database of
+// a pool of the first layout. The old objects are only read, so a crash
+// during the conversion leaves them intact for the next start, and the new
+// ones stay unreachable until init publishes them.
+func (s *Server) convertLegacyDb(l *legacyRoot) *redisDb {
+	db := pnew(redisDb)
+	txn("undo") {
+		db.dict = l.dict.convert()
+		db.expire = l.expire.convert()
+	}
+	return db
+}
+
+// convert copies ld into a new dict with the same tables, so every entry
+// stays in its bucket and a rehash in progress continues where it stopped.
+// Keys and values are shared with ld, except for the dicts nested in values,
+// which are converted too.
+func (ld *legacyDict) convert() *dict {
+	d := pnew(dict)
+	txn("undo") {
+		d.lock = new(sync.RWMutex)
+		d.rehashLock = new(sync.RWMutex)
+		d.rehashIdx = ld.rehashIdx
+		d.initSize = ld.initSize
+		d.bucketPerShard = ld.bucketPerShard
+	}
+	for t := range ld.tab {
+		lt, tab := &ld.tab[t], &d.tab[t]
+		txn("undo") {
+			d.resetTable(t, len(lt.bucket))
+			for s, u := range lt.used {
+				tab.used[s] = u
+			}
+		}
+		for i, le := range lt.bucket {
+			txn("undo") {
+				for next := &tab.bucket[i]; le != nil; le = le.next {
+					e := pnew(entry)
+					e.key = le.key
+					e.value = convertLegacyValue(le.value)
+					e.version = nextVersion()
+					*next = e
+					next = &e.next
+				}
+			}
+		}
+	}
+	return d
+}
+
+func (ld *legacyDict) size() int {
+	n := 0
+	for t := range ld.tab {
+		for _, u := range ld.tab[t].used {
+			n += u
+		}
+	}
+	return n
+}
+
+// convertLegacyValue returns v with its nested dicts converted. They were
+// stored as *dict values, but with the legacyDict layout.
+func convertLegacyValue(v interface{}) interface{} {
+	switch o := v.(type) {
+	case *dict:
+		ld := (*legacyDict)(unsafe.Pointer(o))
+		return ld.convert()
+	case *zset:
+		ld := (*legacyDict)(unsafe.Pointer(o.dict))
+		zs := pnew(zset)
+		txn("undo") {
+			zs.dict = ld.convert()
+			zs.zsl = o.zsl
+		}
+		return zs
+	default:
+		return v
+	}
+}
@@ -0,0 +1,206 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+// legacyDictSlot leaves room for a dict after a legacyDict, so the test can
+// store it as a *dict value without the pointer straddling allocations.
+type legacyDictSlot struct {
+	legacyDict
+	_ dict
+}
+
+// newLegacyDict returns a dict of the first pool layout holding kvs, placed
+// by dumbhash as the server of that layout did. A rehashing dict has moved
+// every other key to its second table.
+func newLegacyDict(size int, rehashing bool, kvs map[string]interface{}) *legacyDict {
+	ld := &pnew(legacyDictSlot).legacyDict
+	ld.initSize, ld.bucketPerShard = size, size
+	ld.rehashIdx = -1
+	ld.tab[1].mask = -1
+	for t := 0; t < 2; t++ {
+		if t == 0 || rehashing {
+			ld.tab[t].bucket = pmake([]*legacyEntry, size<<t)
+			ld.tab[t].used = pmake([]int, 1<<t)
+			ld.tab[t].mask = size<<t - 1
+		}
+	}
+	if rehashing {
+		ld.rehashIdx = 0
+	}
+	i := 0
+	for k, v := range kvs {
+		tab := &ld.tab[i%2]
+		if !rehashing {
+			tab = &ld.tab[0]
+		}
+		key := shadowCopyToPmem([]byte(k))
+		b := dumbhash(key) & tab.mask
+		e := pnew(legacyEntry)
+		e.key = key
+		e.value = v
+		e.next = tab.bucket[b]
+		tab.bucket[b] = e
+		tab.used[b/ld.bucketPerShard]++
+		i++
+	}
+	return ld
+}
+
+// newLegacyRoot returns the root of a pool of the first layout and the keys
+// of its database, with a set, a hash and a zset among strings.
+func newLegacyRoot() (*legacyRoot, map[string]interface{}, *zset) {
+	keys := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		keys[strconv.Itoa(i)] = shadowCopyToPmemI([]byte("v" + strconv.Itoa(i)))
+	}
+	set := newLegacyDict(4, false, map[string]interface{}{"1": nil, "22": nil, "333": nil})
+	keys["set"] = (*dict)(unsafe.Pointer(set))
+	hash := newLegacyDict(4, false, map[string]interface{}{"f": shadowCopyToPmemI([]byte("x"))})
+	keys["hash"] = (*dict)(unsafe.Pointer(hash))
+	zs := pnew(zset)
+	zs.zsl = zslCreate()
+	zs.zsl.insert(1.5, shadowCopyToPmem([]byte("m")))
+	zdict := newLegacyDict(4, false, map[string]interface{}{"m": 1.5})
+	zs.dict = (*dict)(unsafe.Pointer(zdict))
+	keys["zset"] = zs
+	l := pnew(legacyRoot)
+	l.dict = newLegacyDict(32, true, keys)
+	l.expire = newLegacyDict(8, false, map[string]interface{}{"7": int64(1 << 62)})
+	l.magic = MAGIC
+	return l, keys, zs
+}
+
+// assertSeeded checks that every entry of d is in the bucket of its seeded
+// hash.
+func assertSeeded(t *testing.T, d *dict) {
+	for i := range d.tab {
+		for b, e := range d.tab[i].bucket {
+			for ; e != nil; e = e.next {
+				assertEqual(t, d.hashKey(e.key)&d.tab[i].mask, b)
+			}
+		}
+	}
+}
+
+func TestConvertLegacyDb(t *testing.T) {
+	fmt.Println("Convert the database of a pool of the first layout.")
+	l, keys, zs := newLegacyRoot()
+	zdict := zs.dict
+	s := NewServer(DefaultConfig())
+	defer func(seed [2]uint64) { hashSeed = seed }(hashSeed)
+	hashSeed = [2]uint64{1, 2}
+	atomic.StoreInt32(&legacyHash, 1)
+	defer atomic.StoreInt32(&legacyHash, 0)
+	db := s.convertLegacyDb(l)
+
+	fmt.Println("Keep every entry in its bucket.")
+	assertEqual(t, db.dict.size(), len(keys))
+	assertEqual(t, db.dict.rehashIdx, 0)
+	for i := range l.dict.tab {
+		assertEqual(t, len(db.dict.tab[i].bucket), len(l.dict.tab[i].bucket))
+		for b, le := range l.dict.tab[i].bucket {
+			for e := db.dict.tab[i].bucket[b]; le != nil; le, e = le.next, e.next {
+				assertEqual(t, e.key, le.key)
+			}
+		}
+	}
+
+	fmt.Println("Find every key by its dumbhash bucket.")
+	for i := 0; i < 100; i++ {
+		_, _, _, e := db.dict.find([]byte(strconv.Itoa(i)))
+		v, _ := getString(e.value)
+		assertEqual(t, v, []byte("v"+strconv.Itoa(i)))
+	}
+	_, _, _, e := db.expire.find([]byte("7"))
+	assertEqual(t, e.value, int64(1<<62))
+
+	fmt.Println("Convert the dicts nested in values.")
+	_, _, _, e = db.dict.find([]byte("set"))
+	for _, m := range []string{"1", "22", "333"} {
+		_, _, _, me := e.value.(*dict).find([]byte(m))
+		assertEqual(t, me != nil, true)
+	}
+	assertEqual(t, e.value.(*dict).size(), 3)
+	_, _, _, e = db.dict.find([]byte("hash"))
+	_, _, _, fe := e.value.(*dict).find([]byte("f"))
+	v, _ := getString(fe.value)
+	assertEqual(t, v, []byte("x"))
+	_, _, _, e = db.dict.find([]byte("zset"))
+	z := e.value.(*zset)
+	_, _, _, me := z.dict.find([]byte("m"))
+	assertEqual(t, me.value, 1.5)
+	assertEqual(t, z != zs, true)
+	assertEqual(t, z.zsl == zs.zsl, true)
+
+	fmt.Println("Leave the old objects intact.")
+	assertEqual(t, l.magic, MAGIC)
+	assertEqual(t, l.dict.size(), len(keys))
+	assertEqual(t, zs.dict == zdict, true)
+}
+
+func TestMigrateHash(t *testing.T) {
+	fmt.Println("Migrate a converted database while clients use it.")
+	defer func(seed [2]uint64) { hashSeed = seed }(hashSeed)
+	hashSeed = [2]uint64{3, 4}
+	atomic.StoreInt32(&legacyHash, 1)
+	defer atomic.StoreInt32(&legacyHash, 0)
+	c := newTestClient(1)
+	s := c.s
+	l, keys, _ := newLegacyRoot()
+	db := s.convertLegacyDb(l)
+	s.initDb(0, db)
+	s.dbs[0], c.db = db, db
+	s.root = pnew(redisRoot)
+	s.root.dbs = pmake([]*redisDb, 1)
+	s.root.dbs[0] = db
+	s.hashRoot = pnew(hashRoot)
+	s.hashRoot.legacy = true
+
+	fmt.Println("Update legacy keys before the migration reaches them.")
+	assertEqual(t, runCommand(c, "SET", "5", "new"), "+OK\r\n")
+	assertEqual(t, runCommand(c, "HSET", "hash", "g", "y"), ":1\r\n")
+	assertEqual(t, runCommand(c, "SADD", "set", "4444"), ":1\r\n")
+	assertEqual(t, runCommand(c, "RENAME", "hash", "hash2"), "+OK\r\n")
+	assertEqual(t, runCommand(c, "DBSIZE"), ":"+strconv.Itoa(len(keys))+"\r\n")
+
+	s.crons.Add(1)
+	go s.migrateHash()
+	for n := 0; n == 0 || atomic.LoadInt32(&legacyHash) != 0; n++ {
+		k := strconv.Itoa(10 + n%90)
+		assertEqual(t, runCommand(c, "GET", k), "$3\r\nv"+k+"\r\n")
+		assertEqual(t, runCommand(c, "HGET", "hash2", "f"), "$1\r\nx\r\n")
+	}
+	s.crons.Wait()
+	assertEqual(t, s.hashRoot.legacy, false)
+
+	fmt.Println("Find every key by its seeded hash.")
+	assertSeeded(t, db.dict)
+	assertSeeded(t, db.expire)
+	for i := 0; i < 100; i++ {
+		if k := strconv.Itoa(i); i != 5 {
+			assertEqual(t, runCommand(c, "GET", k), fmt.Sprintf("$%d\r\nv%s\r\n", len(k)+1, k))
+		}
+	}
+	assertEqual(t, runCommand(c, "GET", "5"), "$3\r\nnew\r\n")
+	assertEqual(t, runCommand(c, "HGET", "hash2", "f"), "$1\r\nx\r\n")
+	assertEqual(t, runCommand(c, "HGET", "hash2", "g"), "$1\r\ny\r\n")
+	assertEqual(t, runCommand(c, "SCARD", "set"), ":4\r\n")
+	assertEqual(t, runCommand(c, "SISMEMBER", "set", "22"), ":1\r\n")
+	assertEqual(t, runCommand(c, "ZSCORE", "zset", "m"), "$3\r\n1.5\r\n")
+	assertEqual(t, runCommand(c, "DBSIZE"), ":"+strconv.Itoa(len(keys))+"\r\n")
+	_, _, _, e := db.dict.find([]byte("set"))
+	assertSeeded(t, e.value.(*dict))
+	_, _, _, e = db.dict.find([]byte("zset"))
+	assertSeeded(t, e.value.(*zset).dict)
+}
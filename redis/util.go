@@ -0,0 +1,252 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import "strconv"
+
+// splitArgs splits a line into arguments the way redis-cli and the inline
+// protocol do (sdssplitargs in redis): arguments are separated by spaces and
+// may be quoted. Double quoted arguments understand \n, \r, \t, \b, \a and
+// \xHH escapes, single quoted ones only \'. A closing quote must be followed
+// by a space or the end of the line. ok is false for unbalanced quotes.
+func splitArgs(line []byte) (args [][]byte, ok bool) {
+	p := 0
+	for {
+		// skip blanks
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, true
+		}
+		var (
+			inq, insq, done bool
+			current         = []byte{}
+		)
+		for !done {
+			if p == len(line) {
+				if inq || insq {
+					return nil, false // unterminated quotes
+				}
+				break
+			}
+			ch := line[p]
+			if inq {
+				if ch == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					current = append(current, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				} else if ch == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						ch = '\n'
+					case 'r':
+						ch = '\r'
+					case 't':
+						ch = '\t'
+					case 'b':
+						ch = '\b'
+					case 'a':
+						ch = '\a'
+					default:
+						ch = line[p]
+					}
+					current = append(current, ch)
+				} else if ch == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			} else if insq {
+				if ch == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if ch == '\'' {
+					// closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				} else {
+					current = append(current, ch)
+				}
+			} else {
+				switch ch {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, ch)
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, current)
+	}
+}
+
+// string2ll parses s as a decimal integer like string2ll in redis. Only the
+// canonical form of an integer is accepted, so that formatting it back gives
+// s: "01", "+1" and "-0" are not integers.
+func string2ll(s []byte) (int64, bool) {
+	ll, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil || strconv.FormatInt(ll, 10) != string(s) {
+		return 0, false
+	}
+	return ll, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// stringmatch reports whether str matches the glob-style pattern the way
+// redis does (stringmatchlen in redis): '*' matches any string, '?' any
+// character and [...] a set of characters, which may contain ranges like
+// a-z and is negated by a leading '^'. A backslash escapes the next
+// character, also inside a set.
+func stringmatch(pattern, str []byte, nocase bool) bool {
+	skipLongerMatches := false
+	return stringmatchImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+// Patterns with more nested stars than this never match, like in redis.
+const stringmatchMaxNesting = 1000
+
+// stringmatchImpl matches like stringmatch, with the fix of CVE-2022-36021
+// against exponential backtracking: once the rest of the pattern after a star
+// matched no suffix of str, it matches no shorter suffix either, so the outer
+// stars stop trying longer matches of their own.
+func stringmatchImpl(pattern, str []byte, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	if nesting > stringmatchMaxNesting {
+		return false
+	}
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for ; s < len(str); s++ {
+				if stringmatchImpl(pattern[p+1:], str[s:], nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+			}
+			*skipLongerMatches = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p == len(pattern) {
+					// unterminated set, the last character ends it
+					p--
+					break
+				}
+				if pattern[p] == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if len(pattern)-p >= 2 {
+				p++
+			}
+			fallthrough
+		default:
+			if !equalByte(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
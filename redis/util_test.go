@@ -0,0 +1,103 @@
+///////////////////////////////////////////////////////////////////////
+// Copyright 2018-2019 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+///////////////////////////////////////////////////////////////////////
+
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	fmt.Println("Split unquoted, double and single quoted arguments.")
+	args, ok := splitArgs([]byte("  set  key\t\"a \\\"b\\\"\\n\\x41\" 'it\\'s' \"\" "))
+	assertEqual(t, ok, true)
+	assertEqual(t, len(args), 5)
+	assertEqual(t, args[0], []byte("set"))
+	assertEqual(t, args[1], []byte("key"))
+	assertEqual(t, args[2], []byte("a \"b\"\nA"))
+	assertEqual(t, args[3], []byte("it's"))
+	assertEqual(t, args[4], []byte{})
+
+	args, ok = splitArgs([]byte("   "))
+	assertEqual(t, ok, true)
+	assertEqual(t, len(args), 0)
+
+	fmt.Println("Reject unbalanced quotes.")
+	for _, line := range []string{"\"abc", "'abc", "\"a\"b", "'a'b", "a \"b\\\""} {
+		_, ok = splitArgs([]byte(line))
+		assertEqual(t, ok, false)
+	}
+}
+
+func TestStringMatch(t *testing.T) {
+	fmt.Println("Match glob-style patterns.")
+	for _, m := range []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "", false}, // same as redis
+		{"*", "news.sport", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "new.sport", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h**o", "ho", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"a[", "a[", false},
+		{"a[b", "ab", true},
+		{"abc", "ab", false},
+		{"ab", "abc", false},
+	} {
+		if stringmatch([]byte(m.pattern), []byte(m.str), false) != m.match {
+			t.Fatal("wrong match of", m.pattern, "against", m.str)
+		}
+	}
+
+	fmt.Println("Match ignoring case.")
+	assertEqual(t, stringmatch([]byte("H[A-C]LLO"), []byte("hbllo"), true), true)
+	assertEqual(t, stringmatch([]byte("H[A-C]LLO"), []byte("hbllo"), false), false)
+
+	fmt.Println("Match pathological patterns without backtracking exponentially.")
+	done := make(chan bool)
+	go func() {
+		done <- stringmatch([]byte(strings.Repeat("*a", 12)+"b"), bytes.Repeat([]byte("a"), 40), false)
+	}()
+	select {
+	case match := <-done:
+		assertEqual(t, match, false)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stringmatch backtracks exponentially")
+	}
+	assertEqual(t, stringmatch([]byte(strings.Repeat("*", 2000)+"a"), []byte("a"), false), true)
+	assertEqual(t, stringmatch([]byte(strings.Repeat("*a", 1001)), bytes.Repeat([]byte("a"), 1001), false), false)
+	assertEqual(t, stringmatch([]byte("*a*b*c"), []byte("xaxxbxxxc"), false), true)
+}
+
+func TestString2ll(t *testing.T) {
+	fmt.Println("Parse canonical integers only.")
+	for _, s := range []string{"0", "-1", "42", "9223372036854775807", "-9223372036854775808"} {
+		ll, ok := string2ll([]byte(s))
+		assertEqual(t, ok, true)
+		assertEqual(t, fmt.Sprint(ll), s)
+	}
+	for _, s := range []string{"", "01", "+1", "-0", " 1", "1 ", "1.0", "9223372036854775808"} {
+		_, ok := string2ll([]byte(s))
+		assertEqual(t, ok, false)
+	}
+}
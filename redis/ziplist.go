@@ -11,7 +11,6 @@ import (
 	"fmt"
 	"math"
 	"runtime"
-	"strconv"
 	"unsafe"
 
 	"github.com/vmware/go-pmem-transaction/transaction"
@@ -440,7 +439,7 @@ func zipTryEncoding(val interface{}) ([]byte, int64, byte) {
 		if len(v) >= 32 || len(v) == 0 {
 			return v, 0, 0
 		} else {
-			if ll, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			if ll, ok := string2ll(v); ok {
 				value = ll
 			} else {
 				return v, 0, 0
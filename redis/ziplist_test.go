@@ -7,9 +7,6 @@ package redis
 
 import (
 	"fmt"
-	"os"
-	"pmem/region"
-	"runtime"
 	"testing"
 
 	"github.com/vmware/go-pmem-transaction/transaction"
@@ -17,14 +14,11 @@ import (
 
 func TestZiplistBasic(t *testing.T) {
 	fmt.Println("Basic index/get tests.")
-	os.Remove("testziplist")
-	offset := runtime.PmallocInit("testziplist", transaction.LOGSIZE, DATASIZE)
-	region.InitMeta(offset, transaction.LOGSIZE, UUID)
 	tx := transaction.NewUndo()
 	tx.Begin()
-	zl, list := createList(tx)
-	zl2, list2 := createList(tx)
-	tx.Commit()
+	zl, list := createList()
+	zl2, list2 := createList()
+	tx.End()
 
 	var p int
 	var v interface{}
@@ -130,7 +124,7 @@ func TestZiplistBasic(t *testing.T) {
 	for v != nil {
 		i++
 		assertEqual(t, v, list[len(list)-i])
-		zl.Delete(tx, p)
+		zl.Delete(p)
 		p = zl.Prev(p)
 		v = zl.Get(p)
 	}
@@ -140,7 +134,7 @@ func TestZiplistBasic(t *testing.T) {
 
 	fmt.Println("Delete inclusive range 0,0.")
 	tx.Begin()
-	zl.DeleteRange(tx, 0, 1)
+	zl.DeleteRange(0, 1)
 	assertEqual(t, zl.entries, uint(3))
 	assertEqual(t, zl.Get(0), list[1])
 	assertEqual(t, zl.Find(list[1], 0), 0)
@@ -151,7 +145,7 @@ func TestZiplistBasic(t *testing.T) {
 
 	fmt.Println("Delete inclusive range 0,1.")
 	tx.Begin()
-	zl.DeleteRange(tx, 0, 2)
+	zl.DeleteRange(0, 2)
 	assertEqual(t, zl.entries, uint(2))
 	assertEqual(t, zl.Get(0), list[2])
 	assertEqual(t, zl.Find(list[0], 0), -1)
@@ -163,7 +157,7 @@ func TestZiplistBasic(t *testing.T) {
 
 	fmt.Println("Delete inclusive range 1,2.")
 	tx.Begin()
-	zl.DeleteRange(tx, 1, 2)
+	zl.DeleteRange(1, 2)
 	assertEqual(t, zl.entries, uint(2))
 	assertEqual(t, zl.Get(0), list[0])
 	assertEqual(t, zl.Find(list[1], 0), -1)
@@ -175,7 +169,7 @@ func TestZiplistBasic(t *testing.T) {
 
 	fmt.Println("Delete with start index out of range.")
 	tx.Begin()
-	zl.DeleteRange(tx, 5, 1)
+	zl.DeleteRange(5, 1)
 	assertEqual(t, zl.entries, uint(4))
 	assertEqual(t, zl.Get(0), list[0])
 	assertEqual(t, zl.Find(list[0], 0), 0)
@@ -186,7 +180,7 @@ func TestZiplistBasic(t *testing.T) {
 
 	fmt.Println("Delete with num overflow.")
 	tx.Begin()
-	zl.DeleteRange(tx, 1, 5)
+	zl.DeleteRange(1, 5)
 	assertEqual(t, zl.entries, uint(1))
 	assertEqual(t, zl.Find(list[1], 0), -1)
 	assertEqual(t, zl.Find(list[0], 0), 0)
@@ -194,11 +188,11 @@ func TestZiplistBasic(t *testing.T) {
 
 	fmt.Println("Merge test.")
 	tx.Begin()
-	zl3 := ziplistNew(tx)
-	zl4 := ziplistNew(tx)
-	zl3.Merge(tx, zl4)
+	zl3 := ziplistNew()
+	zl4 := ziplistNew()
+	zl3.Merge(zl4)
 	assertEqual(t, zl3.Len(), 0)
-	zl.Merge(tx, zl2)
+	zl.Merge(zl2)
 	assertEqual(t, zl.entries, uint(8))
 	tmplist := append(list, list2...)
 	for i := 0; i < 8; i++ {
@@ -212,12 +206,12 @@ func TestZiplistBasic(t *testing.T) {
 	tx.Abort()
 }
 
-func createList(tx transaction.TX) (*ziplist, []interface{}) {
-	zl := ziplistNew(tx)
-	zl.Push(tx, []byte("foo"), false)
-	zl.Push(tx, []byte("quux"), false)
-	zl.Push(tx, []byte("hello"), true)
-	zl.Push(tx, int64(1024), false)
+func createList() (*ziplist, []interface{}) {
+	zl := ziplistNew()
+	zl.Push([]byte("foo"), false)
+	zl.Push([]byte("quux"), false)
+	zl.Push([]byte("hello"), true)
+	zl.Push(int64(1024), false)
 	list := []interface{}{[]byte("hello"), []byte("foo"), []byte("quux"), int64(1024)}
 	return zl, list
 }